@@ -0,0 +1,153 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/nixomose/nixomosegotools/tools"
+	"github.com/nixomose/stree_v/stree_v_lib/stree_v_lib"
+)
+
+/* if the backing store is a file, it grows a block at a time as the stree writes past the end of it,
+   and a few hundred gig file grown that way ends up in pieces all over the disk, which kills read
+   throughput. so catalog add can lay the store out up front:
+	 preallocate: fallocate the whole thing, so the filesystem can hand out big contiguous extents.
+	 sparse: set the file size to the whole thing and write nothing, so it's explicitly a sparse file
+	         and you can see how big it's going to get.
+	 empty means leave it alone and let it grow, which is what it always did.
+	 the whole thing is the header plus every block the device needs if nothing compresses, or the
+	 whole store if that's smaller.
+	 the stree truncates the file when it frees blocks off the end, which gives back the tail of a
+	 preallocated store, so we fallocate again every time the device starts. that's cheap if the space
+	 is already there. block devices and ramdisks have nothing to allocate. a mirror gets laid out the
+	 same way as the primary. */
+
+const ALLOCATION_PREALLOCATE = "preallocate"
+const ALLOCATION_SPARSE = "sparse"
+
+const STAT_BLOCK_SIZE = 512 // st_blocks is always in 512 byte units, no matter what the filesystem uses
+
+func (this *Lbd_lib) validate_allocation(allocation string) tools.Ret {
+	switch allocation {
+	case "", ALLOCATION_PREALLOCATE, ALLOCATION_SPARSE:
+		return nil
+	}
+	return tools.Error(this.log, "invalid allocation: ", allocation, ", must be ", ALLOCATION_PREALLOCATE,
+		" or ", ALLOCATION_SPARSE)
+}
+
+func (this *Lbd_lib) get_backing_store_extents(device *Lbd_device) (tools.Ret, []uint64) {
+	/* how many bytes of each backing storage file the device can end up using. */
+	var key_length, value_length, additional_nodes_per_block, key_type, value_type = this.get_init_size_values(device)
+	var ret, block_size = stree_v_lib.Calculate_block_size(this.log, key_type, value_type, key_length, value_length, additional_nodes_per_block)
+	if ret != nil {
+		return ret, nil
+	}
+	block_size = this.get_store_block_size(device, block_size)
+	var alignment = device.Alignment
+	if alignment == 0 {
+		alignment = block_size
+		if device.Directio {
+			alignment = PHYSICAL_BLOCK_SIZE
+		}
+	}
+	var aligned_block_size = (uint64(block_size) + uint64(alignment) - 1) / uint64(alignment) * uint64(alignment)
+
+	var total_blocks uint64
+	ret, total_blocks = this.get_backing_store_total_blocks(device, block_size, alignment)
+	if ret != nil {
+		return ret, nil
+	}
+
+	var entry_size = uint64(device.Stree_value_size) * uint64(device.Additional_nodes_per_block+1)
+	var entries = (device.Size + entry_size - 1) / entry_size
+	var blocks = entries*uint64(device.Additional_nodes_per_block+1) + 1 // +1 for the header block
+	if blocks > total_blocks {
+		blocks = total_blocks
+	}
+	if len(device.Storage_layout) > 0 {
+		var mstore = New_multi_file_store(this.log, device.Storage_layout, this.get_storage_files(device), block_size,
+			alignment, device.Additional_nodes_per_block, device.Sync, this.get_file_store_io_path(device), this.get_backing_store_size)
+		return mstore.Calc_member_extents(blocks)
+	}
+	return nil, []uint64{blocks * aligned_block_size}
+}
+
+func (this *Lbd_lib) allocate_backing_store(device *Lbd_device) tools.Ret {
+	if len(device.Allocation) == 0 || device.stree_ramdisk || device.device_ramdisk {
+		return nil
+	}
+	var ret, extents = this.get_backing_store_extents(device)
+	if ret != nil {
+		return ret
+	}
+	var total uint64 = 0
+	for lp, storage_file := range this.get_storage_files(device) {
+		ret = this.allocate_backing_file(storage_file, device.Allocation, extents[lp])
+		if ret != nil {
+			return ret
+		}
+		total += extents[lp]
+	}
+	if len(device.Mirror_storage_file) > 0 {
+		/* the mirror holds everything the primary does, a few header blocks over is fine. */
+		return this.allocate_backing_file(device.Mirror_storage_file, device.Allocation, total)
+	}
+	return nil
+}
+
+func (this *Lbd_lib) allocate_backing_file(storage_file string, allocation string, extent uint64) tools.Ret {
+	var info, err = os.Stat(storage_file)
+	if err == nil && info.Mode().IsRegular() == false {
+		this.log.Debug("backing storage: ", storage_file, " is not a file, nothing to ", allocation)
+		return nil
+	}
+
+	var fh *os.File
+	fh, err = os.OpenFile(storage_file, os.O_RDWR|os.O_CREATE, CATALOG_FILE_PERMISSIONS)
+	if err != nil {
+		return tools.Error(this.log, "unable to open backing storage: ", storage_file, " to allocate it, err: ", err)
+	}
+	defer fh.Close()
+
+	switch allocation {
+	case ALLOCATION_PREALLOCATE:
+		this.log.Info("preallocating ", tools.Prettylargenumber_uint64(extent), " bytes for backing storage: ", storage_file)
+		err = syscall.Fallocate(int(fh.Fd()), 0, 0, int64(extent))
+		if err != nil {
+			return tools.Error(this.log, "unable to preallocate backing storage: ", storage_file, " err: ", err)
+		}
+	case ALLOCATION_SPARSE:
+		if info != nil && uint64(info.Size()) >= extent {
+			return nil
+		}
+		this.log.Info("sizing sparse backing storage: ", storage_file, " to ", tools.Prettylargenumber_uint64(extent), " bytes")
+		err = fh.Truncate(int64(extent))
+		if err != nil {
+			return tools.Error(this.log, "unable to size sparse backing storage: ", storage_file, " err: ", err)
+		}
+	}
+	return nil
+}
+
+func (this *Lbd_lib) get_backing_store_allocation(paths []string) (bool, uint64, uint64) {
+	/* the size the files say they are, and how much disk is actually behind them. only means anything for files. */
+	var any_files = false
+	var apparent, allocated uint64
+	for _, path := range paths {
+		var st syscall.Stat_t
+		if err := syscall.Stat(path, &st); err != nil {
+			continue
+		}
+		if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+			continue
+		}
+		any_files = true
+		apparent += uint64(st.Size)
+		allocated += uint64(st.Blocks) * STAT_BLOCK_SIZE
+	}
+	return any_files, apparent, allocated
+}
@@ -0,0 +1,212 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/nixomose/nixomosegotools/tools"
+	"github.com/nixomose/stree_v/stree_v_lib/stree_v_lib"
+	"github.com/nixomose/zosbd2goclient/zosbd2cmdlib/zosbd2interfaces"
+)
+
+/* the device size can be bigger than what the backing store can hold, that's the point of the
+   kompressor, but if the data doesn't compress, the free position marches up to the block count
+	 and then writes start failing wherever they happen to land, which is the worst possible way
+	 to find out. so the catalog entry can set a soft and hard watermark, as a percent of the
+	 backing store blocks. crossing the soft one we complain loudly. crossing the hard one we
+	 complain loudly and make the device read only (tell the kernel, and refuse writes ourselves in case
+	 the kernel didn't hear us) so the filesystem gets one clean error instead of a pile of random
+	 ones. discards always go through, they're the way to make room (fstrim), and once usage drops back
+	 under the hard watermark we make the device writable again. either way, if there's a hook configured, we run it with the device name, the level and the percent. */
+
+const CAPACITY_OK = 0
+const CAPACITY_SOFT = 1
+const CAPACITY_HARD = 2
+
+const TXT_CAPACITY_OK = "ok"
+const TXT_CAPACITY_SOFT = "soft"
+const TXT_CAPACITY_HARD = "hard"
+
+const TXT_BLOCKDEV_CMD = "blockdev"
+const TXT_BLOCKDEV_SETRO = "--setro"
+const TXT_BLOCKDEV_SETRW = "--setrw"
+
+var capacity_level_names = []string{TXT_CAPACITY_OK, TXT_CAPACITY_SOFT, TXT_CAPACITY_HARD}
+
+type capacity_guard struct {
+	lib     *Lbd_lib
+	log     *tools.Nixomosetools_logger
+	lock    sync.Mutex
+	metrics *Device_metrics
+
+	device_name  string
+	stree        *stree_v_lib.Stree_v
+	storage      zosbd2interfaces.Storage_mechanism
+	soft_percent int
+	hard_percent int
+	hook         string
+
+	level     int
+	read_only bool
+}
+
+var _ zosbd2interfaces.Storage_mechanism = &capacity_guard{}
+var _ zosbd2interfaces.Storage_mechanism = (*capacity_guard)(nil)
+
+func (this *Lbd_lib) validate_capacity_watermarks(soft_percent int, hard_percent int) tools.Ret {
+	if soft_percent < 0 || soft_percent > 100 || hard_percent < 0 || hard_percent > 100 {
+		return tools.Error(this.log, "capacity watermarks must be a percent between 0 and 100, 0 means off")
+	}
+	if soft_percent > 0 && hard_percent > 0 && soft_percent > hard_percent {
+		return tools.Error(this.log, "the soft capacity watermark: ", soft_percent, " can not be above the hard one: ", hard_percent)
+	}
+	return nil
+}
+
+func (this *Lbd_lib) wrap_capacity_guard(device *Lbd_device, storage zosbd2interfaces.Storage_mechanism,
+	metrics *Device_metrics) zosbd2interfaces.Storage_mechanism {
+	if device.stree == nil || (device.Capacity_soft_percent == 0 && device.Capacity_hard_percent == 0) {
+		return storage // nothing to watch, or nothing to watch it with
+	}
+	var ret capacity_guard
+	ret.lib = this
+	ret.log = this.log
+	ret.metrics = metrics
+	ret.device_name = device.Device_name
+	ret.stree = device.stree
+	ret.storage = storage
+	ret.soft_percent = device.Capacity_soft_percent
+	ret.hard_percent = device.Capacity_hard_percent
+	ret.hook = device.Capacity_hook
+	ret.level = CAPACITY_OK
+	ret.read_only = false
+
+	/* it may already be over when we start. */
+	ret.check()
+	return &ret
+}
+
+func (this *capacity_guard) check() {
+	var ret, used_blocks = this.stree.Get_used_blocks()
+	if ret != nil {
+		return
+	}
+	var total_blocks uint32
+	ret, total_blocks = this.stree.Get_total_blocks()
+	if ret != nil || total_blocks == 0 {
+		return
+	}
+	var percent = int(uint64(used_blocks) * 100 / uint64(total_blocks))
+
+	var level = CAPACITY_OK
+	if this.hard_percent > 0 && percent >= this.hard_percent {
+		level = CAPACITY_HARD
+	} else if this.soft_percent > 0 && percent >= this.soft_percent {
+		level = CAPACITY_SOFT
+	}
+	if level == this.level {
+		return
+	}
+	var old_level = this.level
+	this.level = level
+	this.metrics.Set_capacity_level(level)
+	if level != CAPACITY_HARD {
+		this.set_read_write()
+	}
+
+	switch level {
+	case CAPACITY_OK:
+		this.log.Info("backing store for device: ", this.device_name, " is back under its capacity watermarks at ", percent, "%")
+	case CAPACITY_SOFT:
+		if old_level == CAPACITY_OK {
+			this.log.Error("WARNING backing store for device: ", this.device_name, " is ", percent,
+				"% full, past its soft watermark of ", this.soft_percent, "%")
+		} else {
+			this.log.Info("backing store for device: ", this.device_name, " is back under its hard watermark at ", percent, "%")
+		}
+	case CAPACITY_HARD:
+		this.log.Error("WARNING backing store for device: ", this.device_name, " is ", percent,
+			"% full, past its hard watermark of ", this.hard_percent, "%, making the device read only.")
+		this.set_read_only()
+	}
+	this.lib.log_event(EVENT_CAPACITY, this.device_name, map[string]interface{}{"level": capacity_level_names[level],
+		"percent": percent}, nil)
+	this.run_hook(level, percent)
+}
+
+func (this *capacity_guard) set_read_only() {
+	if this.read_only {
+		return
+	}
+	this.read_only = true
+	this.metrics.Set_read_only(true)
+	/* tell the kernel, so the filesystem finds out before it sends us anything. we refuse writes either way. */
+	this.run_blockdev(TXT_BLOCKDEV_SETRO, "read only")
+}
+
+func (this *capacity_guard) set_read_write() {
+	if this.read_only == false {
+		return
+	}
+	this.read_only = false
+	this.metrics.Set_read_only(false)
+	this.log.Info("making device: ", this.device_name, " writable again")
+	this.run_blockdev(TXT_BLOCKDEV_SETRW, "writable")
+}
+
+func (this *capacity_guard) run_blockdev(flag string, what string) {
+	go func() {
+		var handle = exec.Command(TXT_BLOCKDEV_CMD, flag, TXT_DEVICE_PATH_PREFIX+this.device_name)
+		var output, err = handle.CombinedOutput()
+		if err != nil {
+			this.log.Error("unable to set device: ", this.device_name, " ", what, " in the kernel: ", err, " ", string(output))
+		}
+	}()
+}
+
+func (this *capacity_guard) run_hook(level int, percent int) {
+	if len(this.hook) == 0 {
+		return
+	}
+	/* don't hold up the block device waiting for somebody's script. */
+	go func() {
+		var handle = exec.Command(this.hook, this.device_name, capacity_level_names[level], strconv.Itoa(percent))
+		var output, err = handle.CombinedOutput()
+		if err != nil {
+			this.log.Error("capacity hook: ", this.hook, " for device: ", this.device_name, " failed: ", err, " ", string(output))
+		}
+	}()
+}
+
+func (this *capacity_guard) Read_block(start_in_bytes uint64, length uint32, data []byte) tools.Ret {
+	return this.storage.Read_block(start_in_bytes, length, data)
+}
+
+func (this *capacity_guard) Write_block(start_in_bytes uint64, length uint32, data []byte) tools.Ret {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.read_only {
+		return tools.ErrorWithCodeNoLog(this.log, int(syscall.EROFS), "device: ", this.device_name, " is read only, backing store is full")
+	}
+	var ret = this.storage.Write_block(start_in_bytes, length, data)
+	this.check()
+	return ret
+}
+
+func (this *capacity_guard) Discard_block(start_in_bytes uint64, length uint32) tools.Ret {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	/* even when we're read only, freeing space is how we stop being read only. */
+	var ret = this.storage.Discard_block(start_in_bytes, length)
+	this.check()
+	return ret
+}
+
+func (this *capacity_guard) Get_block_size() uint32 {
+	return this.storage.Get_block_size()
+}
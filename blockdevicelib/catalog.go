@@ -61,6 +61,59 @@ type Catalog_entry struct {
 
 	Exclude_from_start_all bool // by default we include all catalog entries when we say start all
 
+	/* names of other catalog entries that must be started (and mounted if they mount) before this one
+	   on start all. stop all goes in the reverse order. */
+	Start_after []string
+	/* of the devices that are free to start at the same time, lower numbers go first. */
+	Priority int
+
+	/* what to do if the block device handler fails: never, on-failure or always. empty means never. */
+	Restart                 string
+	Restart_max_retries     int
+	Restart_backoff_seconds int
+
+	/* where the handler serves metrics, host:port or unix:/path, empty means use the config file's socket dir if set. */
+	Metrics_listen string
+
+	/* percent of the backing store blocks in use at which we complain (soft) and go read only (hard), 0 is off.
+	   the hook is run with the device name, soft, hard or ok, and the percent when we cross one. */
+	Capacity_soft_percent int
+	Capacity_hard_percent int
+	Capacity_hook         string
+
+	/* the config file profile the settings came from when it was added, just so you know. */
+	Profile string
+
+	/* preallocate or sparse, how catalog add laid out a file backing store, empty means it grows as it's written. */
+	Allocation string
+
+	/* concat or stripe if the store is spread over the local storage file and the additional storage files,
+	   in that order. empty means it's all in the local storage file. */
+	Storage_layout           string
+	Additional_storage_files []string
+
+	/* a second copy of the whole backing store, written along with it, read if it can't be. */
+	Mirror_storage_file string
+
+	/* a checksum on every block, which changes the layout so it's only set at catalog add, and how many
+	   blocks a second the handler reads back in the background to check them, 0 is off. */
+	Checksums  bool
+	Scrub_rate int
+
+	/* where the encryption key comes from, a keyfile or an environment variable with a passphrase in it,
+	   never the key itself. the salt and the key check are made by catalog add. everything in the stree
+	   is written encrypted or not from the start, so it's only set at catalog add. */
+	Encryption_keyfile        string
+	Encryption_passphrase_env string
+	Encryption_salt           string
+	Encryption_key_check      string
+
+	/* arbitrary key=value labels, so catalog list, start all and stop all can pick out a group with a selector. */
+	Labels map[string]string
+
+	/* set by catalog reconcile when this entry can't be started, says why. start refuses to start it until
+	   a later reconcile finds the problem gone. */
+	Broken string
 }
 
 func New_catalog_entry_from_device(device *Lbd_device) Catalog_entry {
@@ -77,6 +130,27 @@ func New_catalog_entry_from_device(device *Lbd_device) Catalog_entry {
 	entry.Mount = device.Mount
 	entry.Mountpoint = device.Mountpoint
 	entry.Exclude_from_start_all = device.Exclude_from_start_all
+	entry.Start_after = device.Start_after
+	entry.Priority = device.Priority
+	entry.Restart = device.Restart
+	entry.Restart_max_retries = device.Restart_max_retries
+	entry.Restart_backoff_seconds = device.Restart_backoff_seconds
+	entry.Metrics_listen = device.Metrics_listen
+	entry.Capacity_soft_percent = device.Capacity_soft_percent
+	entry.Capacity_hard_percent = device.Capacity_hard_percent
+	entry.Capacity_hook = device.Capacity_hook
+	entry.Profile = device.Profile
+	entry.Labels = device.Labels
+	entry.Allocation = device.Allocation
+	entry.Storage_layout = device.Storage_layout
+	entry.Additional_storage_files = device.Additional_storage_files
+	entry.Mirror_storage_file = device.Mirror_storage_file
+	entry.Checksums = device.Checksums
+	entry.Scrub_rate = device.Scrub_rate
+	entry.Encryption_keyfile = device.Encryption_keyfile
+	entry.Encryption_passphrase_env = device.Encryption_passphrase_env
+	entry.Encryption_salt = device.Encryption_salt
+	entry.Encryption_key_check = device.Encryption_key_check
 	return entry
 }
 
@@ -88,14 +162,19 @@ type Catalog struct {
 	log *tools.Nixomosetools_logger
 
 	catalog_file string
+	catalog_dir  string // optional catalog.d, one device per file
 	catalog_list *Catalog_list
+
+	entry_files map[string]string // lowercase device name to the catalog.d file it came from
 }
 
-func New_catalog(log *tools.Nixomosetools_logger, catalog_file string) *Catalog {
+func New_catalog(log *tools.Nixomosetools_logger, catalog_file string, catalog_dir string) *Catalog {
 
 	var ret Catalog = Catalog{}
 	ret.log = log
 	ret.catalog_file = catalog_file
+	ret.catalog_dir = catalog_dir
+	ret.entry_files = make(map[string]string)
 	ret.catalog_list = &Catalog_list{Device_list: make(map[string]*Catalog_entry)}
 	return &ret
 }
@@ -109,45 +188,63 @@ func New_catalog_list() *Catalog_list {
 
 func (this *Catalog) Read_catalog(cat *Catalog) tools.Ret {
 
-	// reload from disk
-	if cat.catalog_list == nil {
-		cat.catalog_list = New_catalog_list()
-	}
+	// reload from disk, start fresh so anything removed from the catalog.d goes away
+	var catalog_list = New_catalog_list()
+	var entry_files = make(map[string]string)
 
-	var metadata, err = toml.DecodeFile(cat.catalog_file, &cat.catalog_list)
+	var metadata, err = toml.DecodeFile(cat.catalog_file, &catalog_list)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil // this is fine for first time in
-		}
-		var m, err2 = json.MarshalIndent(metadata, "", "  ")
-		if err2 != nil {
-			m = []byte("unable to display metadata.")
+		if os.IsNotExist(err) == false {
+			var m, err2 = json.MarshalIndent(metadata, "", "  ")
+			if err2 != nil {
+				m = []byte("unable to display metadata.")
+			}
+			return tools.Error(this.log, "Unable to read catalog file: ", cat.catalog_file,
+				" err: ", err, ", metadata: ", string(m))
 		}
-		return tools.Error(this.log, "Unable to read catalog file: ", cat.catalog_file,
-			" err: ", err, ", metadata: ", string(m))
+		// this is fine for first time in
+	}
+	if catalog_list.Device_list == nil {
+		catalog_list.Device_list = make(map[string]*Catalog_entry)
 	}
 
-	/* amazingly, the list loads into the catalog_list correctly. */
+	/* amazingly, the list loads into the catalog_list correctly. but toml keys are case sensitive and we're not. */
+	var seen = make(map[string]string)
+	for k := range catalog_list.Device_list {
+		if other, ok := seen[strings.ToLower(k)]; ok {
+			return tools.Error(this.log, "device: ", k, " is defined twice in catalog file: ", cat.catalog_file, ", also as: ", other)
+		}
+		seen[strings.ToLower(k)] = k
+	}
+	var ret = cat.read_catalog_dir(catalog_list, entry_files)
+	if ret != nil {
+		return ret
+	}
+	cat.catalog_list = catalog_list
+	cat.entry_files = entry_files
 	return nil
 
 }
 
 func (this *Catalog) Write_catalog() tools.Ret {
 
-	f, err := os.Create(this.catalog_file)
-	if err != nil {
-		// failed to create/open the file
-		return tools.Error(this.log, "unable to create catalog file: ", this.catalog_file, " err: ", err)
-	}
-	if err := toml.NewEncoder(f).Encode(this.catalog_list); err != nil {
-		// failed to encode
-		return tools.Error(this.log, "unable to write catalog file: ", this.catalog_file, " err: ", err)
+	/* the catalog.d entries go back where they came from, the rest go in the catalog file.
+	   everything gets written out to the side first, then renamed into place, so a failure
+		 along the way doesn't leave the catalog half old and half new. */
+	var plan catalog_write_plan
+	var ret = this.stage_catalog_dir(&plan)
+	if ret != nil {
+		plan.abandon()
+		return ret
 	}
-	if err := f.Close(); err != nil {
-		// failed to close the file
-		return tools.Error(this.log, "unable to close catalog file: ", this.catalog_file, " err: ", err)
+	var main_staged *staged_catalog_file
+	ret, main_staged = this.stage_catalog_file(this.catalog_file, plan.main_list)
+	if ret != nil {
+		plan.abandon()
+		return ret
 	}
-	return nil
+	plan.writes = append([]*staged_catalog_file{main_staged}, plan.writes...)
+	return this.commit_catalog_write(&plan)
 }
 
 /********************************************************************/
@@ -173,6 +270,18 @@ func (this *Lbd_lib) get_catalog_entry(cat *Catalog, device_name string) (tools.
 	return tools.ErrorWithCodeNoLog(this.log, int(syscall.ENOENT)), nil
 }
 
+func (this *Lbd_lib) find_catalog_entry(cat *Catalog, device_name string) *Catalog_entry {
+	/* same as get_catalog_entry, but against what's already been read in, for when you're
+	   going through a lot of them and don't want to reread the catalog each time. */
+	var lower_device_name = strings.ToLower(device_name)
+	for k, v := range cat.catalog_list.Device_list {
+		if lower_device_name == strings.ToLower(k) {
+			return v
+		}
+	}
+	return nil
+}
+
 func (this *Lbd_lib) delete_catalog_entry(cat *Catalog, device_name string) tools.Ret {
 	/* sift through the map so we can match lowercase always but they can keep their
 	   original case in the name in the catalog, delete the entry from the map
@@ -188,6 +297,7 @@ func (this *Lbd_lib) delete_catalog_entry(cat *Catalog, device_name string) tool
 		var lower_key = strings.ToLower(k)
 		if lower_device_name == lower_key {
 			delete(cat.catalog_list.Device_list, k)
+			this.remove_start_after_references(cat, device_name)
 			return cat.Write_catalog()
 		}
 	}
@@ -307,18 +417,15 @@ func (this *Lbd_lib) dump_catentry_list(catentrylist []*Catalog_entry) tools.Ret
 	return nil
 }
 
-func (this *Lbd_lib) catalog_list_all(cat *Catalog) tools.Ret {
-	/* output the device information for all devices in the catalog */
+func (this *Lbd_lib) catalog_list_all(cat *Catalog, selector *Selector) tools.Ret {
+	/* output the device information for all devices in the catalog that match the selector */
 
 	var ret = this.catalog.Read_catalog(cat)
 	if ret != nil {
 		return ret
 	}
 
-	var collection = make([]*Catalog_entry, 0)
-	for _, catentry := range cat.catalog_list.Device_list {
-		collection = append(collection, catentry)
-	}
+	var collection = this.select_catalog_entries(cat, selector)
 
 	this.dump_catentry_list(collection)
 
@@ -342,7 +449,35 @@ func (this *Lbd_lib) catalog_list_device(cat *Catalog, device_name string) tools
 func (this *Lbd_lib) catalog_add(cat *Catalog, device *Lbd_device) tools.Ret {
 	/* add this device to the catalog if not already there. */
 
-	var ret, _ = this.get_catalog_entry(cat, device.Device_name)
+	var ret = this.validate_restart_policy(device.Restart, device.Restart_max_retries, device.Restart_backoff_seconds)
+	if ret != nil {
+		return ret
+	}
+	ret = this.validate_capacity_watermarks(device.Capacity_soft_percent, device.Capacity_hard_percent)
+	if ret != nil {
+		return ret
+	}
+	ret = this.validate_labels(device.Labels)
+	if ret != nil {
+		return ret
+	}
+	ret = this.validate_allocation(device.Allocation)
+	if ret != nil {
+		return ret
+	}
+	ret = this.validate_scrub_rate(device.Scrub_rate)
+	if ret != nil {
+		return ret
+	}
+	ret = this.validate_encryption(device)
+	if ret != nil {
+		return ret
+	}
+	if len(device.Additional_storage_files) > 0 && len(device.Storage_layout) == 0 {
+		device.Storage_layout = STORAGE_LAYOUT_CONCAT
+	}
+
+	ret, _ = this.get_catalog_entry(cat, device.Device_name)
 	if ret != nil {
 		if ret.Get_errcode() != int(syscall.ENOENT) {
 			return ret
@@ -351,6 +486,34 @@ func (this *Lbd_lib) catalog_add(cat *Catalog, device *Lbd_device) tools.Ret {
 		return tools.Error(this.log, "cannot add ", device.Device_name, ", device name already exists in the catalog.")
 	}
 
+	/* check everything we can before we lay anything down on disk. */
+	ret = this.validate_device_definition(device, this.get_catalog_device_names(cat))
+	if ret != nil {
+		return ret
+	}
+	ret = this.check_storage_in_use(cat, device)
+	if ret != nil {
+		return ret
+	}
+	ret = this.setup_encryption(device) // no key, no point going any further
+	if ret != nil {
+		return ret
+	}
+	var lock []*os.File
+	var created []string
+	ret, lock, created = this.create_and_lock_backing_store(device)
+	if ret != nil {
+		return ret
+	}
+	/* if it doesn't make it into the catalog, don't leave files lying around that we made for it. */
+	var added = false
+	defer func() {
+		this.unlock_backing_store(lock)
+		if added == false {
+			this.remove_created_backing_files(created)
+		}
+	}()
+
 	/* Now try and initialize the backing store. if it is not unitialized, fail. */
 	var stree *stree_v_lib.Stree_v = nil
 	ret, stree = this.Make_stree(device)
@@ -373,7 +536,11 @@ func (this *Lbd_lib) catalog_add(cat *Catalog, device *Lbd_device) tools.Ret {
 		return tools.Error(this.log, "can not create catalog entry, backing store contains data.")
 	}
 	/* so we're clear for takeoff, the backing store is there and uninitialzied it.
-	   init it, and add this device definition to the catalog. */
+	   lay it out if we were asked to, init it, and add this device definition to the catalog. */
+	ret = this.allocate_backing_store(device)
+	if ret != nil {
+		return ret
+	}
 	ret = stree.Init()
 	if ret != nil {
 		return ret
@@ -390,7 +557,9 @@ func (this *Lbd_lib) catalog_add(cat *Catalog, device *Lbd_device) tools.Ret {
 	}
 
 	// now do the local housekeeping
-	return this.add_to_catalog(this.catalog, device)
+	ret = this.add_to_catalog(this.catalog, device)
+	added = ret == nil
+	return ret
 }
 
 func (this *Lbd_lib) catalog_delete(cat *Catalog, device_name string) tools.Ret {
@@ -469,7 +638,7 @@ func (this *Lbd_lib) catalog_delete(cat *Catalog, device_name string) tools.Ret
 	return nil
 }
 
-func (this *Lbd_lib) catalog_shutdown_all(cat *Catalog) tools.Ret {
+func (this *Lbd_lib) catalog_shutdown_all(cat *Catalog, parallel int, selector *Selector) tools.Ret {
 	/* cleanly shutdown all devices in the catalog that aren't marked exclude
 	simply by clling shutdown device on each one. if there's an error on one
 	don't stop doing the others.
@@ -483,19 +652,54 @@ func (this *Lbd_lib) catalog_shutdown_all(cat *Catalog) tools.Ret {
 		return ret
 	}
 
-	var any_failed bool = false
-	var failed_device_list string = ""
+	ret = this.catalog.Read_catalog(cat)
+	if ret != nil {
+		return ret
+	}
+
+	/* the active ones that are in the catalog get shut down in reverse start order, so anything
+	   mounted inside somebody else's filesystem goes away before the thing it's mounted in. */
+	var running = make(map[string]*Catalog_entry)
+	var not_in_catalog = make([]string, 0)
 	for device_name := range map_of_devices {
+		var catentry = this.find_catalog_entry(cat, device_name)
+		if catentry == nil {
+			if selector.Is_empty() { // no labels, so a selector can't pick it
+				not_in_catalog = append(not_in_catalog, device_name)
+			}
+			continue
+		}
+		if selector.Matches(catentry.Labels) == false {
+			continue
+		}
+		running[catentry.Device_name] = catentry
+	}
+
+	var levels [][]*Catalog_entry
+	ret, levels = this.get_start_levels(cat, running)
+	if ret != nil {
+		return ret
+	}
+
+	var failed_device_list = make([]string, 0)
+	for lp := len(levels) - 1; lp >= 0; lp-- {
+		var failed = this.run_parallel(levels[lp], parallel, func(catentry *Catalog_entry) tools.Ret {
+			this.log.Info("calling shutdown on device: ", catentry.Device_name)
+			return this.catalog_shutdown_entry(catentry)
+		})
+		failed_device_list = append(failed_device_list, failed...)
+	}
+
+	for _, device_name := range not_in_catalog {
 		this.log.Info("calling shutdown on device: ", device_name)
 		var ret = this.catalog_shutdown_device(cat, device_name)
 		if ret != nil {
-			any_failed = true
-			failed_device_list = failed_device_list + " " + device_name
+			failed_device_list = append(failed_device_list, device_name)
 		}
-
 	}
-	if any_failed {
-		return tools.Error(this.log, "the following devices failed to shutdown cleanly:", failed_device_list)
+
+	if len(failed_device_list) > 0 {
+		return tools.Error(this.log, "the following devices failed to shutdown cleanly: ", strings.Join(failed_device_list, " "))
 	}
 	return nil
 }
@@ -528,13 +732,19 @@ func (this *Lbd_lib) catalog_shutdown_device(cat *Catalog, device_name string) t
 		return ret
 	}
 
+	return this.catalog_shutdown_entry(catentry)
+}
+
+func (this *Lbd_lib) catalog_shutdown_entry(catentry *Catalog_entry) tools.Ret {
+	/* the part of shutdown that doesn't touch the catalog, so shutdown all can run a bunch of these at once. */
+
 	// the man page says this can not fail. :-)
 	syscall.Sync()
 
 	/* See if it is set to mount. if so, call unmount on it first, then shut the device down, */
 	var device = this.New_block_device_from_catalog_entry(catentry)
 	if catentry.Mount {
-		ret = this.attempt_unmount(device)
+		var ret = this.attempt_unmount(device)
 		if ret != nil {
 			return nil
 		}
@@ -542,16 +752,18 @@ func (this *Lbd_lib) catalog_shutdown_device(cat *Catalog, device_name string) t
 
 	/* once unmount completes and we have synced, we can safely destroy the block device,
 	   there should be no outstanding writes waiting to happen */
-	ret = this.destroy_block_device(device)
+	var ret = this.destroy_block_device(device)
+	this.log_event(EVENT_STOP, device.Device_name, nil, ret)
 	if ret != nil {
 		return ret // it has already logged the error.
 	}
 	return nil
 }
 
-func (this *Lbd_lib) catalog_start_all(cat *Catalog, force bool, data_pipeline *list.List) tools.Ret {
+func (this *Lbd_lib) catalog_start_all(cat *Catalog, force bool, data_pipeline *list.List, parallel int,
+	selector *Selector) tools.Ret {
 	/* go through the catalog and call start on every device that isn't marked
-	   exclude. */
+	   exclude, and that matches the selector if there is one. */
 
 	this.log.Info("starting all non excluded entries in the catalog.")
 	var ret = this.catalog.Read_catalog(cat)
@@ -559,29 +771,66 @@ func (this *Lbd_lib) catalog_start_all(cat *Catalog, force bool, data_pipeline *
 		return ret
 	}
 
-	var any_failed bool = false
-	var failed_device_list string = ""
-
+	var to_start = make(map[string]*Catalog_entry)
 	for device_name, catentry := range cat.catalog_list.Device_list {
 		// forgot to actually check the exclude flag
 		if catentry.Exclude_from_start_all {
 			continue
 		}
-		ret = this.catalog_start_device(cat, device_name, force, data_pipeline, false, false, false)
-		if ret != nil {
-			any_failed = true
-			failed_device_list = failed_device_list + " " + device_name
+		if selector.Matches(catentry.Labels) == false {
+			continue
+		}
+		if len(catentry.Broken) > 0 {
+			this.log.Info("skipping device: ", catentry.Device_name, ", it is marked broken: ", catentry.Broken)
+			continue
+		}
+		to_start[device_name] = catentry
+	}
+	var starting_set = make(map[string]bool)
+	for _, catentry := range to_start {
+		starting_set[strings.ToLower(catentry.Device_name)] = true
+	}
+
+	/* 10/18/2026 map order is random, and some devices live inside other devices' filesystems,
+	   so go by start_after levels, and start everything in a level at once (up to parallel at a time)
+		 once everything it depends on is up and mounted. */
+	var levels [][]*Catalog_entry
+	ret, levels = this.get_start_levels(cat, to_start)
+	if ret != nil {
+		return ret
+	}
+
+	var failed_device_list = make([]string, 0)
+	var failed_set = make(map[string]bool)
+	for _, level := range levels {
+		var failed = this.run_parallel(level, parallel, func(catentry *Catalog_entry) tools.Ret {
+			var ret = this.wait_for_start_after(cat, catentry, starting_set, failed_set)
+			if ret != nil {
+				return ret
+			}
+			ret = this.catalog_start_entry(catentry, force, data_pipeline, false, false, false, false)
+			if ret != nil && ret.Get_errcode() == int(syscall.EALREADY) {
+				/* it's up, which is all start all wants, and anything that starts after it can go ahead. */
+				this.log.Info("device: ", catentry.Device_name, " is already started")
+				return nil
+			}
+			return ret
+		})
+		for _, device_name := range failed {
+			failed_set[strings.ToLower(device_name)] = true
 		}
+		failed_device_list = append(failed_device_list, failed...)
 	}
-	if any_failed {
-		return tools.Error(this.log, "the following devices failed to start cleanly:", failed_device_list)
+
+	if len(failed_device_list) > 0 {
+		return tools.Error(this.log, "the following devices failed to start cleanly: ", strings.Join(failed_device_list, " "))
 	}
 
 	return nil
 }
 
 func (this *Lbd_lib) catalog_start_device(cat *Catalog, device_name string, force bool,
-	data_pipeline *list.List, device_ramdisk bool, stree_ramdisk bool, dragons bool) tools.Ret {
+	data_pipeline *list.List, device_ramdisk bool, stree_ramdisk bool, dragons bool, foreground bool) tools.Ret {
 	/* start the block device. */
 
 	/* this is basically what create block device used to do, except we just read the info out of the
@@ -595,18 +844,31 @@ func (this *Lbd_lib) catalog_start_device(cat *Catalog, device_name string, forc
 		return ret
 	}
 
+	return this.catalog_start_entry(catentry, force, data_pipeline, device_ramdisk, stree_ramdisk, dragons, foreground)
+}
+
+func (this *Lbd_lib) catalog_start_entry(catentry *Catalog_entry, force bool,
+	data_pipeline *list.List, device_ramdisk bool, stree_ramdisk bool, dragons bool, foreground bool) tools.Ret {
+	/* the part of start that doesn't touch the catalog, so start all can run a bunch of these at once. */
+
 	/* check and see if the device is already running. race condition here of course. */
 	/* of course there's a race condition here, but let's assume they don't start and start again or delete frequently.  */
 
+	var ret tools.Ret
 	var map_of_devices map[string]zosbd2cmdlib.Device_status
 	ret, map_of_devices = this.get_active_device_map()
 	if ret != nil {
 		return ret
 	}
-	var lower_device_name = strings.ToLower(device_name)
+	var lower_device_name = strings.ToLower(catentry.Device_name)
 	var _, ok = map_of_devices[lower_device_name]
 	if ok != false {
-		return tools.ErrorWithCode(this.log, int(syscall.EALREADY), "block device: ", device_name, " is already started")
+		return tools.ErrorWithCode(this.log, int(syscall.EALREADY), "block device: ", catentry.Device_name, " is already started")
+	}
+
+	if len(catentry.Broken) > 0 {
+		return tools.Error(this.log, "block device: ", catentry.Device_name, " is marked broken: ", catentry.Broken,
+			", fix it and run catalog ", SUB_CMD_CATALOG_RECONCILE, " --", TXT_APPLY)
 	}
 
 	var device = this.New_block_device_from_catalog_entry(catentry)
@@ -615,11 +877,23 @@ func (this *Lbd_lib) catalog_start_device(cat *Catalog, device_name string, forc
 	device.device_ramdisk = device_ramdisk
 	device.stree_ramdisk = stree_ramdisk
 
-	ret = this.run_block_device(device, force, data_pipeline, dragons)
+	if dragons == false { // the parent already checked, and the flock covers the rest
+		ret = this.check_storage_in_use(this.catalog, device)
+		if ret != nil {
+			return ret
+		}
+	}
+
+	ret = this.run_block_device(device, force, data_pipeline, dragons, foreground)
+	if dragons == false && foreground == false {
+		/* the dragons child's parent already logged the start, the child logs when the handler exits.
+		   in the foreground run_block_device logs it before it starts serving. */
+		this.log_event(EVENT_START, device.Device_name, map[string]interface{}{TXT_FORCE: force, TXT_FOREGROUND: foreground}, ret)
+	}
 	if ret != nil {
 		return ret // it has already logged the error.
 	}
-	if dragons {
+	if dragons || foreground {
 		this.log.Info("device: ", device.Device_name, " has been shutdown.")
 	}
 	return nil // they shutdown the device
@@ -644,9 +918,12 @@ func (this *Lbd_lib) attempt_mount_runner(device *Lbd_device) {
 	if err != nil {
 		this.log.Error("error executing mount command: ", err)
 		this.log.Error(string(output))
+		this.log_event(EVENT_MOUNT, device.Device_name, map[string]interface{}{TXT_MOUNTPOINT: device.Mountpoint},
+			tools.ErrorWithCodeNoLog(this.log, 0, "error executing mount command: ", err, " ", string(output)))
 		return
 	}
 	this.log.Info("mount command completed")
+	this.log_event(EVENT_MOUNT, device.Device_name, map[string]interface{}{TXT_MOUNTPOINT: device.Mountpoint}, nil)
 }
 
 func (this *Lbd_lib) attempt_unmount(device *Lbd_device) tools.Ret {
@@ -671,9 +948,12 @@ func (this *Lbd_lib) attempt_unmount(device *Lbd_device) tools.Ret {
 	var output, err = handle.CombinedOutput()
 	if err != nil {
 		tools.Error(this.log, string(output))
-		return tools.Error(this.log, "error executing umount command: ", err)
+		var ret = tools.Error(this.log, "error executing umount command: ", err)
+		this.log_event(EVENT_UNMOUNT, device.Device_name, map[string]interface{}{TXT_MOUNTPOINT: device.Mountpoint}, ret)
+		return ret
 	}
 	this.log.Info("umount command completed")
+	this.log_event(EVENT_UNMOUNT, device.Device_name, map[string]interface{}{TXT_MOUNTPOINT: device.Mountpoint}, nil)
 	return nil
 }
 
@@ -699,3 +979,114 @@ func (this *Lbd_lib) set_catalog_entry_exclude_device(cat *Catalog, device_name
 	}
 	return tools.Error(this.log, "device ", device_name, " not found")
 }
+
+func (this *Lbd_lib) set_catalog_entry_start_order(cat *Catalog, device_name string, start_after []string, priority int) tools.Ret {
+
+	var ret = this.catalog.Read_catalog(cat)
+	if ret != nil {
+		return ret
+	}
+
+	var catentry = this.find_catalog_entry(cat, device_name)
+	if catentry == nil {
+		return tools.Error(this.log, "device ", device_name, " not found")
+	}
+	var problems = this.get_start_after_problems(catentry.Device_name, start_after, this.get_catalog_device_names(cat))
+	if len(problems) > 0 {
+		return tools.ErrorWithCode(this.log, int(syscall.EINVAL), strings.Join(problems, "; "))
+	}
+	var old_start_after = catentry.Start_after
+	var old_priority = catentry.Priority
+	catentry.Start_after = start_after
+	catentry.Priority = priority
+
+	/* make sure we're not about to write out something start all can't deal with. */
+	ret, _ = this.get_start_levels(cat, cat.catalog_list.Device_list)
+	if ret != nil {
+		catentry.Start_after = old_start_after
+		catentry.Priority = old_priority
+		return ret
+	}
+	return cat.Write_catalog()
+}
+
+func (this *Lbd_lib) set_catalog_entry_restart(cat *Catalog, device_name string, restart string,
+	max_retries int, backoff_seconds int) tools.Ret {
+
+	var ret = this.validate_restart_policy(restart, max_retries, backoff_seconds)
+	if ret != nil {
+		return ret
+	}
+
+	ret = this.catalog.Read_catalog(cat)
+	if ret != nil {
+		return ret
+	}
+
+	var catentry = this.find_catalog_entry(cat, device_name)
+	if catentry == nil {
+		return tools.Error(this.log, "device ", device_name, " not found")
+	}
+	catentry.Restart = restart
+	catentry.Restart_max_retries = max_retries
+	catentry.Restart_backoff_seconds = backoff_seconds
+	return cat.Write_catalog()
+}
+
+func (this *Lbd_lib) set_catalog_entry_metrics(cat *Catalog, device_name string, metrics_listen string) tools.Ret {
+
+	var ret = this.catalog.Read_catalog(cat)
+	if ret != nil {
+		return ret
+	}
+
+	var catentry = this.find_catalog_entry(cat, device_name)
+	if catentry == nil {
+		return tools.Error(this.log, "device ", device_name, " not found")
+	}
+	catentry.Metrics_listen = metrics_listen
+	return cat.Write_catalog()
+}
+
+func (this *Lbd_lib) set_catalog_entry_capacity(cat *Catalog, device_name string, soft_percent int, hard_percent int,
+	hook string) tools.Ret {
+
+	var ret = this.validate_capacity_watermarks(soft_percent, hard_percent)
+	if ret != nil {
+		return ret
+	}
+
+	ret = this.catalog.Read_catalog(cat)
+	if ret != nil {
+		return ret
+	}
+
+	var catentry = this.find_catalog_entry(cat, device_name)
+	if catentry == nil {
+		return tools.Error(this.log, "device ", device_name, " not found")
+	}
+	catentry.Capacity_soft_percent = soft_percent
+	catentry.Capacity_hard_percent = hard_percent
+	catentry.Capacity_hook = hook
+	return cat.Write_catalog()
+}
+
+func (this *Lbd_lib) set_catalog_entry_scrub(cat *Catalog, device_name string, scrub_rate int) tools.Ret {
+
+	var ret = this.validate_scrub_rate(scrub_rate)
+	if ret != nil {
+		return ret
+	}
+
+	ret = this.catalog.Read_catalog(cat)
+	if ret != nil {
+		return ret
+	}
+
+	var catentry = this.find_catalog_entry(cat, device_name)
+	if catentry == nil {
+		return tools.Error(this.log, "device ", device_name, " not found")
+	}
+	catentry.Scrub_rate = scrub_rate
+	return cat.Write_catalog()
+}
@@ -0,0 +1,354 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nixomose/nixomosegotools/tools"
+)
+
+/* if you've got a lot of identical machines, you don't want to be running catalog add a line at a
+   time on each one. catalog export writes out the catalog (or one device) in json or toml, and
+	 catalog apply takes that file and makes this catalog look like it: anything missing gets added
+	 (and its backing store initialized, same as catalog add), anything that's there but different
+	 gets reported as drift, and only if you say prune does anything that's not in the file get
+	 deleted, because deleting destroys the data.
+	 only the fields the file actually sets get compared, so a hand written file with just the name,
+	 size and storage file doesn't show drift on every other setting. */
+
+const FORMAT_JSON = "json"
+const FORMAT_TOML = "toml"
+
+const APPLY_CREATE = "create"
+const APPLY_UNCHANGED = "unchanged"
+const APPLY_DRIFT = "drift"
+const APPLY_DELETE = "delete"
+
+type Field_drift struct {
+	Field   string      `json:"field"`
+	Catalog interface{} `json:"catalog"`
+	File    interface{} `json:"file"`
+}
+
+type Apply_result struct {
+	Device_name string         `json:"device_name"`
+	Action      string         `json:"action"`
+	Drift       []*Field_drift `json:"drift,omitempty"`
+	Applied     bool           `json:"applied"`
+	Error       string         `json:"error,omitempty"`
+}
+
+type desired_entry struct {
+	entry      *Catalog_entry
+	fields_set map[string]bool // lowercase field names the file set
+}
+
+/* these are filled in by catalog add, or by reconcile, not by the person who wrote the file. */
+var apply_ignored_fields = map[string]bool{"device_name": true, "node_calculated_size_bytes": true, "broken": true,
+	"encryption_salt": true, "encryption_key_check": true}
+
+func (this *Lbd_lib) catalog_export(cat *Catalog, format string, device_name string) tools.Ret {
+	var ret = this.catalog.Read_catalog(cat)
+	if ret != nil {
+		return ret
+	}
+
+	var export_list = New_catalog_list()
+	if len(device_name) > 0 {
+		var catentry = this.find_catalog_entry(cat, device_name)
+		if catentry == nil {
+			return tools.Error(this.log, "device: ", device_name, " not found")
+		}
+		export_list.Device_list[catentry.Device_name] = catentry
+	} else {
+		for k, v := range cat.catalog_list.Device_list {
+			export_list.Device_list[k] = v
+		}
+	}
+
+	switch format {
+	case FORMAT_JSON, "":
+		var collection = make([]*Catalog_entry, 0)
+		for _, catentry := range export_list.Device_list {
+			collection = append(collection, catentry)
+		}
+		sort.Slice(collection, func(i, j int) bool {
+			return strings.ToLower(collection[i].Device_name) < strings.ToLower(collection[j].Device_name)
+		})
+		return this.dump_catentry_list(collection)
+	case FORMAT_TOML:
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(export_list); err != nil {
+			return tools.Error(this.log, "unable to encode catalog into toml, err: ", err)
+		}
+		fmt.Print(buf.String())
+		return nil
+	}
+	return tools.Error(this.log, "unknown export format: ", format, ", must be ", FORMAT_JSON, " or ", FORMAT_TOML)
+}
+
+func (this *Lbd_lib) read_apply_file(filename string) (tools.Ret, []*desired_entry) {
+	/* json is a list of entries like catalog list and export spit out, or just one. toml is the
+	   catalog file format, or a single entry like in the catalog.d. */
+	var data, err = os.ReadFile(filename)
+	if err != nil {
+		return tools.Error(this.log, "unable to read catalog apply file: ", filename, " err: ", err), nil
+	}
+	var desired = make([]*desired_entry, 0)
+
+	var trimmed = bytes.TrimSpace(data)
+	if len(trimmed) > 0 && (trimmed[0] == '[' || trimmed[0] == '{') && strings.HasSuffix(strings.ToLower(filename), "."+FORMAT_TOML) == false {
+		var raw_list []map[string]json.RawMessage
+		if trimmed[0] == '{' {
+			var raw map[string]json.RawMessage
+			if err = json.Unmarshal(trimmed, &raw); err == nil {
+				raw_list = append(raw_list, raw)
+			}
+		} else {
+			err = json.Unmarshal(trimmed, &raw_list)
+		}
+		if err != nil {
+			return tools.Error(this.log, "unable to parse catalog apply file: ", filename, " as json, err: ", err), nil
+		}
+		for _, raw := range raw_list {
+			var d = &desired_entry{entry: &Catalog_entry{}, fields_set: make(map[string]bool)}
+			var b, _ = json.Marshal(raw)
+			if err = json.Unmarshal(b, d.entry); err != nil {
+				return tools.Error(this.log, "unable to parse catalog entry in: ", filename, " err: ", err), nil
+			}
+			for k := range raw {
+				d.fields_set[strings.ToLower(k)] = true
+			}
+			desired = append(desired, d)
+		}
+	} else {
+		var catalog_list = New_catalog_list()
+		var md toml.MetaData
+		md, err = toml.Decode(string(data), catalog_list)
+		if err != nil {
+			return tools.Error(this.log, "unable to parse catalog apply file: ", filename, " as toml, err: ", err), nil
+		}
+		if md.IsDefined("Device_list") {
+			for k, v := range catalog_list.Device_list {
+				var d = &desired_entry{entry: v, fields_set: make(map[string]bool)}
+				if len(v.Device_name) == 0 {
+					v.Device_name = k
+				}
+				for _, key := range md.Keys() {
+					if len(key) == 3 && key[1] == k {
+						d.fields_set[strings.ToLower(key[2])] = true
+					}
+				}
+				desired = append(desired, d)
+			}
+		} else {
+			var d = &desired_entry{entry: &Catalog_entry{}, fields_set: make(map[string]bool)}
+			md, err = toml.Decode(string(data), d.entry)
+			if err != nil {
+				return tools.Error(this.log, "unable to parse catalog apply file: ", filename, " as toml, err: ", err), nil
+			}
+			for _, key := range md.Keys() {
+				d.fields_set[strings.ToLower(key[0])] = true
+			}
+			desired = append(desired, d)
+		}
+	}
+
+	var seen = make(map[string]bool)
+	for _, d := range desired {
+		if len(d.entry.Device_name) == 0 {
+			return tools.Error(this.log, "catalog apply file: ", filename, " has an entry with no Device_name"), nil
+		}
+		var lower_device_name = strings.ToLower(d.entry.Device_name)
+		if seen[lower_device_name] {
+			return tools.Error(this.log, "catalog apply file: ", filename, " defines device: ", d.entry.Device_name, " more than once"), nil
+		}
+		seen[lower_device_name] = true
+	}
+	sort.Slice(desired, func(i, j int) bool {
+		return strings.ToLower(desired[i].entry.Device_name) < strings.ToLower(desired[j].entry.Device_name)
+	})
+	return nil, desired
+}
+
+func (this *Lbd_lib) get_catalog_entry_drift(have *Catalog_entry, want *desired_entry) []*Field_drift {
+	var drift = make([]*Field_drift, 0)
+	var have_value = reflect.ValueOf(have).Elem()
+	var want_value = reflect.ValueOf(want.entry).Elem()
+	var t = have_value.Type()
+	for lp := 0; lp < t.NumField(); lp++ {
+		var lower_name = strings.ToLower(t.Field(lp).Name)
+		if apply_ignored_fields[lower_name] || want.fields_set[lower_name] == false {
+			continue
+		}
+		var h = have_value.Field(lp).Interface()
+		var w = want_value.Field(lp).Interface()
+		if reflect.DeepEqual(h, w) {
+			continue
+		}
+		/* an empty list and no list are the same thing. */
+		var kind = have_value.Field(lp).Kind()
+		if (kind == reflect.Slice || kind == reflect.Map) && have_value.Field(lp).Len() == 0 && want_value.Field(lp).Len() == 0 {
+			continue
+		}
+		drift = append(drift, &Field_drift{Field: t.Field(lp).Name, Catalog: h, File: w})
+	}
+	return drift
+}
+
+func (this *Lbd_lib) catalog_apply(cat *Catalog, filename string, prune bool, dry_run bool) tools.Ret {
+
+	var ret, desired = this.read_apply_file(filename)
+	if ret != nil {
+		return ret
+	}
+	ret = this.catalog.Read_catalog(cat)
+	if ret != nil {
+		return ret
+	}
+
+	/* validate everything before we touch anything, so a typo in the last entry doesn't leave
+	   us half applied. new entries can start after each other, not just after what's already there. */
+	var device_names = this.get_catalog_device_names(cat)
+	for _, d := range desired {
+		device_names[strings.ToLower(d.entry.Device_name)] = true
+	}
+	for _, d := range desired {
+		ret = this.validate_restart_policy(d.entry.Restart, d.entry.Restart_max_retries, d.entry.Restart_backoff_seconds)
+		if ret != nil {
+			return ret
+		}
+		ret = this.validate_capacity_watermarks(d.entry.Capacity_soft_percent, d.entry.Capacity_hard_percent)
+		if ret != nil {
+			return ret
+		}
+		ret = this.validate_labels(d.entry.Labels)
+		if ret != nil {
+			return ret
+		}
+		ret = this.validate_allocation(d.entry.Allocation)
+		if ret != nil {
+			return ret
+		}
+		ret = this.validate_scrub_rate(d.entry.Scrub_rate)
+		if ret != nil {
+			return ret
+		}
+		ret = this.validate_encryption(this.New_block_device_from_catalog_entry(d.entry))
+		if ret != nil {
+			return ret
+		}
+		if this.find_catalog_entry(cat, d.entry.Device_name) == nil {
+			ret = this.validate_device_definition(this.New_block_device_from_catalog_entry(d.entry), device_names)
+			if ret != nil {
+				return ret
+			}
+		}
+	}
+
+	var results = make([]*Apply_result, 0)
+	var wanted = make(map[string]bool)
+	var to_create = make([]*Catalog_entry, 0)
+	for _, d := range desired {
+		wanted[strings.ToLower(d.entry.Device_name)] = true
+		var have = this.find_catalog_entry(cat, d.entry.Device_name)
+		if have == nil {
+			to_create = append(to_create, d.entry)
+			continue
+		}
+		var r = &Apply_result{Device_name: have.Device_name, Action: APPLY_UNCHANGED}
+		r.Drift = this.get_catalog_entry_drift(have, d)
+		if len(r.Drift) > 0 {
+			r.Action = APPLY_DRIFT // we report it, we don't fix it. that could mean reinitializing the store.
+		}
+		results = append(results, r)
+	}
+
+	/* and the new ones get added dependencies first, so each one's start after list is already in
+	   the catalog when it's added, and a loop between them is caught here rather than halfway through. */
+	var all_entries = make(map[string]*Catalog_entry)
+	for k, v := range cat.catalog_list.Device_list {
+		all_entries[k] = v
+	}
+	var create_entries = make(map[string]*Catalog_entry)
+	for _, entry := range to_create {
+		all_entries[entry.Device_name] = entry
+		create_entries[entry.Device_name] = entry
+	}
+	ret, _ = this.get_start_levels(cat, all_entries)
+	if ret != nil {
+		return ret
+	}
+	var create_levels [][]*Catalog_entry
+	ret, create_levels = this.get_start_levels(cat, create_entries)
+	if ret != nil {
+		return ret
+	}
+	to_create = to_create[:0]
+	for _, level := range create_levels {
+		to_create = append(to_create, level...)
+	}
+
+	var to_delete = make([]string, 0)
+	for _, catentry := range cat.catalog_list.Device_list {
+		if wanted[strings.ToLower(catentry.Device_name)] == false {
+			to_delete = append(to_delete, catentry.Device_name)
+		}
+	}
+	sort.Strings(to_delete)
+
+	for _, entry := range to_create {
+		var r = &Apply_result{Device_name: entry.Device_name, Action: APPLY_CREATE}
+		if dry_run == false {
+			var device = this.New_block_device_from_catalog_entry(entry)
+			ret = this.catalog_add(cat, device)
+			this.log_event(EVENT_CATALOG_ADD, entry.Device_name, map[string]interface{}{"apply": filename}, ret)
+			if ret != nil {
+				r.Error = ret.Get_errmsg()
+			} else {
+				r.Applied = true
+			}
+		}
+		results = append(results, r)
+	}
+
+	for _, device_name := range to_delete {
+		var r = &Apply_result{Device_name: device_name, Action: APPLY_DELETE}
+		if prune && dry_run == false {
+			ret = this.catalog_delete(cat, device_name)
+			this.log_event(EVENT_CATALOG_DELETE, device_name, map[string]interface{}{"apply": filename}, ret)
+			if ret != nil {
+				r.Error = ret.Get_errmsg()
+			} else {
+				r.Applied = true
+			}
+		}
+		results = append(results, r)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return strings.ToLower(results[i].Device_name) < strings.ToLower(results[j].Device_name)
+	})
+	var bytesout, err = json.MarshalIndent(results, "", " ")
+	if err != nil {
+		return tools.Error(this.log, "unable to marshal catalog apply results into json, err: ", err)
+	}
+	fmt.Println(string(bytesout))
+
+	for _, r := range results {
+		if len(r.Error) > 0 {
+			return tools.ErrorWithCode(this.log, int(syscall.EIO), "not all catalog entries could be applied")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nixomose/nixomosegotools/tools"
+)
+
+/* besides the one catalog file, you can have a catalog directory (catalog.d) where each device is
+   its own toml file, one catalog entry per file, so something like ansible can own a device definition
+	 without having to rewrite a file it shares with everybody else. they get merged with the catalog
+	 file when we read, and device names have to be unique across all of them, case insensitively,
+	 same as everywhere else. if the entry doesn't say its Device_name, the file name (without .toml) is it.
+	 when we write, entries that came from the directory go back to their own file (only if they actually
+	 changed, so we don't fight with whoever owns them) and new entries go in the catalog file. */
+
+const TXT_CATALOG_DIR_SUFFIX = ".toml"
+const TXT_CATALOG_TMP_SUFFIX = ".tmp"
+const CATALOG_FILE_PERMISSIONS = 0644
+
+func (this *Catalog) read_catalog_dir(list *Catalog_list, sources map[string]string) tools.Ret {
+	if len(this.catalog_dir) == 0 {
+		return nil
+	}
+	var entries, err = os.ReadDir(this.catalog_dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // nobody's dropped anything in yet
+		}
+		return tools.Error(this.log, "unable to read catalog directory: ", this.catalog_dir, " err: ", err)
+	}
+	/* readdir sorts by name, so the error for a duplicate is always the same one. */
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), TXT_CATALOG_DIR_SUFFIX) == false ||
+			strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		var path = filepath.Join(this.catalog_dir, entry.Name())
+		var catentry Catalog_entry
+		_, err = toml.DecodeFile(path, &catentry)
+		if err != nil {
+			return tools.Error(this.log, "Unable to read catalog file: ", path, " err: ", err)
+		}
+		if len(catentry.Device_name) == 0 {
+			catentry.Device_name = strings.TrimSuffix(entry.Name(), TXT_CATALOG_DIR_SUFFIX)
+		}
+		var lower_device_name = strings.ToLower(catentry.Device_name)
+		for k := range list.Device_list {
+			if strings.ToLower(k) == lower_device_name {
+				var other = sources[lower_device_name]
+				if len(other) == 0 {
+					other = this.catalog_file
+				}
+				return tools.Error(this.log, "device: ", catentry.Device_name, " in catalog file: ", path,
+					" is already defined in: ", other)
+			}
+		}
+		list.Device_list[catentry.Device_name] = &catentry
+		sources[lower_device_name] = path
+	}
+	return nil
+}
+
+type staged_catalog_file struct {
+	tmp  string
+	path string
+}
+
+type catalog_write_plan struct {
+	/* everything that has to change on disk to write the catalog. the new contents are all
+	   written to tmp files next to where they go before anything is renamed over or removed,
+		 so if anything fails we haven't touched the catalog yet. */
+	main_list   *Catalog_list
+	writes      []*staged_catalog_file
+	removes     []string
+	entry_files map[string]string
+}
+
+func (this *Catalog) stage_catalog_file(path string, v interface{}) (tools.Ret, *staged_catalog_file) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(v); err != nil {
+		return tools.Error(this.log, "unable to encode catalog file: ", path, " err: ", err), nil
+	}
+	/* keep whatever permissions somebody gave the one that's there. */
+	var mode os.FileMode = CATALOG_FILE_PERMISSIONS
+	if st, err := os.Stat(path); err == nil {
+		mode = st.Mode().Perm()
+	}
+	var tmp = path + TXT_CATALOG_TMP_SUFFIX
+	var f, err = os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return tools.Error(this.log, "unable to create catalog file: ", tmp, " err: ", err), nil
+	}
+	if _, err = f.Write(buf.Bytes()); err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return tools.Error(this.log, "unable to write catalog file: ", tmp, " err: ", err), nil
+	}
+	return nil, &staged_catalog_file{tmp: tmp, path: path}
+}
+
+func (this *catalog_write_plan) abandon() {
+	for _, staged := range this.writes {
+		os.Remove(staged.tmp)
+	}
+}
+
+func (this *Catalog) stage_catalog_dir(plan *catalog_write_plan) tools.Ret {
+	/* stage the entries that came from the directory, note the files of ones that were
+	   deleted, and put what's left in the plan for the catalog file. */
+	plan.main_list = New_catalog_list()
+	plan.entry_files = make(map[string]string)
+	for k, v := range this.catalog_list.Device_list {
+		var path, from_dir = this.entry_files[strings.ToLower(k)]
+		if from_dir == false {
+			plan.main_list.Device_list[k] = v
+			continue
+		}
+		plan.entry_files[strings.ToLower(k)] = path
+		/* compare what's there, not how it's written, so a hand written file stays hand written. */
+		var current Catalog_entry
+		var _, err = toml.DecodeFile(path, &current)
+		if err == nil {
+			if len(current.Device_name) == 0 {
+				current.Device_name = strings.TrimSuffix(filepath.Base(path), TXT_CATALOG_DIR_SUFFIX)
+			}
+			if reflect.DeepEqual(&current, v) {
+				continue
+			}
+		}
+		var ret, staged = this.stage_catalog_file(path, v)
+		if ret != nil {
+			return ret
+		}
+		plan.writes = append(plan.writes, staged)
+	}
+
+	for lower_device_name, path := range this.entry_files {
+		if _, ok := plan.entry_files[lower_device_name]; ok == false {
+			plan.removes = append(plan.removes, path)
+		}
+	}
+	sort.Strings(plan.removes)
+	return nil
+}
+
+func (this *Catalog) commit_catalog_write(plan *catalog_write_plan) tools.Ret {
+	/* the catalog file is first in the writes, then the directory files. removes
+	   go last, so if we die part way an entry that moved between files is in both places,
+		 which read will tell you about, rather than in neither. */
+	for lp, staged := range plan.writes {
+		if err := os.Rename(staged.tmp, staged.path); err != nil {
+			for _, unstaged := range plan.writes[lp:] {
+				os.Remove(unstaged.tmp)
+			}
+			return tools.Error(this.log, "unable to replace catalog file: ", staged.path, " err: ", err)
+		}
+	}
+	for _, path := range plan.removes {
+		var err = os.Remove(path)
+		if err != nil && os.IsNotExist(err) == false {
+			return tools.Error(this.log, "unable to remove catalog file: ", path, " err: ", err)
+		}
+	}
+	this.entry_files = plan.entry_files
+	return nil
+}
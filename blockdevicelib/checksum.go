@@ -0,0 +1,195 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/nixomose/nixomosegotools/tools"
+)
+
+/* nothing checks that what the stree reads back is what it wrote, so if the backing file gets
+   corrupted underneath us, the first anybody hears of it is the filesystem on the device falling
+	 over. so a catalog entry can have checksums: every block the stree stores gets a crc32c of the
+	 block number and the data stuck on the end of it, and every time we read a block back we check it.
+	 including the block number means a block that got written to the wrong place fails too.
+	 the stree doesn't know, it asks for its usual block size and we ask the file store for a few
+	 bytes more, which changes the layout on disk, so it's something you pick at catalog add and
+	 can't change after. the header block belongs to the file store, so it's left alone.
+	 the stree sometimes only reads the front of a node, we read the whole thing anyway so we can check it.
+	 a mismatch is a read error, which with a mirror means the other side gets a shot at it, and
+	 it counts towards the checksum error metric. storage scrub and the background scrub read every
+	 block to find them before anybody else does. */
+
+const CHECKSUM_SIZE = 4
+
+var checksum_table = crc32.MakeTable(crc32.Castagnoli)
+
+type Checksummed_store struct {
+	log        *tools.Nixomosetools_logger
+	store      Lbd_file_store
+	path       string
+	block_size uint32  // what the stree sees, the store underneath has CHECKSUM_SIZE more
+	errors     *uint64 // checksum mismatches, shared by every store of a device
+}
+
+var _ Lbd_file_store = &Checksummed_store{}
+
+func New_checksummed_store(log *tools.Nixomosetools_logger, store Lbd_file_store, path string, block_size uint32,
+	errors *uint64) *Checksummed_store {
+	var c Checksummed_store
+	c.log = log
+	c.store = store
+	c.path = path
+	c.block_size = block_size
+	c.errors = errors
+	return &c
+}
+
+func (this *Lbd_lib) get_store_block_size(device *Lbd_device, stree_block_size uint32) uint32 {
+	/* how big a block the file store has to hold for the stree to get stree block size out of it. */
+	if device.Checksums {
+		return stree_block_size + CHECKSUM_SIZE
+	}
+	return stree_block_size
+}
+
+func (this *Lbd_lib) wrap_checksums(device *Lbd_device, fstore Lbd_file_store, path string, stree_block_size uint32) Lbd_file_store {
+	if device.Checksums == false {
+		return fstore
+	}
+	return New_checksummed_store(this.log, fstore, path, stree_block_size, &device.checksum_errors)
+}
+
+func (this *Checksummed_store) checksum(block_num uint32, data []byte) uint32 {
+	var num [4]byte
+	binary.BigEndian.PutUint32(num[:], block_num)
+	var crc = crc32.Update(0, checksum_table, num[:])
+	return crc32.Update(crc, checksum_table, data)
+}
+
+func (this *Checksummed_store) verify(block_num uint32, data []byte) (tools.Ret, []byte) {
+	if len(data) < int(this.block_size)+CHECKSUM_SIZE {
+		return tools.Error(this.log, "short read of block ", block_num, " from backing storage: ", this.path,
+			", got ", len(data), " bytes, expected ", int(this.block_size)+CHECKSUM_SIZE), nil
+	}
+	var stored = binary.BigEndian.Uint32(data[this.block_size : this.block_size+CHECKSUM_SIZE])
+	if this.checksum(block_num, data[:this.block_size]) != stored {
+		atomic.AddUint64(this.errors, 1)
+		return tools.ErrorWithCode(this.log, int(syscall.EIO), "checksum mismatch reading block ", block_num,
+			" from backing storage: ", this.path), nil
+	}
+	return nil, data[:this.block_size]
+}
+
+func (this *Checksummed_store) Is_backing_store_uninitialized() (tools.Ret, bool) {
+	return this.store.Is_backing_store_uninitialized()
+}
+
+func (this *Checksummed_store) Init() tools.Ret {
+	return this.store.Init()
+}
+
+func (this *Checksummed_store) Startup(force bool) tools.Ret {
+	return this.store.Startup(force)
+}
+
+func (this *Checksummed_store) Shutdown() tools.Ret {
+	return this.store.Shutdown()
+}
+
+func (this *Checksummed_store) Open_datastore_readonly() tools.Ret {
+	return this.store.Open_datastore_readonly()
+}
+
+func (this *Checksummed_store) Load_header_and_check_magic(check_device_params bool) tools.Ret {
+	return this.store.Load_header_and_check_magic(check_device_params)
+}
+
+func (this *Checksummed_store) Get_store_information() (tools.Ret, string) {
+	return this.store.Get_store_information()
+}
+
+func (this *Checksummed_store) Get_usable_storage_bytes(path string) (tools.Ret, uint64) {
+	return this.store.Get_usable_storage_bytes(path)
+}
+
+func (this *Checksummed_store) Read_raw_data(block_num uint32) (tools.Ret, []byte) {
+	var ret, data = this.store.Read_raw_data(block_num)
+	if ret != nil || block_num == 0 {
+		return ret, data // the header has its own md5
+	}
+	return this.verify(block_num, data)
+}
+
+func (this *Checksummed_store) Load(block_num uint32) (tools.Ret, *[]byte) {
+	var ret, data = this.store.Load(block_num)
+	if ret != nil {
+		return ret, nil
+	}
+	var verified []byte
+	ret, verified = this.verify(block_num, *data)
+	if ret != nil {
+		return ret, nil
+	}
+	return nil, &verified
+}
+
+func (this *Checksummed_store) Load_limit(block_num uint32, length uint32) (tools.Ret, *[]byte) {
+	if length > this.block_size {
+		return tools.Error(this.log, "load asked to read ", length, " bytes but the block size is only ", this.block_size), nil
+	}
+	var ret, data = this.Load(block_num)
+	if ret != nil {
+		return ret, nil
+	}
+	var limited = (*data)[:length]
+	return nil, &limited
+}
+
+func (this *Checksummed_store) Store(block_num uint32, data *[]byte) tools.Ret {
+	/* short blocks get padded out, the checksum always goes in the same place. */
+	if len(*data) > int(this.block_size) {
+		return tools.Error(this.log, "store asked to write ", len(*data), " bytes but the block size is only ", this.block_size)
+	}
+	var block = make([]byte, this.block_size+CHECKSUM_SIZE)
+	copy(block, *data)
+	binary.BigEndian.PutUint32(block[this.block_size:], this.checksum(block_num, block[:this.block_size]))
+	return this.store.Store(block_num, &block)
+}
+
+func (this *Checksummed_store) Get_root_node() (tools.Ret, uint32) {
+	return this.store.Get_root_node()
+}
+
+func (this *Checksummed_store) Set_root_node(block_num uint32) tools.Ret {
+	return this.store.Set_root_node(block_num)
+}
+
+func (this *Checksummed_store) Get_free_position() (tools.Ret, uint32) {
+	return this.store.Get_free_position()
+}
+
+func (this *Checksummed_store) Get_total_blocks() (tools.Ret, uint32) {
+	return this.store.Get_total_blocks()
+}
+
+func (this *Checksummed_store) Allocate(amount uint32) (tools.Ret, []uint32) {
+	return this.store.Allocate(amount)
+}
+
+func (this *Checksummed_store) Deallocate() tools.Ret {
+	return this.store.Deallocate()
+}
+
+func (this *Checksummed_store) Wipe() tools.Ret {
+	return this.store.Wipe()
+}
+
+func (this *Checksummed_store) Dispose() tools.Ret {
+	return this.store.Dispose()
+}
@@ -0,0 +1,154 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nixomose/nixomosegotools/tools"
+)
+
+/* config check tells you what's wrong with the config file before it bites you: things it can't
+   parse, keys it doesn't know about (a typo in a key is otherwise silently ignored), and paths
+	 that don't exist or can't be made. config show prints what we actually ended up with after the
+	 defaults, the config file, the environment and the command line flags have all had their say. */
+
+type Config_problem struct {
+	Key     string `json:"key,omitempty"`
+	Problem string `json:"problem"`
+}
+
+func (this *Lbd_lib) get_effective_config() Lbd_config {
+	/* start with what came out of the config file and fill in what we resolved it to. */
+	var conf Lbd_config
+	if this.conf != nil {
+		conf = *this.conf
+	}
+	conf.Log.Log_file = this.Log_file
+	conf.Log.Log_level = int(this.Log_level)
+	conf.Zosbd2.Control_device = this.control_device
+	conf.Catalog.Catalog_file = this.catalog_file
+	conf.Events.Event_log_file = this.get_event_log_file()
+	return conf
+}
+
+func (this *Lbd_lib) config_show() tools.Ret {
+	var conf = this.get_effective_config()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# effective configuration, config file: %s\n", this.Config_file)
+	fmt.Fprintf(&sb, "# precedence: command line flags, then environment variables, then the config file, then defaults\n")
+	fmt.Fprintf(&sb, "# environment variables: %s\n", strings.Join(this.get_env_names(), " "))
+	var err = toml.NewEncoder(&sb).Encode(conf)
+	if err != nil {
+		return tools.Error(this.log, "unable to encode configuration, err: ", err)
+	}
+	fmt.Print(sb.String())
+	return nil
+}
+
+func (this *Lbd_lib) check_directory_for(key string, path string, problems []*Config_problem) []*Config_problem {
+	/* for things we're going to create, the file doesn't have to exist, but the directory it goes
+	   in has to be there or be makeable, and be a directory. */
+	if len(path) == 0 {
+		return problems
+	}
+	var dir = filepath.Dir(path)
+	for {
+		var info, err = os.Stat(dir)
+		if err == nil {
+			if info.IsDir() == false {
+				problems = append(problems, &Config_problem{Key: key, Problem: dir + " is not a directory"})
+			}
+			return problems
+		}
+		if os.IsNotExist(err) == false {
+			return append(problems, &Config_problem{Key: key, Problem: "unable to check " + dir + ": " + err.Error()})
+		}
+		var parent = filepath.Dir(dir)
+		if parent == dir {
+			return problems
+		}
+		dir = parent // we'd make it, as long as something above it exists
+	}
+}
+
+func (this *Lbd_lib) config_check() tools.Ret {
+	var problems = make([]*Config_problem, 0)
+
+	var conf Lbd_config
+	var md, err = toml.DecodeFile(this.Config_file, &conf)
+	if err != nil {
+		if os.IsNotExist(err) {
+			problems = append(problems, &Config_problem{Problem: "config file " + this.Config_file + " does not exist, using defaults"})
+		} else {
+			problems = append(problems, &Config_problem{Problem: "unable to parse config file " + this.Config_file + ": " + err.Error()})
+		}
+	} else {
+		for _, key := range md.Undecoded() {
+			problems = append(problems, &Config_problem{Key: key.String(), Problem: "unknown key, it is ignored"})
+		}
+	}
+
+	var effective = this.get_effective_config()
+
+	var info, err2 = os.Stat(effective.Zosbd2.Control_device)
+	if err2 != nil {
+		problems = append(problems, &Config_problem{Key: "Zosbd2.Control_device",
+			Problem: effective.Zosbd2.Control_device + ": " + err2.Error() + ", is the zosbd2 kernel module loaded?"})
+	} else if info.Mode()&os.ModeCharDevice == 0 {
+		problems = append(problems, &Config_problem{Key: "Zosbd2.Control_device",
+			Problem: effective.Zosbd2.Control_device + " is not a character device"})
+	}
+
+	/* reading it the same way everybody else does catches parse errors and duplicate names across the catalog.d */
+	var cat = New_catalog(this.log, effective.Catalog.Catalog_file, effective.Catalog.Catalog_dir)
+	if ret := cat.Read_catalog(cat); ret != nil {
+		problems = append(problems, &Config_problem{Key: "Catalog.Catalog_file", Problem: ret.Get_errmsg()})
+	}
+	problems = this.check_directory_for("Catalog.Catalog_file", effective.Catalog.Catalog_file, problems)
+	if len(effective.Catalog.Catalog_dir) > 0 {
+		if info, err2 := os.Stat(effective.Catalog.Catalog_dir); err2 == nil && info.IsDir() == false {
+			problems = append(problems, &Config_problem{Key: "Catalog.Catalog_dir", Problem: effective.Catalog.Catalog_dir + " is not a directory"})
+		} else if err2 != nil && os.IsNotExist(err2) == false {
+			problems = append(problems, &Config_problem{Key: "Catalog.Catalog_dir", Problem: err2.Error()})
+		}
+	}
+
+	problems = this.check_directory_for("Log.Log_file", effective.Log.Log_file, problems)
+	if len(effective.Log.Device_log_dir) > 0 {
+		problems = this.check_directory_for("Log.Device_log_dir", filepath.Join(effective.Log.Device_log_dir, "x"), problems)
+	}
+	if len(effective.Metrics.Socket_dir) > 0 {
+		problems = this.check_directory_for("Metrics.Socket_dir", filepath.Join(effective.Metrics.Socket_dir, "x"), problems)
+	}
+	problems = this.check_directory_for("Events.Event_log_file", effective.Events.Event_log_file, problems)
+
+	for _, profile_name := range this.get_profile_names() {
+		if ret := this.validate_profile(profile_name, effective.Profiles[profile_name]); ret != nil {
+			problems = append(problems, &Config_problem{Key: "Profiles." + profile_name, Problem: ret.Get_errmsg()})
+		}
+	}
+
+	if effective.Log.Log_max_size_mb < 0 {
+		problems = append(problems, &Config_problem{Key: "Log.Log_max_size_mb", Problem: "can not be negative"})
+	}
+	if effective.Log.Log_max_files < 0 {
+		problems = append(problems, &Config_problem{Key: "Log.Log_max_files", Problem: "can not be negative"})
+	}
+
+	bytesout, err := json.MarshalIndent(problems, "", " ")
+	if err != nil {
+		return tools.Error(this.log, "unable to marshal config problems into json, err: ", err)
+	}
+	fmt.Println(string(bytesout))
+	if len(problems) > 0 {
+		return tools.Error(this.log, "found ", len(problems), " problems with the configuration")
+	}
+	return nil
+}
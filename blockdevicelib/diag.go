@@ -27,8 +27,8 @@ func (this *Lbd_lib) Dump_header(cat *Catalog, device_name string) tools.Ret {
 	var device = this.New_block_device_from_catalog_entry(catentry)
 	var block_size uint32 = device.Stree_calculated_node_size
 
-	var fstore *stree_v_lib.File_store_aligned
-	ret, fstore = this.make_file_store_aligned(device, block_size)
+	var fstore Lbd_file_store
+	ret, fstore = this.make_backing_store(device, block_size)
 	if ret != nil {
 		return ret
 	}
@@ -101,8 +101,8 @@ func (this *Lbd_lib) Dump_block_header(cat *Catalog, device_name string, block_n
 
 	var device = this.New_block_device_from_catalog_entry(catentry)
 	var block_size uint32 = device.Stree_calculated_node_size
-	var fstore *stree_v_lib.File_store_aligned
-	ret, fstore = this.make_file_store_aligned(device, block_size)
+	var fstore Lbd_file_store
+	ret, fstore = this.make_backing_store(device, block_size)
 	if ret != nil {
 		return ret
 	}
@@ -0,0 +1,529 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"container/list"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/nixomose/nixomosegotools/tools"
+	"github.com/nixomose/zosbd2goclient/zosbd2cmdlib/zosbd2interfaces"
+	"github.com/spf13/cobra"
+)
+
+/* encryption at rest, so a laptop or a shared build host can have a scratch volume nobody else can
+   read out of the backing file. it's a data pipeline element that comes with the library, so it
+	 sees what the kompressor sees, one stree node's worth of data at a time, and the stree and the
+	 file store underneath don't know it's there.
+	 the catch is that authenticated encryption makes things bigger, it needs a nonce and a tag, and
+	 the storage mechanism hands the pipeline exactly as much as the stree node can hold. so for an
+	 encrypted device we put encryption_room around the storage mechanism, which only puts
+	 ENCRYPTION_OVERHEAD less than a node's worth of device data in each node, and tells the pipeline
+	 element which block it's working on, because pipe in and pipe out don't get told.
+	 the storage mechanism runs the pipeline front to back in both directions, so the element goes in
+	 twice, once at the front and once at the back, and everything else in the pipeline goes in between
+	 and only ever sees plain data: going in, the front drops the room off the end and the back encrypts,
+	 coming out, the front decrypts and the back puts the room back. the rest of the pipeline is told
+	 the node size is that much smaller, see Get_node_size_in_bytes.
+	 every block gets aes-256-gcm with the block number as additional data, so a block that gets copied
+	 to somewhere else fails to decrypt. gcm with a random 96 bit nonce is only good for about 2^32
+	 writes under one key before the chance of a repeated nonce (which gives away the key's
+	 authentication) gets too big, and a busy device gets there. so every write makes a new random
+	 128 bit salt, and the key for that one write is an hmac of the salt under the device's key, and
+	 the gcm nonce is random on top of that. the salt and nonce go in front of the data, the tag after.
+	 the key comes from a keyfile or a passphrase in an environment variable, whichever the catalog
+	 entry names, and either way it goes through pbkdf2 with a salt we make at catalog add. the catalog
+	 keeps the salt and a check value so we can tell a wrong key from a bad block. the key is worked
+	 out in Process_device, so a wrong one fails the start instead of the first read.
+	 what this doesn't hide is the stree itself, which blocks of the device have been written and which
+	 haven't, and with the kompressor in the pipeline, how well each one compressed. and it doesn't stop
+	 somebody who can write the backing file from putting back an older copy of a block, that needs
+	 somewhere to keep track of every block's version, and we don't have one. */
+
+const ENCRYPTION_CIPHER = "aes-256-gcm, hmac-sha256 key per write"
+const ENCRYPTION_KEY_SIZE = 32
+const ENCRYPTION_BLOCK_SALT_SIZE = 16 // makes the key for one write
+const ENCRYPTION_GCM_NONCE_SIZE = 12
+const ENCRYPTION_NONCE_SIZE = ENCRYPTION_BLOCK_SALT_SIZE + ENCRYPTION_GCM_NONCE_SIZE
+const ENCRYPTION_TAG_SIZE = 16
+const ENCRYPTION_OVERHEAD = ENCRYPTION_NONCE_SIZE + ENCRYPTION_TAG_SIZE
+const ENCRYPTION_SALT_SIZE = 16
+const ENCRYPTION_KDF_ITERATIONS = 200000
+
+const ENCRYPTION_KEY_CHECK_LABEL = "blockdevicelib key check"
+const ENCRYPTION_BLOCK_KEY_LABEL = "blockdevicelib block key"
+
+type encryption_pipeline_element struct {
+	lib     *Lbd_lib
+	context zosbd2interfaces.Data_pipeline_element_context
+	tail    *encryption_pipeline_tail
+
+	/* set up by Process_device for whichever device went last, see pipeline_lock. */
+	device_name string
+	key         []byte // nil if the device isn't encrypted
+	node_size   uint32 // what the storage mechanism hands the pipeline
+
+	/* set by encryption_room around each call it makes to the storage mechanism. */
+	have_block bool
+	block_num  uint64
+}
+
+type encryption_pipeline_tail struct {
+	element *encryption_pipeline_element
+}
+
+var _ zosbd2interfaces.Data_pipeline_element = &encryption_pipeline_element{}
+var _ zosbd2interfaces.Data_pipeline_element = (*encryption_pipeline_element)(nil)
+var _ zosbd2interfaces.Data_pipeline_element = &encryption_pipeline_tail{}
+var _ zosbd2interfaces.Data_pipeline_element = (*encryption_pipeline_tail)(nil)
+
+func new_encryption_pipeline_element(lib *Lbd_lib) *encryption_pipeline_element {
+	var e encryption_pipeline_element
+	e.lib = lib
+	e.context = nil
+	e.tail = &encryption_pipeline_tail{element: &e}
+	e.key = nil
+	return &e
+}
+
+func (this *Lbd_device) is_encrypted() bool {
+	return len(this.Encryption_keyfile) > 0 || len(this.Encryption_passphrase_env) > 0
+}
+
+func (this *encryption_pipeline_element) Add_to_pipeline(data_pipeline *list.List) *list.List {
+	/* make a new list with us at both ends, the original list is left alone. */
+	var ret = list.New()
+	ret.PushBack(this)
+	if data_pipeline != nil {
+		ret.PushBackList(data_pipeline)
+	}
+	ret.PushBack(this.tail)
+	return ret
+}
+
+func (this *encryption_pipeline_element) Process_parameters(params *cobra.Command) tools.Ret {
+	/* where the key comes from is in the catalog entry, not on the command line, so there's nothing
+	   to pick up here, it all happens in Process_device once we know which device it is. */
+	return nil
+}
+
+func (this *encryption_pipeline_element) Process_device(device zosbd2interfaces.Device_interface) tools.Ret {
+	var lbd_device, ok = device.(*Lbd_device)
+	if ok == false {
+		return tools.Error(this.lib.log, "the encryption pipeline element can only work with a local block device")
+	}
+	if lbd_device.is_encrypted() == false {
+		return nil // nothing to hold onto, and only encrypted devices get us in their pipeline.
+	}
+	this.device_name = ""
+	this.key = nil
+	var ret, key = this.lib.get_encryption_key(lbd_device)
+	if ret != nil {
+		return ret
+	}
+	this.device_name = lbd_device.Device_name
+	this.key = key
+	this.node_size = lbd_device.Stree_value_size * (lbd_device.Additional_nodes_per_block + 1)
+	return nil
+}
+
+func (this *encryption_pipeline_element) check_ready() tools.Ret {
+	if this.key == nil {
+		return tools.Error(this.lib.log, "the encryption pipeline element hasn't been given a key for this device")
+	}
+	if this.have_block == false {
+		return tools.Error(this.lib.log, "the encryption pipeline element wasn't told which block it's working on for device: ",
+			this.device_name)
+	}
+	return nil
+}
+
+func (this *encryption_pipeline_element) Pipe_in(data_in_out *[]byte) tools.Ret {
+	/* drop the room encryption_room left on the end, the rest of the pipeline doesn't get to use it. */
+	var ret = this.check_ready()
+	if ret != nil {
+		return ret
+	}
+	if len(*data_in_out) != int(this.node_size) {
+		return tools.Error(this.lib.log, "encryption pipeline element was handed ", len(*data_in_out), " bytes for block ",
+			this.block_num, " of device: ", this.device_name, ", expected ", this.node_size)
+	}
+	*data_in_out = (*data_in_out)[:this.node_size-ENCRYPTION_OVERHEAD]
+	return nil
+}
+
+func (this *encryption_pipeline_element) Pipe_out(data_in_out *[]byte) tools.Ret {
+	var ret = this.check_ready()
+	if ret != nil {
+		return ret
+	}
+	var plain []byte
+	ret, plain = this.decrypt(*data_in_out)
+	if ret != nil {
+		return ret
+	}
+	*data_in_out = plain
+	return nil
+}
+
+func (this *encryption_pipeline_element) Get_context() zosbd2interfaces.Data_pipeline_element_context {
+	return this.context
+}
+
+func (this *encryption_pipeline_element) Set_context(context zosbd2interfaces.Data_pipeline_element_context) {
+	this.context = context
+}
+
+func (this *encryption_pipeline_tail) Process_parameters(params *cobra.Command) tools.Ret {
+	return nil // the front does this for both of us
+}
+
+func (this *encryption_pipeline_tail) Process_device(device zosbd2interfaces.Device_interface) tools.Ret {
+	return nil
+}
+
+func (this *encryption_pipeline_tail) Pipe_in(data_in_out *[]byte) tools.Ret {
+	var ret = this.element.check_ready()
+	if ret != nil {
+		return ret
+	}
+	var sealed []byte
+	ret, sealed = this.element.encrypt(*data_in_out)
+	if ret != nil {
+		return ret
+	}
+	*data_in_out = sealed
+	return nil
+}
+
+func (this *encryption_pipeline_tail) Pipe_out(data_in_out *[]byte) tools.Ret {
+	/* put back the room the front took off, the storage mechanism wants a whole node. */
+	var ret = this.element.check_ready()
+	if ret != nil {
+		return ret
+	}
+	if len(*data_in_out) > int(this.element.node_size-ENCRYPTION_OVERHEAD) {
+		return tools.Error(this.element.lib.log, "block ", this.element.block_num, " of device: ", this.element.device_name,
+			" came out of the pipeline with ", len(*data_in_out), " bytes, which doesn't leave room for encryption")
+	}
+	var whole = make([]byte, this.element.node_size)
+	copy(whole, *data_in_out)
+	*data_in_out = whole
+	return nil
+}
+
+func (this *encryption_pipeline_tail) Get_context() zosbd2interfaces.Data_pipeline_element_context {
+	return this.element.Get_context()
+}
+
+func (this *encryption_pipeline_tail) Set_context(context zosbd2interfaces.Data_pipeline_element_context) {
+	this.element.Set_context(context)
+}
+
+func (this *Lbd_lib) validate_encryption(device *Lbd_device) tools.Ret {
+	if len(device.Encryption_keyfile) > 0 && len(device.Encryption_passphrase_env) > 0 {
+		return tools.ErrorWithCode(this.log, int(syscall.EINVAL), "device: ", device.Device_name,
+			" can have an encryption keyfile or an encryption passphrase, not both")
+	}
+	var node_size = uint64(device.Stree_value_size) * uint64(device.Additional_nodes_per_block+1)
+	if device.is_encrypted() && device.Stree_value_size > 0 && node_size <= ENCRYPTION_OVERHEAD {
+		return tools.ErrorWithCode(this.log, int(syscall.EINVAL), "device: ", device.Device_name, " has a ", node_size,
+			" byte stree node, which is too small to hold encrypted data")
+	}
+	return nil
+}
+
+func (this *Lbd_lib) setup_encryption(device *Lbd_device) tools.Ret {
+	/* catalog add, make a new salt and work out the check value for whatever key we were given. if we
+	   can't get the key now, better to find out before there's anything on disk. */
+	device.Encryption_salt = ""
+	device.Encryption_key_check = ""
+	device.encryption_key = nil
+	if device.is_encrypted() == false {
+		return nil
+	}
+	var ret, secret = this.read_encryption_secret(device)
+	if ret != nil {
+		return ret
+	}
+	var salt = make([]byte, ENCRYPTION_SALT_SIZE)
+	var _, err = rand.Read(salt)
+	if err != nil {
+		return tools.Error(this.log, "unable to make an encryption salt, err: ", err)
+	}
+	var key = pbkdf2_sha256(secret, salt, ENCRYPTION_KDF_ITERATIONS, ENCRYPTION_KEY_SIZE)
+	device.Encryption_salt = hex.EncodeToString(salt)
+	device.Encryption_key_check = hex.EncodeToString(this.get_encryption_key_check(key))
+	return nil
+}
+
+func (this *Lbd_lib) read_encryption_secret(device *Lbd_device) (tools.Ret, []byte) {
+	if len(device.Encryption_keyfile) > 0 {
+		var secret, err = os.ReadFile(device.Encryption_keyfile)
+		if err != nil {
+			return tools.Error(this.log, "unable to read encryption keyfile: ", device.Encryption_keyfile, ", err: ", err), nil
+		}
+		if len(secret) == 0 {
+			return tools.ErrorWithCode(this.log, int(syscall.EINVAL), "encryption keyfile: ", device.Encryption_keyfile, " is empty"), nil
+		}
+		return nil, secret
+	}
+	var passphrase = os.Getenv(device.Encryption_passphrase_env)
+	if len(passphrase) == 0 {
+		return tools.ErrorWithCode(this.log, int(syscall.ENOKEY), "the encryption passphrase for device: ", device.Device_name,
+			" goes in environment variable: ", device.Encryption_passphrase_env, ", and it's not set"), nil
+	}
+	return nil, []byte(passphrase)
+}
+
+func (this *Lbd_lib) get_encryption_key_check(key []byte) []byte {
+	/* not the key, or anything you could get the key back out of, just enough to know it's the same key. */
+	var mac = hmac.New(sha256.New, key)
+	mac.Write([]byte(ENCRYPTION_KEY_CHECK_LABEL))
+	return mac.Sum(nil)[:16]
+}
+
+func (this *Lbd_lib) get_encryption_key(device *Lbd_device) (tools.Ret, []byte) {
+	/* work the key out the first time somebody needs it, and keep it, so a restart of the handler
+	   doesn't have to go through pbkdf2 again. */
+	device.encryption_lock.Lock()
+	defer device.encryption_lock.Unlock()
+	if device.encryption_key != nil {
+		return nil, device.encryption_key
+	}
+
+	var salt, err = hex.DecodeString(device.Encryption_salt)
+	if err != nil || len(salt) != ENCRYPTION_SALT_SIZE {
+		return tools.Error(this.log, "device: ", device.Device_name, " has a bad encryption salt in the catalog"), nil
+	}
+	var check []byte
+	check, err = hex.DecodeString(device.Encryption_key_check)
+	if err != nil || len(check) == 0 {
+		return tools.Error(this.log, "device: ", device.Device_name, " has a bad encryption key check in the catalog"), nil
+	}
+	var ret, secret = this.read_encryption_secret(device)
+	if ret != nil {
+		return ret, nil
+	}
+	var key = pbkdf2_sha256(secret, salt, ENCRYPTION_KDF_ITERATIONS, ENCRYPTION_KEY_SIZE)
+	if hmac.Equal(this.get_encryption_key_check(key), check) == false {
+		return tools.ErrorWithCode(this.log, int(syscall.EKEYREJECTED), "wrong encryption key for device: ", device.Device_name), nil
+	}
+	device.encryption_key = key
+	return nil, key
+}
+
+func pbkdf2_sha256(password []byte, salt []byte, iterations int, key_length int) []byte {
+	/* rfc 8018, there's no pbkdf2 in the standard library we can count on and it's not worth a
+	   dependency for twenty lines. */
+	var prf = hmac.New(sha256.New, password)
+	var block_count = (key_length + prf.Size() - 1) / prf.Size()
+	var key = make([]byte, 0, block_count*prf.Size())
+	var counter [4]byte
+	for block := 1; block <= block_count; block++ {
+		binary.BigEndian.PutUint32(counter[:], uint32(block))
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(counter[:])
+		var u = prf.Sum(nil)
+		var t = make([]byte, len(u))
+		copy(t, u)
+		for lp := 1; lp < iterations; lp++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for x := range t {
+				t[x] ^= u[x]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:key_length]
+}
+
+func (this *encryption_pipeline_element) additional_data() []byte {
+	var num = make([]byte, 8)
+	binary.BigEndian.PutUint64(num, this.block_num)
+	return num
+}
+
+func (this *encryption_pipeline_element) get_block_aead(salt []byte) (tools.Ret, cipher.AEAD) {
+	/* the key for the one write this salt was made for. */
+	var mac = hmac.New(sha256.New, this.key)
+	mac.Write([]byte(ENCRYPTION_BLOCK_KEY_LABEL))
+	mac.Write(salt)
+	var block, err = aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return tools.Error(this.lib.log, "unable to make cipher for block ", this.block_num, " of device: ", this.device_name,
+			", err: ", err), nil
+	}
+	var aead cipher.AEAD
+	aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return tools.Error(this.lib.log, "unable to make gcm for block ", this.block_num, " of device: ", this.device_name,
+			", err: ", err), nil
+	}
+	return nil, aead
+}
+
+func (this *encryption_pipeline_element) encrypt(plain []byte) (tools.Ret, []byte) {
+	if len(plain) > int(this.node_size-ENCRYPTION_OVERHEAD) {
+		return tools.Error(this.lib.log, "block ", this.block_num, " of device: ", this.device_name, " is ", len(plain),
+			" bytes going into encryption, which doesn't leave room in a ", this.node_size, " byte node"), nil
+	}
+	var sealed = make([]byte, ENCRYPTION_NONCE_SIZE, len(plain)+ENCRYPTION_OVERHEAD)
+	var _, err = rand.Read(sealed)
+	if err != nil {
+		return tools.Error(this.lib.log, "unable to make a nonce for block ", this.block_num, ", err: ", err), nil
+	}
+	var ret, aead = this.get_block_aead(sealed[:ENCRYPTION_BLOCK_SALT_SIZE])
+	if ret != nil {
+		return ret, nil
+	}
+	sealed = aead.Seal(sealed, sealed[ENCRYPTION_BLOCK_SALT_SIZE:ENCRYPTION_NONCE_SIZE], plain, this.additional_data())
+	return nil, sealed
+}
+
+func (this *encryption_pipeline_element) decrypt(sealed []byte) (tools.Ret, []byte) {
+	if len(sealed) < ENCRYPTION_OVERHEAD {
+		return tools.ErrorWithCode(this.lib.log, int(syscall.EIO), "block ", this.block_num, " of device: ", this.device_name,
+			" is only ", len(sealed), " bytes, too short to be encrypted"), nil
+	}
+	var ret, aead = this.get_block_aead(sealed[:ENCRYPTION_BLOCK_SALT_SIZE])
+	if ret != nil {
+		return ret, nil
+	}
+	var nonce = sealed[ENCRYPTION_BLOCK_SALT_SIZE:ENCRYPTION_NONCE_SIZE]
+	var plain, err = aead.Open(nil, nonce, sealed[ENCRYPTION_NONCE_SIZE:], this.additional_data())
+	if err != nil {
+		return tools.ErrorWithCode(this.lib.log, int(syscall.EIO), "unable to decrypt block ", this.block_num,
+			" of device: ", this.device_name, ", it's been changed or damaged"), nil
+	}
+	return nil, plain
+}
+
+/* the storage mechanism the handler calls, for an encrypted device. */
+
+type encryption_room struct {
+	log         *tools.Nixomosetools_logger
+	lock        sync.Mutex
+	storage     zosbd2interfaces.Storage_mechanism
+	element     *encryption_pipeline_element
+	device_name string
+	node_size   uint32 // what the storage mechanism underneath works in
+	block_size  uint32 // what we work in, a node less ENCRYPTION_OVERHEAD
+}
+
+var _ zosbd2interfaces.Storage_mechanism = &encryption_room{}
+var _ zosbd2interfaces.Storage_mechanism = (*encryption_room)(nil)
+
+func (this *Lbd_lib) wrap_encryption_room(device *Lbd_device, storage zosbd2interfaces.Storage_mechanism) zosbd2interfaces.Storage_mechanism {
+	if device.is_encrypted() == false {
+		return storage
+	}
+	var ret encryption_room
+	ret.log = this.log
+	ret.storage = storage
+	ret.element = this.encryption
+	ret.device_name = device.Device_name
+	ret.node_size = storage.Get_block_size()
+	ret.block_size = ret.node_size - ENCRYPTION_OVERHEAD
+	return &ret
+}
+
+func (this *encryption_room) with_block(block_num uint64, fn func(start_in_bytes uint64) tools.Ret) tools.Ret {
+	/* anything the pipeline does in fn is for this block. if the element hasn't been set up for
+	   this device, nothing goes through, we're not going to write anybody's data in the clear. */
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.element.key == nil || this.element.device_name != this.device_name {
+		return tools.ErrorWithCode(this.log, int(syscall.ENOKEY), "the encryption pipeline element isn't set up for device: ",
+			this.device_name)
+	}
+	this.element.block_num = block_num
+	this.element.have_block = true
+	defer func() { this.element.have_block = false }()
+	return fn(block_num * uint64(this.node_size))
+}
+
+func (this *encryption_room) Read_block(start_in_bytes uint64, length uint32, data []byte) tools.Ret {
+	var done uint32 = 0
+	for done < length {
+		var pos = start_in_bytes + uint64(done)
+		var block_num = pos / uint64(this.block_size)
+		var offset = uint32(pos % uint64(this.block_size))
+		var amount = tools.Minint(int(this.block_size-offset), int(length-done))
+		var ret = this.with_block(block_num, func(start uint64) tools.Ret {
+			return this.storage.Read_block(start+uint64(offset), uint32(amount), data[done:done+uint32(amount)])
+		})
+		if ret != nil {
+			return ret
+		}
+		done += uint32(amount)
+	}
+	return nil
+}
+
+func (this *encryption_room) Write_block(start_in_bytes uint64, length uint32, data []byte) tools.Ret {
+	var done uint32 = 0
+	for done < length {
+		var pos = start_in_bytes + uint64(done)
+		var block_num = pos / uint64(this.block_size)
+		var offset = uint32(pos % uint64(this.block_size))
+		var amount = tools.Minint(int(this.block_size-offset), int(length-done))
+		var ret = this.with_block(block_num, func(start uint64) tools.Ret {
+			if amount == int(this.block_size) {
+				/* a whole block, write the whole node with the room on the end, so the storage
+				   mechanism doesn't read it first to fill in the rest. */
+				var whole = make([]byte, this.node_size)
+				copy(whole, data[done:done+uint32(amount)])
+				return this.storage.Write_block(start, this.node_size, whole)
+			}
+			return this.storage.Write_block(start+uint64(offset), uint32(amount), data[done:done+uint32(amount)])
+		})
+		if ret != nil {
+			return ret
+		}
+		done += uint32(amount)
+	}
+	return nil
+}
+
+func (this *encryption_room) Discard_block(start_in_bytes uint64, length uint32) tools.Ret {
+	/* discards can cover most of the device, so this counts in 64 bits. */
+	var done uint64 = 0
+	for done < uint64(length) {
+		var pos = start_in_bytes + done
+		var block_num = pos / uint64(this.block_size)
+		var offset = pos % uint64(this.block_size)
+		var amount = uint64(this.block_size) - offset
+		if amount > uint64(length)-done {
+			amount = uint64(length) - done
+		}
+		var ret = this.with_block(block_num, func(start uint64) tools.Ret {
+			if amount == uint64(this.block_size) {
+				return this.storage.Discard_block(start, this.node_size) // the whole node goes
+			}
+			return this.storage.Discard_block(start+offset, uint32(amount))
+		})
+		if ret != nil {
+			return ret
+		}
+		done += amount
+	}
+	return nil
+}
+
+func (this *encryption_room) Get_block_size() uint32 {
+	return this.block_size
+}
@@ -0,0 +1,215 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/hex"
+	"syscall"
+	"testing"
+
+	"github.com/nixomose/zosbd2goclient/zosbd2_stree_v_storage_mechanism"
+)
+
+const TEST_PASSPHRASE_ENV = "LBD_TEST_ENCRYPTION_PASSPHRASE"
+
+func TestPbkdf2Sha256(t *testing.T) {
+	/* rfc 7914 section 11, and the rfc 6070 cases done with sha256 instead of sha1. */
+	var cases = []struct {
+		password   string
+		salt       string
+		iterations int
+		want       string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+			"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56" +
+			"a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096,
+			"348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+		{"pass\x00word", "sa\x00lt", 4096, "89b69d0516f829893c696226650a8687"},
+	}
+	for _, c := range cases {
+		var want, _ = hex.DecodeString(c.want)
+		var got = pbkdf2_sha256([]byte(c.password), []byte(c.salt), c.iterations, len(want))
+		if bytes.Equal(got, want) == false {
+			t.Errorf("pbkdf2(%q, %q, %d, %d): expected %x, got %x", c.password, c.salt, c.iterations, len(want), want, got)
+		}
+	}
+}
+
+func new_test_encrypted_device(t *testing.T, lib *Lbd_lib, passphrase string) *Lbd_device {
+	t.Setenv(TEST_PASSPHRASE_ENV, passphrase)
+	var device Lbd_device
+	device.Device_name = "crypt"
+	device.Stree_value_size = 4096
+	device.Additional_nodes_per_block = 1
+	device.Encryption_passphrase_env = TEST_PASSPHRASE_ENV
+	device.stree_ramdisk = true
+	var ret = lib.setup_encryption(&device)
+	if ret != nil {
+		t.Fatal(ret.Get_errmsg())
+	}
+	return &device
+}
+
+func start_test_encrypted_device(t *testing.T, lib *Lbd_lib, device *Lbd_device) {
+	t.Helper()
+	var ret = lib.device_startup(device, false, lib.data_pipeline)
+	if ret != nil {
+		t.Fatal(ret.Get_errmsg())
+	}
+	t.Cleanup(func() { lib.device_shutdown(device) })
+	ret = lib.process_pipeline_init_last_chance(lib.data_pipeline, device)
+	if ret != nil {
+		t.Fatal(ret.Get_errmsg())
+	}
+}
+
+func new_test_encryption_lib(t *testing.T) *Lbd_lib {
+	var lib = new_test_lbd_lib(t)
+	lib.data_pipeline = list.New()
+	return lib
+}
+
+func get_test_stored_value(t *testing.T, device *Lbd_device, block_num uint64) []byte {
+	t.Helper()
+	var ret, found, data = device.stree.Fetch(zosbd2_stree_v_storage_mechanism.Generate_key_from_block_num(block_num))
+	if ret != nil || found == false {
+		t.Fatalf("block %d isn't in the stree", block_num)
+	}
+	return data
+}
+
+func set_test_stored_value(t *testing.T, device *Lbd_device, block_num uint64, data []byte) {
+	t.Helper()
+	var ret = device.stree.Update_or_insert(zosbd2_stree_v_storage_mechanism.Generate_key_from_block_num(block_num), data)
+	if ret != nil {
+		t.Fatal(ret.Get_errmsg())
+	}
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	var lib = new_test_encryption_lib(t)
+	var device = new_test_encrypted_device(t, lib, "correct horse battery staple")
+	start_test_encrypted_device(t, lib, device)
+
+	var node_size = device.Stree_value_size * (device.Additional_nodes_per_block + 1)
+	var block_size = device.storage.Get_block_size()
+	if block_size != node_size-ENCRYPTION_OVERHEAD || device.Get_node_size_in_bytes() != block_size {
+		t.Fatalf("expected the device to see %d byte blocks, storage says %d and the pipeline is told %d",
+			node_size-ENCRYPTION_OVERHEAD, block_size, device.Get_node_size_in_bytes())
+	}
+
+	/* keep a plain copy of what should be there, and do whole blocks, bits of blocks, and across blocks. */
+	var expect = make([]byte, 4*block_size)
+	var write = func(start uint32, length uint32, fill byte) {
+		var data = bytes.Repeat([]byte{fill}, int(length))
+		var ret = device.storage.Write_block(uint64(start), length, data)
+		if ret != nil {
+			t.Fatal(ret.Get_errmsg())
+		}
+		copy(expect[start:], data)
+	}
+	write(0, block_size, 'a')
+	write(block_size+100, 200, 'b')
+	write(2*block_size-10, 20, 'c')
+	write(3*block_size, block_size, 'd')
+
+	var ret = device.storage.Discard_block(uint64(3*block_size+block_size/2), block_size/2)
+	if ret != nil {
+		t.Fatal(ret.Get_errmsg())
+	}
+	for lp := 3*block_size + block_size/2; lp < 4*block_size; lp++ {
+		expect[lp] = 0
+	}
+
+	var got = make([]byte, len(expect))
+	ret = device.storage.Read_block(0, uint32(len(got)), got)
+	if ret != nil {
+		t.Fatal(ret.Get_errmsg())
+	}
+	if bytes.Equal(got, expect) == false {
+		t.Fatal("what came back isn't what was written")
+	}
+
+	/* and what's in the stree is a whole node that doesn't look anything like what was written. */
+	var stored = get_test_stored_value(t, device, 0)
+	if len(stored) != int(node_size) {
+		t.Fatalf("expected block 0 to be stored as %d bytes, got %d", node_size, len(stored))
+	}
+	if bytes.Contains(stored, bytes.Repeat([]byte{'a'}, 32)) {
+		t.Fatal("block 0 was stored in the clear")
+	}
+}
+
+func TestEncryptionWrongKey(t *testing.T) {
+	var lib = new_test_encryption_lib(t)
+	var device = new_test_encrypted_device(t, lib, "correct horse battery staple")
+	t.Setenv(TEST_PASSPHRASE_ENV, "incorrect horse battery staple")
+
+	var ret = lib.device_startup(device, false, lib.data_pipeline)
+	if ret != nil {
+		t.Fatal(ret.Get_errmsg())
+	}
+	defer lib.device_shutdown(device)
+	ret = lib.process_pipeline_init_last_chance(lib.data_pipeline, device)
+	if ret == nil || ret.Get_errcode() != int(syscall.EKEYREJECTED) {
+		t.Fatalf("expected a wrong key to be rejected, got %v", ret)
+	}
+
+	/* and with no key, nothing goes through, in the clear or otherwise. */
+	var data = make([]byte, 512)
+	ret = device.storage.Write_block(0, uint32(len(data)), data)
+	if ret == nil || ret.Get_errcode() != int(syscall.ENOKEY) {
+		t.Fatalf("expected a write without a key to be refused, got %v", ret)
+	}
+}
+
+func TestEncryptionRejectsChangedBlocks(t *testing.T) {
+	var lib = new_test_encryption_lib(t)
+	var device = new_test_encrypted_device(t, lib, "correct horse battery staple")
+	start_test_encrypted_device(t, lib, device)
+
+	var block_size = device.storage.Get_block_size()
+	for block_num := uint32(0); block_num < 3; block_num++ {
+		var data = bytes.Repeat([]byte{byte('x' + block_num)}, int(block_size))
+		var ret = device.storage.Write_block(uint64(block_num*block_size), block_size, data)
+		if ret != nil {
+			t.Fatal(ret.Get_errmsg())
+		}
+	}
+	var read = func(block_num uint32) error {
+		var data = make([]byte, block_size)
+		var ret = device.storage.Read_block(uint64(block_num*block_size), block_size, data)
+		if ret != nil {
+			if ret.Get_errcode() != int(syscall.EIO) {
+				t.Fatalf("expected EIO reading block %d, got %s", block_num, ret.Get_errmsg())
+			}
+			return ret
+		}
+		return nil
+	}
+
+	/* one flipped bit anywhere in the stored block. */
+	var flipped = get_test_stored_value(t, device, 0)
+	flipped[ENCRYPTION_NONCE_SIZE+10] ^= 0x01
+	set_test_stored_value(t, device, 0, flipped)
+	if read(0) == nil {
+		t.Fatal("expected a changed block to fail to decrypt")
+	}
+
+	/* a perfectly good block, in the wrong place. */
+	set_test_stored_value(t, device, 2, get_test_stored_value(t, device, 1))
+	if read(2) == nil {
+		t.Fatal("expected a block copied to another block number to fail to decrypt")
+	}
+	if read(1) != nil {
+		t.Fatal("the block that was copied should still read where it belongs")
+	}
+}
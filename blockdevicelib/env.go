@@ -0,0 +1,127 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+/* in a container or ci job it's a lot easier to set an environment variable than to get -c -l -v
+   onto every command line, so every persistent flag and every config file field can also come
+	 from an environment variable named after the application, so for an application called lbd you'd
+	 get LBD_CONFIG_FILE, LBD_LOG_LEVEL, LBD_CONTROL_DEVICE, LBD_CATALOG_FILE and so on.
+	 the config file field names are unique across sections so we leave the section out of the name.
+	 the order of precedence is: command line flags, then environment variables, then the config
+	 file, then the defaults. */
+
+func (this *Lbd_lib) get_env_prefix() string {
+	var prefix = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, this.application_name)
+	return strings.ToUpper(prefix) + "_"
+}
+
+func (this *Lbd_lib) get_env_name(name string) string {
+	return this.get_env_prefix() + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+func (this *Lbd_lib) apply_env_to_flags() []string {
+	/* this runs before the log exists, since the log level can come from here, so hand back
+	   what went wrong and let the caller log it. */
+	var problems = make([]string, 0)
+	if this.root_cmd == nil {
+		return problems
+	}
+	var flags = this.root_cmd.PersistentFlags()
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if flag.Changed {
+			return // the command line wins
+		}
+		var env_name = this.get_env_name(flag.Name)
+		var value, set = os.LookupEnv(env_name)
+		if set == false {
+			return
+		}
+		/* setting it this way marks it changed, so it wins over the config file like a flag would. */
+		var err = flags.Set(flag.Name, value)
+		if err != nil {
+			problems = append(problems, "ignoring environment variable: "+env_name+"="+value+", err: "+err.Error())
+		}
+	})
+	return problems
+}
+
+func (this *Lbd_lib) apply_env_to_config(conf *Lbd_config) {
+	/* walk the config sections and fields, and override whatever has an environment variable set. */
+	var sections = reflect.ValueOf(conf).Elem()
+	for s := 0; s < sections.NumField(); s++ {
+		var section = sections.Field(s)
+		if section.Kind() != reflect.Struct {
+			continue
+		}
+		for f := 0; f < section.NumField(); f++ {
+			var field = section.Field(f)
+			var env_name = this.get_env_name(section.Type().Field(f).Name)
+			var value, set = os.LookupEnv(env_name)
+			if set == false || field.CanSet() == false {
+				continue
+			}
+			switch field.Kind() {
+			case reflect.String:
+				field.SetString(value)
+			case reflect.Int:
+				var v, err = strconv.Atoi(value)
+				if err != nil {
+					this.log.Error("ignoring environment variable: ", env_name, "=", value, ", it must be a number")
+					continue
+				}
+				field.SetInt(int64(v))
+			case reflect.Bool:
+				var v, err = strconv.ParseBool(value)
+				if err != nil {
+					this.log.Error("ignoring environment variable: ", env_name, "=", value, ", it must be true or false")
+					continue
+				}
+				field.SetBool(v)
+			}
+		}
+	}
+}
+
+func (this *Lbd_lib) get_env_names() []string {
+	/* for config show, so you can see what you can set. */
+	var names = make([]string, 0)
+	if this.root_cmd != nil {
+		this.root_cmd.PersistentFlags().VisitAll(func(flag *pflag.Flag) {
+			names = append(names, this.get_env_name(flag.Name))
+		})
+	}
+	var seen = make(map[string]bool)
+	for _, name := range names {
+		seen[name] = true
+	}
+	var sections = reflect.TypeOf(Lbd_config{})
+	for s := 0; s < sections.NumField(); s++ {
+		var section = sections.Field(s).Type
+		if section.Kind() != reflect.Struct {
+			continue
+		}
+		for f := 0; f < section.NumField(); f++ {
+			var name = this.get_env_name(section.Field(f).Name)
+			if seen[name] == false {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
@@ -0,0 +1,160 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nixomose/nixomosegotools/tools"
+)
+
+/* every time somebody changes something, we append a json line to the event log saying who, what,
+   when and how it went. catalog delete destroys data, so somebody is going to want to know who ran it.
+	 lots of processes can be writing at once (the command line, the background handlers) so we
+	 lock the file around each append. catalog history reads it back.
+	 the event log goes where the config file says, or next to the log file if it doesn't say. */
+
+const EVENT_CATALOG_ADD = "catalog add"
+const EVENT_CATALOG_DELETE = "catalog delete"
+const EVENT_CATALOG_SET = "catalog set"
+const EVENT_START = "start"
+const EVENT_STOP = "stop"
+const EVENT_DESTROY_DEVICE = "destroy device"
+const EVENT_DESTROY_ALL_DEVICES = "destroy all devices"
+const EVENT_MOUNT = "mount"
+const EVENT_UNMOUNT = "unmount"
+const EVENT_HANDLER_EXIT = "handler exit"
+const EVENT_CAPACITY = "capacity"
+const EVENT_RECONCILE = "reconcile"
+const EVENT_STORAGE_RESYNC = "storage resync"
+const EVENT_STORAGE_SCRUB = "storage scrub"
+
+const TXT_EVENT_RESULT_OK = "ok"
+const TXT_EVENT_LOG_SUFFIX = "-events.jsonl"
+
+type Event struct {
+	Time        string      `json:"time"`
+	Uid         int         `json:"uid"`
+	Pid         int         `json:"pid"`
+	Operation   string      `json:"operation"`
+	Device_name string      `json:"device_name,omitempty"`
+	Parameters  interface{} `json:"parameters,omitempty"`
+	Result      string      `json:"result"`
+}
+
+func (this *Lbd_lib) get_event_log_file() string {
+	if this.conf != nil && len(this.conf.Events.Event_log_file) > 0 {
+		return this.conf.Events.Event_log_file
+	}
+	if len(this.Log_file) == 0 {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(this.Log_file), this.application_name+TXT_EVENT_LOG_SUFFIX)
+}
+
+func (this *Lbd_lib) log_event(operation string, device_name string, parameters interface{}, result tools.Ret) {
+	/* if we can't write the event we say so, but we never fail the operation because of it. */
+	var event_log_file = this.get_event_log_file()
+	if len(event_log_file) == 0 {
+		return
+	}
+
+	var event Event
+	event.Time = time.Now().Format(time.RFC3339Nano)
+	event.Uid = os.Getuid()
+	event.Pid = os.Getpid()
+	event.Operation = operation
+	event.Device_name = device_name
+	event.Parameters = parameters
+	event.Result = TXT_EVENT_RESULT_OK
+	if result != nil {
+		event.Result = result.Get_errmsg()
+	}
+
+	var bytesout, err = json.Marshal(event)
+	if err != nil {
+		this.log.Error("unable to marshal event for: ", operation, " err: ", err)
+		return
+	}
+	bytesout = append(bytesout, '\n')
+
+	err = os.MkdirAll(filepath.Dir(event_log_file), LOG_DIR_PERMISSIONS)
+	if err != nil {
+		this.log.Error("unable to make directory for event log: ", event_log_file, " err: ", err)
+		return
+	}
+	fh, err := os.OpenFile(event_log_file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, LOG_FILE_PERMISSIONS)
+	if err != nil {
+		this.log.Error("unable to open event log: ", event_log_file, " err: ", err)
+		return
+	}
+	defer fh.Close()
+
+	err = syscall.Flock(int(fh.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		this.log.Error("unable to lock event log: ", event_log_file, " err: ", err)
+		return
+	}
+	defer syscall.Flock(int(fh.Fd()), syscall.LOCK_UN)
+
+	_, err = fh.Write(bytesout)
+	if err != nil {
+		this.log.Error("unable to write to event log: ", event_log_file, " err: ", err)
+	}
+}
+
+func (this *Lbd_lib) catalog_history(device_name string) tools.Ret {
+	/* read the event log back, all of it or just the events for one device. */
+	var event_log_file = this.get_event_log_file()
+	if len(event_log_file) == 0 {
+		return tools.Error(this.log, "no event log is configured")
+	}
+
+	var fh, err = os.Open(event_log_file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			fmt.Println("[]")
+			return nil
+		}
+		return tools.Error(this.log, "unable to open event log: ", event_log_file, " err: ", err)
+	}
+	defer fh.Close()
+
+	var events = make([]*Event, 0)
+	var lower_device_name = strings.ToLower(device_name)
+	var scanner = bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 64*1024), ONE_MEG)
+	var line_number = 0
+	for scanner.Scan() {
+		line_number++
+		var event Event
+		err = json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			this.log.Error("skipping unreadable event on line ", line_number, " of ", event_log_file)
+			continue
+		}
+		if len(device_name) > 0 && strings.ToLower(event.Device_name) != lower_device_name {
+			continue
+		}
+		events = append(events, &event)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return tools.Error(this.log, "error reading event log: ", event_log_file, " err: ", err)
+	}
+
+	bytesout, err := json.MarshalIndent(events, "", " ")
+	if err != nil {
+		return tools.Error(this.log, "unable to marshal events into json, err: ", err)
+	}
+	fmt.Println(string(bytesout))
+	return nil
+}
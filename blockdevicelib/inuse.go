@@ -0,0 +1,239 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/nixomose/nixomosegotools/tools"
+)
+
+/* two things writing to the same backing store is the end of both of them. so catalog add and
+   catalog start refuse a backing store if another catalog entry points at the same thing (after
+	 following symlinks), if it's a block device that's mounted (or has a partition that's mounted),
+	 or if it's one of our own devices. and the handler holds an exclusive flock on the store for as
+	 long as it's running, so two handlers can't serve the same store no matter how they got there. */
+
+const TXT_PROC_SELF_MOUNTINFO = "/proc/self/mountinfo"
+const TXT_SYS_DEV_BLOCK = "/sys/dev/block"
+const TXT_SYS_DEV = "dev"
+const TXT_SYS_PARTITION = "partition"
+
+func (this *Lbd_lib) resolve_storage_path(path string) string {
+	/* the store might not exist yet, so resolve what we can, the directory at least. */
+	var abs, err = filepath.Abs(path)
+	if err != nil {
+		abs = filepath.Clean(path)
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved
+	}
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(abs)); err == nil {
+		return filepath.Join(dir, filepath.Base(abs))
+	}
+	return abs
+}
+
+func (this *Lbd_lib) get_block_device_number(path string) (bool, string) {
+	/* if it's a block device, hand back its major:minor the way mountinfo and sysfs spell it. */
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return false, ""
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return false, ""
+	}
+	var rdev = uint64(st.Rdev)
+	var major = ((rdev >> 8) & 0xfff) | ((rdev >> 32) & 0xfffff000)
+	var minor = (rdev & 0xff) | ((rdev >> 12) & 0xffffff00)
+	return true, tools.Inttostring(int(major)) + ":" + tools.Inttostring(int(minor))
+}
+
+func (this *Lbd_lib) get_partition_device_numbers(device_number string) []string {
+	/* the device itself and any partitions on it, a mounted partition means the whole disk is in use. */
+	var numbers = []string{device_number}
+	var sysdir = filepath.Join(TXT_SYS_DEV_BLOCK, device_number)
+	var entries, err = os.ReadDir(sysdir)
+	if err != nil {
+		return numbers
+	}
+	for _, entry := range entries {
+		if _, err := os.Stat(filepath.Join(sysdir, entry.Name(), TXT_SYS_PARTITION)); err != nil {
+			continue
+		}
+		var dev, err = os.ReadFile(filepath.Join(sysdir, entry.Name(), TXT_SYS_DEV))
+		if err == nil {
+			numbers = append(numbers, strings.TrimSpace(string(dev)))
+		}
+	}
+	return numbers
+}
+
+func (this *Lbd_lib) get_mounted_device_numbers() map[string][]string {
+	/* major:minor to mountpoints for everything mounted. the third field of mountinfo is the device number,
+	   the fifth is the mountpoint. */
+	var mounted = make(map[string][]string)
+	var fh, err = os.Open(TXT_PROC_SELF_MOUNTINFO)
+	if err != nil {
+		return mounted
+	}
+	defer fh.Close()
+	var scanner = bufio.NewScanner(fh)
+	for scanner.Scan() {
+		var fields = strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mounted[fields[2]] = append(mounted[fields[2]], fields[4])
+	}
+	return mounted
+}
+
+func (this *Lbd_lib) check_storage_in_use(cat *Catalog, device *Lbd_device) tools.Ret {
+	/* cat has to have been read already. */
+	if device.stree_ramdisk || device.device_ramdisk {
+		return nil
+	}
+	var lower_device_name = strings.ToLower(device.Device_name)
+	for _, storage_file := range this.get_storage_and_mirror_files(device) {
+		var resolved = this.resolve_storage_path(storage_file)
+
+		for _, catentry := range cat.catalog_list.Device_list {
+			if strings.ToLower(catentry.Device_name) == lower_device_name {
+				continue
+			}
+			var other = this.New_block_device_from_catalog_entry(catentry)
+			for _, other_file := range this.get_storage_and_mirror_files(other) {
+				if this.resolve_storage_path(other_file) == resolved {
+					return tools.ErrorWithCode(this.log, int(syscall.EBUSY), "backing storage: ", storage_file,
+						" for device: ", device.Device_name, " is also the backing storage for device: ", catentry.Device_name)
+				}
+			}
+		}
+
+		var ret = this.check_block_device_in_use(cat, device, storage_file, resolved)
+		if ret != nil {
+			return ret
+		}
+	}
+	return nil
+}
+
+func (this *Lbd_lib) check_block_device_in_use(cat *Catalog, device *Lbd_device, storage_file string, resolved string) tools.Ret {
+	var is_block, device_number = this.get_block_device_number(resolved)
+	if is_block == false {
+		return nil
+	}
+
+	/* one of ours? the names in /dev are the catalog names, and anything the kernel module is running. */
+	if strings.HasPrefix(resolved, TXT_DEVICE_PATH_PREFIX) {
+		var name = strings.TrimPrefix(resolved, TXT_DEVICE_PATH_PREFIX)
+		var ret, map_of_devices = this.get_active_device_map()
+		if ret == nil {
+			if _, ours := map_of_devices[strings.ToLower(name)]; ours {
+				return tools.ErrorWithCode(this.log, int(syscall.EBUSY), "backing storage: ", storage_file,
+					" for device: ", device.Device_name, " is itself a ", this.application_name, " device")
+			}
+		}
+		if this.find_catalog_entry(cat, name) != nil {
+			return tools.ErrorWithCode(this.log, int(syscall.EBUSY), "backing storage: ", storage_file,
+				" for device: ", device.Device_name, " is catalog device: ", name)
+		}
+	}
+
+	var mounted = this.get_mounted_device_numbers()
+	for _, number := range this.get_partition_device_numbers(device_number) {
+		if mountpoints, ok := mounted[number]; ok {
+			return tools.ErrorWithCode(this.log, int(syscall.EBUSY), "backing storage: ", storage_file,
+				" for device: ", device.Device_name, " is mounted on: ", mountpoints[0])
+		}
+	}
+	return nil
+}
+
+func (this *Lbd_lib) lock_backing_store(device *Lbd_device) (tools.Ret, []*os.File) {
+	/* take an exclusive flock on every file in the store, the caller holds on to them until it's done,
+	   and closing them lets go. if somebody else has one, say so rather than waiting. */
+	var ret, locks, _ = this.lock_backing_files(device, false)
+	return ret, locks
+}
+
+func (this *Lbd_lib) create_and_lock_backing_store(device *Lbd_device) (tools.Ret, []*os.File, []string) {
+	/* same thing, but for somebody who's about to lay the store down, so the files that aren't there
+	   yet get made. it says which ones it made, so if the caller doesn't get that far, it can
+		 take them away again with remove_created_backing_files and leave things how it found them. */
+	return this.lock_backing_files(device, true)
+}
+
+func (this *Lbd_lib) lock_backing_files(device *Lbd_device, create bool) (tools.Ret, []*os.File, []string) {
+	var locks = make([]*os.File, 0)
+	var created = make([]string, 0)
+	if device.stree_ramdisk || device.device_ramdisk {
+		return nil, locks, created
+	}
+	for _, storage_file := range this.get_storage_and_mirror_files(device) {
+		var ret, fh, made = this.lock_backing_file(device, storage_file, create)
+		if made {
+			created = append(created, storage_file)
+		}
+		if ret != nil {
+			this.unlock_backing_store(locks)
+			this.remove_created_backing_files(created)
+			return ret, nil, nil
+		}
+		if fh != nil {
+			locks = append(locks, fh)
+		}
+	}
+	return nil, locks, created
+}
+
+func (this *Lbd_lib) lock_backing_file(device *Lbd_device, storage_file string, create bool) (tools.Ret, *os.File, bool) {
+	/* returns whether we made the file. */
+	var made = false
+	var fh, err = os.OpenFile(storage_file, os.O_RDONLY, CATALOG_FILE_PERMISSIONS)
+	if err != nil && os.IsNotExist(err) && create {
+		fh, err = os.OpenFile(storage_file, os.O_RDONLY|os.O_CREATE|os.O_EXCL, CATALOG_FILE_PERMISSIONS)
+		made = err == nil
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, false // nothing to lock, whoever goes to use it will complain
+		}
+		return tools.Error(this.log, "unable to open backing storage: ", storage_file, " to lock it, err: ", err), nil, false
+	}
+	err = syscall.Flock(int(fh.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		fh.Close()
+		if err == syscall.EWOULDBLOCK {
+			return tools.ErrorWithCode(this.log, int(syscall.EBUSY), "backing storage: ", storage_file,
+				" for device: ", device.Device_name, " is in use by another process"), nil, made
+		}
+		return tools.Error(this.log, "unable to lock backing storage: ", storage_file, " err: ", err), nil, made
+	}
+	return nil, fh, made
+}
+
+func (this *Lbd_lib) remove_created_backing_files(created []string) {
+	/* only ever files create_and_lock_backing_store made, so there was nothing there before we came along. */
+	for _, storage_file := range created {
+		var err = os.Remove(storage_file)
+		if err != nil && os.IsNotExist(err) == false {
+			this.log.Error("unable to remove backing storage: ", storage_file, " that we created, err: ", err)
+			continue
+		}
+		this.log.Info("removed backing storage: ", storage_file, " that we created")
+	}
+}
+
+func (this *Lbd_lib) unlock_backing_store(locks []*os.File) {
+	for _, fh := range locks {
+		syscall.Flock(int(fh.Fd()), syscall.LOCK_UN)
+		fh.Close()
+	}
+}
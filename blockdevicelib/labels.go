@@ -0,0 +1,171 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/nixomose/nixomosegotools/tools"
+)
+
+/* exclude from start all is an all or nothing grouping, so catalog entries can also have labels,
+   like env=prod or tier=scratch, and catalog list, start all and stop all can take a selector to only
+	 work on the ones that match. a selector is a comma separated list of requirements that all have
+	 to match:
+	   key=value or key==value   the label is there and has that value
+	   key!=value                the label isn't there or has some other value
+	   key                       the label is there, any value
+	   !key                      the label isn't there
+	 keys and values are case sensitive, device names are the only thing we're case insensitive about.
+	 an empty selector matches everything. */
+
+const SELECTOR_EQUALS = "="
+const SELECTOR_NOT_EQUALS = "!="
+const SELECTOR_EXISTS = "exists"
+const SELECTOR_NOT_EXISTS = "!"
+
+type selector_requirement struct {
+	key       string
+	operation string
+	value     string
+}
+
+type Selector struct {
+	requirements []*selector_requirement
+}
+
+func (this *Lbd_lib) parse_selector(selector string) (tools.Ret, *Selector) {
+	var ret Selector
+	ret.requirements = make([]*selector_requirement, 0)
+	if len(strings.TrimSpace(selector)) == 0 {
+		return nil, &ret
+	}
+	for _, part := range strings.Split(selector, ",") {
+		part = strings.TrimSpace(part)
+		var r selector_requirement
+		switch {
+		case strings.Contains(part, "!="):
+			var kv = strings.SplitN(part, "!=", 2)
+			r = selector_requirement{key: kv[0], operation: SELECTOR_NOT_EQUALS, value: kv[1]}
+		case strings.Contains(part, "=="):
+			var kv = strings.SplitN(part, "==", 2)
+			r = selector_requirement{key: kv[0], operation: SELECTOR_EQUALS, value: kv[1]}
+		case strings.Contains(part, "="):
+			var kv = strings.SplitN(part, "=", 2)
+			r = selector_requirement{key: kv[0], operation: SELECTOR_EQUALS, value: kv[1]}
+		case strings.HasPrefix(part, "!"):
+			r = selector_requirement{key: part[1:], operation: SELECTOR_NOT_EXISTS}
+		default:
+			r = selector_requirement{key: part, operation: SELECTOR_EXISTS}
+		}
+		r.key = strings.TrimSpace(r.key)
+		r.value = strings.TrimSpace(r.value)
+		if ret := this.validate_label_key(r.key); ret != nil {
+			return tools.Error(this.log, "bad selector: ", selector, ", ", ret.Get_errmsg()), nil
+		}
+		ret.requirements = append(ret.requirements, &r)
+	}
+	return nil, &ret
+}
+
+func (this *Selector) Matches(labels map[string]string) bool {
+	if this == nil {
+		return true
+	}
+	for _, r := range this.requirements {
+		var value, ok = labels[r.key]
+		switch r.operation {
+		case SELECTOR_EQUALS:
+			if ok == false || value != r.value {
+				return false
+			}
+		case SELECTOR_NOT_EQUALS:
+			if ok && value == r.value {
+				return false
+			}
+		case SELECTOR_EXISTS:
+			if ok == false {
+				return false
+			}
+		case SELECTOR_NOT_EXISTS:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (this *Selector) Is_empty() bool {
+	return this == nil || len(this.requirements) == 0
+}
+
+func (this *Lbd_lib) validate_label_key(key string) tools.Ret {
+	if len(key) == 0 {
+		return tools.Error(this.log, "label keys can not be empty")
+	}
+	if strings.ContainsAny(key, "=!, \t") {
+		return tools.Error(this.log, "label key: ", key, " can not contain =, !, commas or spaces")
+	}
+	return nil
+}
+
+func (this *Lbd_lib) validate_labels(labels map[string]string) tools.Ret {
+	for k, v := range labels {
+		if ret := this.validate_label_key(k); ret != nil {
+			return ret
+		}
+		if strings.ContainsAny(v, ", \t") {
+			return tools.Error(this.log, "label value: ", v, " for key: ", k, " can not contain commas or spaces")
+		}
+	}
+	return nil
+}
+
+func (this *Lbd_lib) set_catalog_entry_labels(cat *Catalog, device_name string, labels map[string]string,
+	remove []string) tools.Ret {
+	/* add or change the labels given, and take away the ones in remove. */
+	var ret = this.validate_labels(labels)
+	if ret != nil {
+		return ret
+	}
+
+	ret = this.catalog.Read_catalog(cat)
+	if ret != nil {
+		return ret
+	}
+
+	var catentry = this.find_catalog_entry(cat, device_name)
+	if catentry == nil {
+		return tools.Error(this.log, "device ", device_name, " not found")
+	}
+	if catentry.Labels == nil {
+		catentry.Labels = make(map[string]string)
+	}
+	for k, v := range labels {
+		catentry.Labels[k] = v
+	}
+	for _, k := range remove {
+		delete(catentry.Labels, k)
+	}
+	if len(catentry.Labels) == 0 {
+		catentry.Labels = nil
+	}
+	return cat.Write_catalog()
+}
+
+func (this *Lbd_lib) select_catalog_entries(cat *Catalog, selector *Selector) []*Catalog_entry {
+	/* the entries that match, sorted by name, from what's already been read. */
+	var collection = make([]*Catalog_entry, 0)
+	for _, catentry := range cat.catalog_list.Device_list {
+		if selector.Matches(catentry.Labels) {
+			collection = append(collection, catentry)
+		}
+	}
+	sort.Slice(collection, func(i, j int) bool {
+		return strings.ToLower(collection[i].Device_name) < strings.ToLower(collection[j].Device_name)
+	})
+	return collection
+}
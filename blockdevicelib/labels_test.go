@@ -0,0 +1,91 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"testing"
+)
+
+func TestParseSelectorErrors(t *testing.T) {
+	var lib = new_test_lbd_lib(t)
+	var cases = []struct {
+		selector string
+		err      string
+	}{
+		{"=prod", "label keys can not be empty"},
+		{"!=prod", "label keys can not be empty"},
+		{"==prod", "label keys can not be empty"},
+		{"!", "label keys can not be empty"},
+		{"env=prod,", "label keys can not be empty"},
+		{"env=prod,,tier=scratch", "label keys can not be empty"},
+		{",env=prod", "label keys can not be empty"},
+		{"!!env", "can not contain"},
+		{"!env=prod", "can not contain"},
+		{"my env=prod", "can not contain"},
+	}
+	for _, c := range cases {
+		t.Run(c.selector, func(t *testing.T) {
+			var ret, _ = lib.parse_selector(c.selector)
+			expect_error_containing(t, ret, c.err)
+		})
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	var lib = new_test_lbd_lib(t)
+	var prod = map[string]string{"env": "prod", "tier": "fast", "blank": ""}
+	var dev = map[string]string{"env": "dev"}
+	var none map[string]string
+
+	var cases = []struct {
+		selector string
+		prod     bool
+		dev      bool
+		none     bool
+	}{
+		{"", true, true, true},
+		{"   ", true, true, true},
+		{"env=prod", true, false, false},
+		{"env==prod", true, false, false},
+		{" env = prod ", true, false, false},
+		{"env!=prod", false, true, true},
+		{"tier!=slow", true, true, true},
+		{"env", true, true, false},
+		{"tier", true, false, false},
+		{"!tier", false, true, true},
+		{" ! tier ", false, true, true},
+		{"env,!tier", false, true, false},
+		{"env=prod,tier=fast", true, false, false},
+		{"env=prod, tier=slow", false, false, false},
+		{"env!=prod,env!=dev", false, false, true},
+		{"blank=", true, false, false},
+		{"blank", true, false, false},
+		{"env=PROD", false, false, false},
+		{"ENV=prod", false, false, false},
+	}
+	for _, c := range cases {
+		t.Run(c.selector, func(t *testing.T) {
+			var ret, selector = lib.parse_selector(c.selector)
+			if ret != nil {
+				t.Fatal(ret.Get_errmsg())
+			}
+			if got := selector.Matches(prod); got != c.prod {
+				t.Errorf("against %v expected %t, got %t", prod, c.prod, got)
+			}
+			if got := selector.Matches(dev); got != c.dev {
+				t.Errorf("against %v expected %t, got %t", dev, c.dev, got)
+			}
+			if got := selector.Matches(none); got != c.none {
+				t.Errorf("against no labels expected %t, got %t", c.none, got)
+			}
+		})
+	}
+}
+
+func TestSelectorNilMatchesEverything(t *testing.T) {
+	var selector *Selector
+	if selector.Matches(map[string]string{"env": "prod"}) == false || selector.Is_empty() == false {
+		t.Fatal("a nil selector should be empty and match everything")
+	}
+}
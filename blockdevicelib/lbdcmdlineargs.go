@@ -8,6 +8,7 @@ import (
 	"log"
 	"log/syslog"
 	"os"
+	"syscall"
 
 	"github.com/nixomose/nixomosegotools/tools"
 	"github.com/nixomose/zosbd2goclient/zosbd2cmdlib/zosbd2interfaces"
@@ -34,32 +35,51 @@ func (this *Lbd_lib) add_device_status(root_cmd *cobra.Command) {
 func (this *Lbd_lib) add_storage_status(root_cmd *cobra.Command) {
 	/* storage status */
 	var storage_file string
+	var device_name string
 	var cmd_storage_status = &cobra.Command{
 		Use:   CMD_STORAGE_STATUS,
 		Short: "display definition of backing storage",
-		Long:  `storage-status will display details of the layout of the backing storage.`,
-		Args:  cobra.MinimumNArgs(0),
+		Long: `storage-status will display details of the layout of the backing storage and how full it is,
+			either for a catalog entry or for a backing storage file or block device.`,
+		Args: cobra.MinimumNArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
-			// this is the device definition, it only needs to be started for create
-			var err error
-			storage_file, err = cmd.Flags().GetString(TXT_STORAGE_FILE)
-			if err != nil {
-				tools.Error(this.log, err)
+			if len(device_name) > 0 && len(storage_file) > 0 {
+				tools.Error(this.log, "you can only select one of device name and storage file")
 				os.Exit(1)
 				return
-			} else {
-				/* we just need enough default device settings so we can open the file and read the header
-				   directio on allows us to read a big enough chunk to get the header. */
-				var device = this.New_block_device("", 0, storage_file, true, false, PHYSICAL_BLOCK_SIZE, 0, 0, 0, false, "", false, false)
-				if ret := this.storage_status(device); ret != nil {
+			}
+			if len(device_name) == 0 && len(storage_file) == 0 {
+				tools.Error(this.log, "you must select one of device name and storage file")
+				os.Exit(1)
+				return
+			}
+
+			var device *Lbd_device
+			if len(device_name) > 0 {
+				/* the catalog knows the real geometry, so we get the right block size and can work
+				   out how much of the logical device the store can actually hold. */
+				var ret, catentry = this.get_catalog_entry(this.catalog, device_name)
+				if ret != nil {
+					if ret.Get_errcode() == int(syscall.ENOENT) {
+						tools.Error(this.log, "device: ", device_name, " not found")
+					}
 					os.Exit(1)
 					return
 				}
+				device = this.New_block_device_from_catalog_entry(catentry)
+			} else {
+				/* we just need enough default device settings so we can open the file and read the header
+				   directio on allows us to read a big enough chunk to get the header. */
+				device = this.New_block_device("", 0, storage_file, true, false, PHYSICAL_BLOCK_SIZE, 0, 0, 0, false, "", false, false)
+			}
+			if ret := this.storage_status(device); ret != nil {
+				os.Exit(1)
+				return
 			}
 		},
 	}
 	cmd_storage_status.Flags().StringVarP(&storage_file, TXT_STORAGE_FILE, "t", "", "path of file or block device for backing storage")
-	cmd_storage_status.MarkFlagRequired(TXT_STORAGE_FILE)
+	cmd_storage_status.Flags().StringVarP(&device_name, TXT_DEVICE_NAME, "d", "", "name of the block device in the catalog")
 	root_cmd.AddCommand(cmd_storage_status)
 }
 
@@ -87,7 +107,9 @@ func (this *Lbd_lib) add_destroy_block_device(root_cmd *cobra.Command) {
 				return
 			}
 			var device = this.New_block_device(device_name, 0, "", false, false, 1, 0, 0, 0, false, "", false, false)
-			if ret := this.destroy_block_device(device); ret != nil {
+			var ret = this.destroy_block_device(device)
+			this.log_event(EVENT_DESTROY_DEVICE, device_name, nil, ret)
+			if ret != nil {
 				os.Exit(1)
 				return
 			}
@@ -105,7 +127,9 @@ func (this *Lbd_lib) add_destroy_all_block_devices(root_cmd *cobra.Command) {
 		Long:  `this command will cause all existing block devices to cleanly hang up on the userspace applictions servicing those block devices.`,
 		Args:  cobra.MinimumNArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
-			if ret := this.destroy_all_block_devices(); ret != nil {
+			var ret = this.destroy_all_block_devices()
+			this.log_event(EVENT_DESTROY_ALL_DEVICES, "", nil, ret)
+			if ret != nil {
 				os.Exit(1)
 				return
 			}
@@ -114,6 +138,117 @@ func (this *Lbd_lib) add_destroy_all_block_devices(root_cmd *cobra.Command) {
 	root_cmd.AddCommand(cmd_destroy_all_block_devices)
 }
 
+/* configuration commands */
+
+func (this *Lbd_lib) add_config_commands(root_cmd *cobra.Command) {
+	var cmd_config = &cobra.Command{
+		Use:   CMD_CONFIG,
+		Short: "check or show the configuration",
+		Long:  `this command will let you check the config file for problems or show the configuration in effect.`,
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			tools.Error(this.log, "please specify a subcommand for config")
+			os.Exit(1)
+		}}
+
+	var cmd_config_check = &cobra.Command{
+		Use:   SUB_CMD_CONFIG_CHECK,
+		Short: "report unknown keys, parse errors and bad paths in the config file",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			if ret := this.config_check(); ret != nil {
+				os.Exit(1)
+				return
+			}
+		}}
+
+	var cmd_config_show = &cobra.Command{
+		Use:   SUB_CMD_CONFIG_SHOW,
+		Short: "show the configuration in effect after defaults, the config file and command line flags",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			if ret := this.config_show(); ret != nil {
+				os.Exit(1)
+				return
+			}
+		}}
+
+	cmd_config.AddCommand(cmd_config_check)
+	cmd_config.AddCommand(cmd_config_show)
+	root_cmd.AddCommand(cmd_config)
+}
+
+/* backing storage commands */
+
+func (this *Lbd_lib) add_storage_commands(root_cmd *cobra.Command) {
+	var cmd_storage = &cobra.Command{
+		Use:   CMD_STORAGE,
+		Short: "look after a device's backing storage",
+		Long:  `this command will let you maintain the backing storage of a device in the catalog.`,
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			tools.Error(this.log, "please specify a subcommand for storage")
+			os.Exit(1)
+		}}
+
+	root_cmd.AddCommand(cmd_storage)
+
+	this.add_storage_resync(cmd_storage)
+	this.add_storage_scrub(cmd_storage)
+}
+
+func (this *Lbd_lib) add_storage_resync(root_cmd *cobra.Command) {
+	var device_name string
+	var from_mirror bool
+	var force bool
+	var cmd_storage_resync = &cobra.Command{
+		Use:   SUB_CMD_STORAGE_RESYNC,
+		Short: "bring a device's mirror storage up to date by copying the backing storage over it",
+		Long: `this command will copy the backing storage of a device over its mirror storage file, or the other way
+			around with --from-mirror, after a disk has been replaced or the mirror fell behind. the device can not be running.`,
+		Args: cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			var ret = this.storage_resync(this.catalog, device_name, from_mirror, force)
+			this.log_event(EVENT_STORAGE_RESYNC, device_name, map[string]interface{}{TXT_FROM_MIRROR: from_mirror, TXT_FORCE: force}, ret)
+			if ret != nil {
+				os.Exit(1)
+				return
+			}
+		},
+	}
+	cmd_storage_resync.Flags().StringVarP(&device_name, TXT_DEVICE_NAME, "d", "", "name of the block device to resync")
+	cmd_storage_resync.Flags().BoolVarP(&from_mirror, TXT_FROM_MIRROR, "m", false, "copy the mirror over the backing storage instead")
+	cmd_storage_resync.Flags().BoolVarP(&force, TXT_FORCE, "f", false, "copy even if the source wasn't cleanly shut down or looks older than the target")
+	cmd_storage_resync.MarkFlagRequired(TXT_DEVICE_NAME)
+
+	root_cmd.AddCommand(cmd_storage_resync)
+}
+
+func (this *Lbd_lib) add_storage_scrub(root_cmd *cobra.Command) {
+	var device_name string
+	var force bool
+	var cmd_storage_scrub = &cobra.Command{
+		Use:   SUB_CMD_STORAGE_SCRUB,
+		Short: "read back every block in a device's backing storage and report the bad ones",
+		Long: `this command will read every live block in the backing storage of a device, check it against its
+			checksum if it has them, and fix it from the mirror if it has one. the device can not be running.`,
+		Args: cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			var ret = this.storage_scrub(this.catalog, device_name, force)
+			this.log_event(EVENT_STORAGE_SCRUB, device_name, map[string]interface{}{TXT_FORCE: force}, ret)
+			if ret != nil {
+				os.Exit(1)
+				return
+			}
+		},
+	}
+	cmd_storage_scrub.Flags().StringVarP(&device_name, TXT_DEVICE_NAME, "d", "", "name of the block device to scrub")
+	cmd_storage_scrub.Flags().BoolVarP(&force, TXT_FORCE, "f", false, "scrub even if the backing store was not cleanly shut down")
+	cmd_storage_scrub.MarkFlagRequired(TXT_DEVICE_NAME)
+
+	root_cmd.AddCommand(cmd_storage_scrub)
+}
+
 /* diagnostic commands */
 
 func (this *Lbd_lib) add_diag_commands(root_cmd *cobra.Command) {
@@ -242,6 +377,12 @@ func (this *Lbd_lib) add_catalog_commands(root_cmd *cobra.Command) {
 	this.add_catalog_list(cmd_catalog)
 	this.add_catalog_add(cmd_catalog)
 	this.add_catalog_delete(cmd_catalog)
+	this.add_catalog_status(cmd_catalog)
+	this.add_catalog_reconcile(cmd_catalog)
+	this.add_catalog_history(cmd_catalog)
+	this.add_catalog_export(cmd_catalog)
+	this.add_catalog_apply(cmd_catalog)
+	this.add_catalog_add_storage(cmd_catalog)
 
 	this.add_start_device_from_catalog(cmd_catalog)
 	this.add_stop_device_from_catalog(cmd_catalog) // clean shutdown (will try and unmount)
@@ -251,14 +392,25 @@ func (this *Lbd_lib) add_catalog_commands(root_cmd *cobra.Command) {
 
 func (this *Lbd_lib) add_catalog_list(root_cmd *cobra.Command) {
 	var device_name string
+	var selector_text string
 	var cmd_catalog_list = &cobra.Command{
 		Use:   SUB_CMD_CATALOG_LIST,
 		Short: "list one or all of the devices defined in the catalog",
 		Long:  `this command will list the specified or all of the existing block device definitions in the catalog.`,
 		Args:  cobra.MinimumNArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
+			if len(device_name) > 0 && len(selector_text) > 0 {
+				tools.Error(this.log, "you can only select one of device name and selector")
+				os.Exit(1)
+				return
+			}
+			var ret, selector = this.parse_selector(selector_text)
+			if ret != nil {
+				os.Exit(1)
+				return
+			}
 			if device_name == "" {
-				if ret := this.catalog_list_all(this.catalog); ret != nil {
+				if ret := this.catalog_list_all(this.catalog, selector); ret != nil {
 					os.Exit(1)
 					return
 				}
@@ -271,6 +423,7 @@ func (this *Lbd_lib) add_catalog_list(root_cmd *cobra.Command) {
 		},
 	}
 	cmd_catalog_list.Flags().StringVarP(&device_name, TXT_DEVICE_NAME, "d", "", "name of the block device to display")
+	cmd_catalog_list.Flags().StringVarP(&selector_text, TXT_SELECTOR, "S", "", "only list devices whose labels match, like env=prod,tier!=scratch")
 
 	root_cmd.AddCommand(cmd_catalog_list)
 }
@@ -294,6 +447,25 @@ func (this *Lbd_lib) add_catalog_add(root_cmd *cobra.Command) {
 	var additional_nodes_per_block uint32
 	var mount bool
 	var mountpoint string
+	var start_after []string
+	var priority int
+	var restart string
+	var restart_max_retries int
+	var restart_backoff int
+	var metrics_listen string
+	var capacity_soft int
+	var capacity_hard int
+	var capacity_hook string
+	var profile string
+	var labels map[string]string
+	var allocation string
+	var storage_layout string
+	var additional_storage_files []string
+	var mirror_storage_file string
+	var checksums bool
+	var scrub_rate int
+	var encryption_keyfile string
+	var encryption_passphrase_env string
 
 	var cmd_catalog_add = &cobra.Command{
 		Use:   SUB_CMD_CATALOG_ADD,
@@ -307,7 +479,35 @@ func (this *Lbd_lib) add_catalog_add(root_cmd *cobra.Command) {
 			var device = this.New_block_device(device_name, device_size, storage_file, directio, sync,
 				alignment, stree_value_size, calculated_stree_node_size, additional_nodes_per_block,
 				mount, mountpoint, false, false)
-			if ret := this.catalog_add(this.catalog, device); ret != nil {
+			device.Start_after = start_after
+			device.Priority = priority
+			device.Restart = restart
+			device.Restart_max_retries = restart_max_retries
+			device.Restart_backoff_seconds = restart_backoff
+			device.Metrics_listen = metrics_listen
+			device.Capacity_soft_percent = capacity_soft
+			device.Capacity_hard_percent = capacity_hard
+			device.Capacity_hook = capacity_hook
+			device.Allocation = allocation
+			device.Storage_layout = storage_layout
+			device.Additional_storage_files = additional_storage_files
+			device.Mirror_storage_file = mirror_storage_file
+			device.Checksums = checksums
+			device.Scrub_rate = scrub_rate
+			device.Encryption_keyfile = encryption_keyfile
+			device.Encryption_passphrase_env = encryption_passphrase_env
+			if len(labels) > 0 {
+				device.Labels = labels
+			}
+			if len(profile) > 0 {
+				if ret := this.apply_profile(device, profile, cmd.Flags()); ret != nil {
+					os.Exit(1)
+					return
+				}
+			}
+			var ret = this.catalog_add(this.catalog, device)
+			this.log_event(EVENT_CATALOG_ADD, device_name, New_catalog_entry_from_device(device), ret)
+			if ret != nil {
 				os.Exit(1)
 				return
 			}
@@ -323,6 +523,25 @@ func (this *Lbd_lib) add_catalog_add(root_cmd *cobra.Command) {
 	cmd_catalog_add.Flags().Uint32VarP(&additional_nodes_per_block, TXT_ADDITIONAL_NODES_PER_BLOCK, "p", 0, "how many additional nodes to add per block to make a single tree block")
 	cmd_catalog_add.Flags().BoolVarP(&mount, TXT_MOUNT, "m", false, "try and mount filesystem after creating block device")
 	cmd_catalog_add.Flags().StringVarP(&mountpoint, TXT_MOUNTPOINT, "r", "", "where to mount filesystem after creating block device") // required by user
+	cmd_catalog_add.Flags().StringSliceVarP(&start_after, TXT_START_AFTER, "w", nil, "names of devices that must be started before this one on start all")
+	cmd_catalog_add.Flags().IntVarP(&priority, TXT_PRIORITY, "o", 0, "devices that can start at the same time start lowest priority first")
+	cmd_catalog_add.Flags().StringVarP(&restart, TXT_RESTART, "R", RESTART_NEVER, "restart the block device handler if it fails: "+RESTART_NEVER+", "+RESTART_ON_FAILURE+" or "+RESTART_ALWAYS)
+	cmd_catalog_add.Flags().IntVarP(&restart_max_retries, TXT_RESTART_MAX_RETRIES, "x", DEFAULT_RESTART_MAX_RETRIES, "with "+RESTART_ON_FAILURE+", how many times in a row to restart before giving up")
+	cmd_catalog_add.Flags().IntVarP(&restart_backoff, TXT_RESTART_BACKOFF, "b", DEFAULT_RESTART_BACKOFF_SECONDS, "seconds to wait before the first restart, doubles with each restart after that")
+	cmd_catalog_add.Flags().StringVarP(&metrics_listen, TXT_METRICS_LISTEN, "q", "", "serve metrics while the device is running on host:port or unix:/path")
+	cmd_catalog_add.Flags().IntVarP(&capacity_soft, TXT_CAPACITY_SOFT_PERCENT, "k", 0, "warn when the backing store is this percent full, 0 is off")
+	cmd_catalog_add.Flags().IntVarP(&capacity_hard, TXT_CAPACITY_HARD_PERCENT, "K", 0, "make the device read only when the backing store is this percent full, 0 is off")
+	cmd_catalog_add.Flags().StringVarP(&capacity_hook, TXT_CAPACITY_HOOK, "g", "", "command to run with device name, level and percent when a capacity watermark is crossed")
+	cmd_catalog_add.Flags().StringVarP(&profile, TXT_PROFILE, "u", "", "fill in any settings not given on the command line from this profile in the config file")
+	cmd_catalog_add.Flags().StringToStringVarP(&labels, TXT_LABEL, "L", nil, "key=value labels for picking this device out with a selector")
+	cmd_catalog_add.Flags().StringVarP(&storage_layout, TXT_STORAGE_LAYOUT, "Y", "", "spread the backing storage over more than one file: "+STORAGE_LAYOUT_CONCAT+" or "+STORAGE_LAYOUT_STRIPE)
+	cmd_catalog_add.Flags().StringSliceVarP(&additional_storage_files, TXT_ADDITIONAL_STORAGE_FILE, "T", nil, "more files or block devices for backing storage, in order, after the storage file")
+	cmd_catalog_add.Flags().StringVarP(&mirror_storage_file, TXT_MIRROR_STORAGE_FILE, "M", "", "file or block device on another disk to keep a second copy of the backing storage on")
+	cmd_catalog_add.Flags().BoolVarP(&checksums, TXT_CHECKSUMS, "C", false, "keep a checksum with every block in the backing store and check it on every read, can't be changed later")
+	cmd_catalog_add.Flags().IntVarP(&scrub_rate, TXT_SCRUB_RATE, "z", 0, "blocks per second to check in the background while the device is running, 0 is off")
+	cmd_catalog_add.Flags().StringVarP(&encryption_keyfile, TXT_ENCRYPTION_KEYFILE, "E", "", "encrypt every block in the backing store with a key made from this file, can't be changed later")
+	cmd_catalog_add.Flags().StringVarP(&encryption_passphrase_env, TXT_ENCRYPTION_PASSPHRASE_ENV, "P", "", "encrypt every block in the backing store with a key made from the passphrase in this environment variable, can't be changed later")
+	cmd_catalog_add.Flags().StringVarP(&allocation, TXT_ALLOCATION, "A", "", "lay out a file backing store up front: "+ALLOCATION_PREALLOCATE+" to fallocate it or "+ALLOCATION_SPARSE+" to make it a sparse file")
 
 	cmd_catalog_add.MarkFlagRequired(TXT_DEVICE_NAME)
 	cmd_catalog_add.MarkFlagRequired(TXT_STORAGE_FILE)
@@ -331,6 +550,146 @@ func (this *Lbd_lib) add_catalog_add(root_cmd *cobra.Command) {
 	root_cmd.AddCommand(cmd_catalog_add)
 }
 
+func (this *Lbd_lib) add_catalog_add_storage(root_cmd *cobra.Command) {
+	var device_name string
+	var storage_file string
+	var cmd_catalog_add_storage = &cobra.Command{
+		Use:   SUB_CMD_CATALOG_ADD_STORAGE,
+		Short: "grow a device by adding a file or block device to the end of its backing storage",
+		Long: `this command will add another backing storage file to a device with a concat storage layout and make
+			its blocks available to the device. the device can not be running.`,
+		Args: cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			var ret = this.catalog_add_storage(this.catalog, device_name, storage_file)
+			this.log_event(EVENT_CATALOG_SET, device_name, map[string]interface{}{TXT_ADDITIONAL_STORAGE_FILE: storage_file}, ret)
+			if ret != nil {
+				os.Exit(1)
+				return
+			}
+		},
+	}
+	cmd_catalog_add_storage.Flags().StringVarP(&device_name, TXT_DEVICE_NAME, "d", "", "name of the block device to grow")
+	cmd_catalog_add_storage.Flags().StringVarP(&storage_file, TXT_STORAGE_FILE, "t", "", "path of file or block device to add to the backing storage")
+	cmd_catalog_add_storage.MarkFlagRequired(TXT_DEVICE_NAME)
+	cmd_catalog_add_storage.MarkFlagRequired(TXT_STORAGE_FILE)
+
+	root_cmd.AddCommand(cmd_catalog_add_storage)
+}
+
+func (this *Lbd_lib) add_catalog_status(root_cmd *cobra.Command) {
+	var device_name string
+	var cmd_catalog_status = &cobra.Command{
+		Use:   SUB_CMD_CATALOG_STATUS,
+		Short: "show the catalog, kernel and backing store state of one or all devices",
+		Long: `this command will show for each device whether it is defined in the catalog, running, or running
+			without a catalog entry (orphaned), along with the handler pid, mount state and backing store state.`,
+		Args: cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			if ret := this.catalog_status(this.catalog, device_name); ret != nil {
+				os.Exit(1)
+				return
+			}
+		},
+	}
+	cmd_catalog_status.Flags().StringVarP(&device_name, TXT_DEVICE_NAME, "d", "", "name of the block device to show, all if not specified")
+
+	root_cmd.AddCommand(cmd_catalog_status)
+}
+
+func (this *Lbd_lib) add_catalog_reconcile(root_cmd *cobra.Command) {
+	var apply bool
+	var destroy_unserved bool
+	var cmd_catalog_reconcile = &cobra.Command{
+		Use:   SUB_CMD_CATALOG_RECONCILE,
+		Short: "list where the catalog and the running kernel devices disagree, and optionally fix it",
+		Long: `this command will list kernel devices that aren't in the catalog or that nobody is serving, and catalog
+			entries whose backing storage is missing. with apply it will unmount and destroy the kernel devices that
+			aren't in the catalog and mark those catalog entries broken so they are not started. catalog devices that
+			nobody is serving are only destroyed if destroy unserved is given as well.`,
+		Args: cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			if ret := this.catalog_reconcile(this.catalog, apply, destroy_unserved); ret != nil {
+				os.Exit(1)
+				return
+			}
+		},
+	}
+	cmd_catalog_reconcile.Flags().BoolVarP(&apply, TXT_APPLY, "y", false, "destroy orphaned kernel devices and mark broken catalog entries")
+	cmd_catalog_reconcile.Flags().BoolVarP(&destroy_unserved, TXT_DESTROY_UNSERVED, "U", false, "with apply, also destroy catalog devices nobody is serving")
+
+	root_cmd.AddCommand(cmd_catalog_reconcile)
+}
+
+func (this *Lbd_lib) add_catalog_history(root_cmd *cobra.Command) {
+	var device_name string
+	var cmd_catalog_history = &cobra.Command{
+		Use:   SUB_CMD_CATALOG_HISTORY,
+		Short: "show the event log of changes made to one or all devices",
+		Long:  `this command will show who added, deleted, changed, started, stopped, mounted or destroyed what and when.`,
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			if ret := this.catalog_history(device_name); ret != nil {
+				os.Exit(1)
+				return
+			}
+		},
+	}
+	cmd_catalog_history.Flags().StringVarP(&device_name, TXT_DEVICE_NAME, "d", "", "name of the block device to show history for, all if not specified")
+
+	root_cmd.AddCommand(cmd_catalog_history)
+}
+
+func (this *Lbd_lib) add_catalog_export(root_cmd *cobra.Command) {
+	var format string
+	var device_name string
+	var cmd_catalog_export = &cobra.Command{
+		Use:   SUB_CMD_CATALOG_EXPORT,
+		Short: "write out the catalog, or one device, in json or toml for catalog apply",
+		Long:  `this command will print the catalog entries in a form catalog apply can read back in on another machine.`,
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			if ret := this.catalog_export(this.catalog, format, device_name); ret != nil {
+				os.Exit(1)
+				return
+			}
+		},
+	}
+	cmd_catalog_export.Flags().StringVarP(&format, TXT_FORMAT, "m", FORMAT_JSON, "output format, json or toml")
+	cmd_catalog_export.Flags().StringVarP(&device_name, TXT_DEVICE_NAME, "d", "", "name of the block device to export, all if not specified")
+
+	root_cmd.AddCommand(cmd_catalog_export)
+}
+
+func (this *Lbd_lib) add_catalog_apply(root_cmd *cobra.Command) {
+	var filename string
+	var prune bool
+	var dry_run bool
+	var cmd_catalog_apply = &cobra.Command{
+		Use:   SUB_CMD_CATALOG_APPLY,
+		Short: "make the catalog match a file from catalog export",
+		Long: `this command will add any device in the file that isn't in the catalog, initializing its backing store
+			like catalog add does, and report any device whose settings differ from the file. devices in the catalog
+			that aren't in the file are only deleted, along with their data, if you specify prune.`,
+		Args: cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(filename) == 0 {
+				tools.Error(this.log, "you must specify a file to apply")
+				os.Exit(1)
+				return
+			}
+			if ret := this.catalog_apply(this.catalog, filename, prune, dry_run); ret != nil {
+				os.Exit(1)
+				return
+			}
+		},
+	}
+	cmd_catalog_apply.Flags().StringVarP(&filename, TXT_FILE, "f", "", "json or toml file of catalog entries")
+	cmd_catalog_apply.Flags().BoolVarP(&prune, TXT_PRUNE, "", false, "delete catalog entries and their data that are not in the file")
+	cmd_catalog_apply.Flags().BoolVarP(&dry_run, TXT_DRY_RUN, "n", false, "only report what would be done")
+
+	root_cmd.AddCommand(cmd_catalog_apply)
+}
+
 func (this *Lbd_lib) add_catalog_delete(root_cmd *cobra.Command) {
 	var device_name string
 	var i, am, sure bool
@@ -340,7 +699,9 @@ func (this *Lbd_lib) add_catalog_delete(root_cmd *cobra.Command) {
 		Long:  `this command will permanently destroy all data associated with the specified block device and remove it from the catalog.`,
 		Args:  cobra.MinimumNArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
-			if ret := this.catalog_delete(this.catalog, device_name); ret != nil {
+			var ret = this.catalog_delete(this.catalog, device_name)
+			this.log_event(EVENT_CATALOG_DELETE, device_name, nil, ret)
+			if ret != nil {
 				os.Exit(1)
 				return
 			}
@@ -382,7 +743,7 @@ func (this *Lbd_lib) process_pipeline_command_line_params(data_pipeline *list.Li
 			}
 		}
 	}
-	return nil
+	return this.encryption.Process_parameters(cmd)
 }
 
 func (this *Lbd_lib) add_start_device_from_catalog(root_cmd *cobra.Command) {
@@ -392,6 +753,9 @@ func (this *Lbd_lib) add_start_device_from_catalog(root_cmd *cobra.Command) {
 	var device_ramdisk bool
 	var stree_ramdisk bool
 	var dragons bool
+	var foreground bool
+	var parallel int
+	var selector_text string
 
 	var cmd_catalog_start_device = &cobra.Command{
 		Use:   SUB_CMD_CATALOG_START,
@@ -415,9 +779,23 @@ func (this *Lbd_lib) add_start_device_from_catalog(root_cmd *cobra.Command) {
 				os.Exit(1)
 				return
 			}
+			if foreground && (all || dragons) {
+				tools.Error(this.log, "you can only run a single device by name in the foreground")
+				os.Exit(1)
+				return
+			}
+			if len(selector_text) > 0 && all == false {
+				tools.Error(this.log, "a selector can only be used with all")
+				os.Exit(1)
+				return
+			}
+			var ret, selector = this.parse_selector(selector_text)
+			if ret != nil {
+				os.Exit(1)
+				return
+			}
 
 			/* give each item in the pipeline the opportunity to pick up it's command line params */
-			var ret tools.Ret
 			ret = this.process_pipeline_command_line_params(this.data_pipeline, cmd)
 			if ret != nil {
 				os.Exit(1)
@@ -425,14 +803,15 @@ func (this *Lbd_lib) add_start_device_from_catalog(root_cmd *cobra.Command) {
 			}
 
 			if dragons {
-				// send all stdout to syslog if we're going to be running in the background
-				this.dragons_to_syslog(device_name)
+				// send all logging to the device log or syslog if we're going to be running in the background
+				this.dragons_to_log(device_name)
 			}
 
 			if all {
-				ret = this.catalog_start_all(this.catalog, force, this.data_pipeline)
+				ret = this.catalog_start_all(this.catalog, force, this.data_pipeline, parallel, selector)
 			} else {
-				ret = this.catalog_start_device(this.catalog, device_name, force, this.data_pipeline, device_ramdisk, stree_ramdisk, dragons)
+				ret = this.catalog_start_device(this.catalog, device_name, force, this.data_pipeline, device_ramdisk, stree_ramdisk,
+					dragons, foreground)
 			}
 			if ret != nil {
 				os.Exit(1)
@@ -446,6 +825,9 @@ func (this *Lbd_lib) add_start_device_from_catalog(root_cmd *cobra.Command) {
 	cmd_catalog_start_device.Flags().BoolVarP(&device_ramdisk, TXT_DEVICE_RAMDISK, "y", false, "for testing, use a ramdisk to back the block device")
 	cmd_catalog_start_device.Flags().BoolVarP(&stree_ramdisk, TXT_STREE_RAMDISK, "j", false, "for testing, use a ramdisk to back the stree")
 	cmd_catalog_start_device.Flags().BoolVarP(&dragons, TXT_DRAGONS, "H", false, "here be dragons")
+	cmd_catalog_start_device.Flags().BoolVarP(&foreground, TXT_FOREGROUND, "F", false, "validate and run the block device handler in this process instead of in the background")
+	cmd_catalog_start_device.Flags().IntVarP(&parallel, TXT_PARALLEL, "P", DEFAULT_START_PARALLEL, "with all, how many devices to start at the same time")
+	cmd_catalog_start_device.Flags().StringVarP(&selector_text, TXT_SELECTOR, "S", "", "with all, only start devices whose labels match, like env=prod,tier!=scratch")
 
 	// cmd_catalog_start_device.MarkFlagRequired(TXT_DEVICE_NAME)
 
@@ -457,6 +839,8 @@ func (this *Lbd_lib) add_stop_device_from_catalog(root_cmd *cobra.Command) {
 
 	var device_name string
 	var all bool
+	var parallel int
+	var selector_text string
 	var cmd_catalog_stop_device = &cobra.Command{
 		Use:   SUB_CMD_CATALOG_STOP,
 		Short: "cleanly shutdown a currently running block device specified by the device name",
@@ -474,9 +858,18 @@ func (this *Lbd_lib) add_stop_device_from_catalog(root_cmd *cobra.Command) {
 				os.Exit(1)
 				return
 			}
-			var ret tools.Ret
+			if len(selector_text) > 0 && all == false {
+				tools.Error(this.log, "a selector can only be used with all")
+				os.Exit(1)
+				return
+			}
+			var ret, selector = this.parse_selector(selector_text)
+			if ret != nil {
+				os.Exit(1)
+				return
+			}
 			if all {
-				ret = this.catalog_shutdown_all(this.catalog)
+				ret = this.catalog_shutdown_all(this.catalog, parallel, selector)
 			} else {
 				ret = this.catalog_shutdown_device(this.catalog, device_name)
 			}
@@ -488,6 +881,8 @@ func (this *Lbd_lib) add_stop_device_from_catalog(root_cmd *cobra.Command) {
 	}
 	cmd_catalog_stop_device.Flags().StringVarP(&device_name, TXT_DEVICE_NAME, "d", "", "name of the block device in the catalog to create")
 	cmd_catalog_stop_device.Flags().BoolVarP(&all, TXT_ALL, "a", false, "stop all devices in catalog")
+	cmd_catalog_stop_device.Flags().IntVarP(&parallel, TXT_PARALLEL, "P", DEFAULT_START_PARALLEL, "with all, how many devices to stop at the same time")
+	cmd_catalog_stop_device.Flags().StringVarP(&selector_text, TXT_SELECTOR, "S", "", "with all, only stop devices whose labels match, like env=prod,tier!=scratch")
 
 	root_cmd.AddCommand(cmd_catalog_stop_device)
 }
@@ -508,6 +903,12 @@ func (this *Lbd_lib) add_catalog_set_commands(cmd_catalog *cobra.Command) {
 	cmd_catalog.AddCommand(cmd_catalog_set)
 
 	this.add_set_catalog_include_exclude(cmd_catalog_set)
+	this.add_set_catalog_start_order(cmd_catalog_set)
+	this.add_set_catalog_restart(cmd_catalog_set)
+	this.add_set_catalog_metrics(cmd_catalog_set)
+	this.add_set_catalog_capacity(cmd_catalog_set)
+	this.add_set_catalog_labels(cmd_catalog_set)
+	this.add_set_catalog_scrub(cmd_catalog_set)
 }
 
 func (this *Lbd_lib) add_set_catalog_include_exclude(cmd_catalog_set *cobra.Command) {
@@ -518,7 +919,9 @@ func (this *Lbd_lib) add_set_catalog_include_exclude(cmd_catalog_set *cobra.Comm
 		Short: "set a catalog entry to include on start all",
 		Args:  cobra.MinimumNArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
-			if ret := this.set_catalog_entry_exclude_device(this.catalog, device_name, false); ret != nil {
+			var ret = this.set_catalog_entry_exclude_device(this.catalog, device_name, false)
+			this.log_event(EVENT_CATALOG_SET, device_name, map[string]interface{}{CMD_INCLUDE: true}, ret)
+			if ret != nil {
 				os.Exit(1)
 				return
 			}
@@ -531,7 +934,9 @@ func (this *Lbd_lib) add_set_catalog_include_exclude(cmd_catalog_set *cobra.Comm
 		Short: "set a catalog entry to exclude on start all",
 		Args:  cobra.MinimumNArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
-			if ret := this.set_catalog_entry_exclude_device(this.catalog, device_name, true); ret != nil {
+			var ret = this.set_catalog_entry_exclude_device(this.catalog, device_name, true)
+			this.log_event(EVENT_CATALOG_SET, device_name, map[string]interface{}{CMD_EXCLUDE: true}, ret)
+			if ret != nil {
 				os.Exit(1)
 				return
 			}
@@ -543,6 +948,159 @@ func (this *Lbd_lib) add_set_catalog_include_exclude(cmd_catalog_set *cobra.Comm
 	cmd_catalog_set.AddCommand(cmd_catalog_set_exclude)
 }
 
+func (this *Lbd_lib) add_set_catalog_start_order(cmd_catalog_set *cobra.Command) {
+
+	var device_name string
+	var start_after []string
+	var priority int
+	var cmd_catalog_set_start_order = &cobra.Command{
+		Use:   CMD_START_ORDER,
+		Short: "set which devices a catalog entry starts after and its priority on start all",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			var ret = this.set_catalog_entry_start_order(this.catalog, device_name, start_after, priority)
+			this.log_event(EVENT_CATALOG_SET, device_name, map[string]interface{}{TXT_START_AFTER: start_after, TXT_PRIORITY: priority}, ret)
+			if ret != nil {
+				os.Exit(1)
+				return
+			}
+		}}
+	cmd_catalog_set_start_order.Flags().StringVarP(&device_name, TXT_DEVICE_NAME, "d", "", "name of the block device to set start order on")
+	cmd_catalog_set_start_order.Flags().StringSliceVarP(&start_after, TXT_START_AFTER, "w", nil, "names of devices that must be started before this one, empty to clear")
+	cmd_catalog_set_start_order.Flags().IntVarP(&priority, TXT_PRIORITY, "o", 0, "devices that can start at the same time start lowest priority first")
+	cmd_catalog_set_start_order.MarkFlagRequired(TXT_DEVICE_NAME)
+
+	cmd_catalog_set.AddCommand(cmd_catalog_set_start_order)
+}
+
+func (this *Lbd_lib) add_set_catalog_restart(cmd_catalog_set *cobra.Command) {
+
+	var device_name string
+	var restart string
+	var restart_max_retries int
+	var restart_backoff int
+	var cmd_catalog_set_restart = &cobra.Command{
+		Use:   CMD_RESTART,
+		Short: "set what to do when the block device handler for a catalog entry fails",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			var ret = this.set_catalog_entry_restart(this.catalog, device_name, restart, restart_max_retries, restart_backoff)
+			this.log_event(EVENT_CATALOG_SET, device_name, map[string]interface{}{TXT_RESTART: restart,
+				TXT_RESTART_MAX_RETRIES: restart_max_retries, TXT_RESTART_BACKOFF: restart_backoff}, ret)
+			if ret != nil {
+				os.Exit(1)
+				return
+			}
+		}}
+	cmd_catalog_set_restart.Flags().StringVarP(&device_name, TXT_DEVICE_NAME, "d", "", "name of the block device to set the restart policy on")
+	cmd_catalog_set_restart.Flags().StringVarP(&restart, TXT_RESTART, "R", RESTART_NEVER, RESTART_NEVER+", "+RESTART_ON_FAILURE+" or "+RESTART_ALWAYS)
+	cmd_catalog_set_restart.Flags().IntVarP(&restart_max_retries, TXT_RESTART_MAX_RETRIES, "x", DEFAULT_RESTART_MAX_RETRIES, "with "+RESTART_ON_FAILURE+", how many times in a row to restart before giving up")
+	cmd_catalog_set_restart.Flags().IntVarP(&restart_backoff, TXT_RESTART_BACKOFF, "b", DEFAULT_RESTART_BACKOFF_SECONDS, "seconds to wait before the first restart, doubles with each restart after that")
+	cmd_catalog_set_restart.MarkFlagRequired(TXT_DEVICE_NAME)
+	cmd_catalog_set_restart.MarkFlagRequired(TXT_RESTART)
+
+	cmd_catalog_set.AddCommand(cmd_catalog_set_restart)
+}
+
+func (this *Lbd_lib) add_set_catalog_metrics(cmd_catalog_set *cobra.Command) {
+
+	var device_name string
+	var metrics_listen string
+	var cmd_catalog_set_metrics = &cobra.Command{
+		Use:   CMD_METRICS,
+		Short: "set where the block device handler for a catalog entry serves metrics",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			var ret = this.set_catalog_entry_metrics(this.catalog, device_name, metrics_listen)
+			this.log_event(EVENT_CATALOG_SET, device_name, map[string]interface{}{TXT_METRICS_LISTEN: metrics_listen}, ret)
+			if ret != nil {
+				os.Exit(1)
+				return
+			}
+		}}
+	cmd_catalog_set_metrics.Flags().StringVarP(&device_name, TXT_DEVICE_NAME, "d", "", "name of the block device to set the metrics address on")
+	cmd_catalog_set_metrics.Flags().StringVarP(&metrics_listen, TXT_METRICS_LISTEN, "q", "", "host:port or unix:/path, empty to turn it off")
+	cmd_catalog_set_metrics.MarkFlagRequired(TXT_DEVICE_NAME)
+
+	cmd_catalog_set.AddCommand(cmd_catalog_set_metrics)
+}
+
+func (this *Lbd_lib) add_set_catalog_capacity(cmd_catalog_set *cobra.Command) {
+
+	var device_name string
+	var capacity_soft int
+	var capacity_hard int
+	var capacity_hook string
+	var cmd_catalog_set_capacity = &cobra.Command{
+		Use:   CMD_CAPACITY,
+		Short: "set the backing store capacity watermarks and hook for a catalog entry",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			var ret = this.set_catalog_entry_capacity(this.catalog, device_name, capacity_soft, capacity_hard, capacity_hook)
+			this.log_event(EVENT_CATALOG_SET, device_name, map[string]interface{}{TXT_CAPACITY_SOFT_PERCENT: capacity_soft,
+				TXT_CAPACITY_HARD_PERCENT: capacity_hard, TXT_CAPACITY_HOOK: capacity_hook}, ret)
+			if ret != nil {
+				os.Exit(1)
+				return
+			}
+		}}
+	cmd_catalog_set_capacity.Flags().StringVarP(&device_name, TXT_DEVICE_NAME, "d", "", "name of the block device to set the capacity watermarks on")
+	cmd_catalog_set_capacity.Flags().IntVarP(&capacity_soft, TXT_CAPACITY_SOFT_PERCENT, "k", 0, "warn when the backing store is this percent full, 0 is off")
+	cmd_catalog_set_capacity.Flags().IntVarP(&capacity_hard, TXT_CAPACITY_HARD_PERCENT, "K", 0, "make the device read only when the backing store is this percent full, 0 is off")
+	cmd_catalog_set_capacity.Flags().StringVarP(&capacity_hook, TXT_CAPACITY_HOOK, "g", "", "command to run with device name, level and percent when a capacity watermark is crossed")
+	cmd_catalog_set_capacity.MarkFlagRequired(TXT_DEVICE_NAME)
+
+	cmd_catalog_set.AddCommand(cmd_catalog_set_capacity)
+}
+
+func (this *Lbd_lib) add_set_catalog_scrub(cmd_catalog_set *cobra.Command) {
+
+	var device_name string
+	var scrub_rate int
+	var cmd_catalog_set_scrub = &cobra.Command{
+		Use:   CMD_SCRUB,
+		Short: "set how fast a catalog entry's backing store is scrubbed in the background while it runs",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			var ret = this.set_catalog_entry_scrub(this.catalog, device_name, scrub_rate)
+			this.log_event(EVENT_CATALOG_SET, device_name, map[string]interface{}{TXT_SCRUB_RATE: scrub_rate}, ret)
+			if ret != nil {
+				os.Exit(1)
+				return
+			}
+		}}
+	cmd_catalog_set_scrub.Flags().StringVarP(&device_name, TXT_DEVICE_NAME, "d", "", "name of the block device to set the scrub rate on")
+	cmd_catalog_set_scrub.Flags().IntVarP(&scrub_rate, TXT_SCRUB_RATE, "z", 0, "blocks per second, 0 is off")
+	cmd_catalog_set_scrub.MarkFlagRequired(TXT_DEVICE_NAME)
+
+	cmd_catalog_set.AddCommand(cmd_catalog_set_scrub)
+}
+
+func (this *Lbd_lib) add_set_catalog_labels(cmd_catalog_set *cobra.Command) {
+
+	var device_name string
+	var labels map[string]string
+	var remove []string
+	var cmd_catalog_set_labels = &cobra.Command{
+		Use:   CMD_LABELS,
+		Short: "add, change or remove labels on a catalog entry",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			var ret = this.set_catalog_entry_labels(this.catalog, device_name, labels, remove)
+			this.log_event(EVENT_CATALOG_SET, device_name, map[string]interface{}{TXT_LABEL: labels, TXT_REMOVE_LABEL: remove}, ret)
+			if ret != nil {
+				os.Exit(1)
+				return
+			}
+		}}
+	cmd_catalog_set_labels.Flags().StringVarP(&device_name, TXT_DEVICE_NAME, "d", "", "name of the block device to set labels on")
+	cmd_catalog_set_labels.Flags().StringToStringVarP(&labels, TXT_LABEL, "L", nil, "key=value labels to add or change")
+	cmd_catalog_set_labels.Flags().StringSliceVarP(&remove, TXT_REMOVE_LABEL, "X", nil, "keys of labels to remove")
+	cmd_catalog_set_labels.MarkFlagRequired(TXT_DEVICE_NAME)
+
+	cmd_catalog_set.AddCommand(cmd_catalog_set_labels)
+}
+
 // func (this *Lbd_lib) add_catalog_set_commands(cmd_catalog *cobra.Command) {
 // 	var device_name string
 // 	var include bool
@@ -581,6 +1139,12 @@ func (this *Lbd_lib) cobra_commands_setup(root_cmd *cobra.Command) tools.Ret {
 	/* catalog */
 	this.add_catalog_commands(root_cmd)
 
+	/* backing storage */
+	this.add_storage_commands(root_cmd)
+
+	/* configuration */
+	this.add_config_commands(root_cmd)
+
 	/* diagnostics */
 
 	this.add_diag_commands(root_cmd)
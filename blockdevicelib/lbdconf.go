@@ -7,14 +7,28 @@ type Lbd_config struct {
 	Log     logfields
 	Zosbd2  zosbd2fields
 	Catalog catalogfields
+	Metrics metricsfields
+	Events  eventsfields
+
+	Profiles map[string]*Profile // named sets of catalog add settings, see profile.go
 }
 type logfields struct {
-	Log_file  string
-	Log_level int
+	Log_file        string
+	Log_level       int
+	Log_max_size_mb int    // rotate the log file when it gets this big, 0 means never
+	Log_max_files   int    // how many rotated log files to keep
+	Device_log_dir  string // if set, background device handlers log to their own file in here instead of syslog
 }
 type catalogfields struct {
 	Catalog_file string
+	Catalog_dir  string // optional, one toml file per device, merged with the catalog file
 }
 type zosbd2fields struct {
 	Control_device string
 }
+type metricsfields struct {
+	Socket_dir string // if set, every device handler serves metrics on a unix socket in here
+}
+type eventsfields struct {
+	Event_log_file string // where to append the json lines event log, defaults to next to the log file
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"sync"
 	"syscall"
 
 	"github.com/nixomose/nixomosegotools/tools"
@@ -48,6 +49,18 @@ const CMD_DESTROY_ALL_BLOCK_DEVICES = "destroy-all-devices"
 
 const CMD_CATALOG_LIST = "catalog-list"
 
+/* configuration and subcommands */
+
+const CMD_CONFIG = "config"
+const SUB_CMD_CONFIG_CHECK = "check"
+const SUB_CMD_CONFIG_SHOW = "show"
+
+/* backing storage and subcommands */
+
+const CMD_STORAGE = "storage"
+const SUB_CMD_STORAGE_RESYNC = "resync"
+const SUB_CMD_STORAGE_SCRUB = "scrub"
+
 /* diagnostics and subcommands */
 
 const CMD_DIAG = "diag"
@@ -62,6 +75,12 @@ const CMD_CATALOG = "catalog"
 const SUB_CMD_CATALOG_LIST = "list"
 const SUB_CMD_CATALOG_ADD = "add"
 const SUB_CMD_CATALOG_DELETE = "delete"
+const SUB_CMD_CATALOG_STATUS = "status"
+const SUB_CMD_CATALOG_RECONCILE = "reconcile"
+const SUB_CMD_CATALOG_HISTORY = "history"
+const SUB_CMD_CATALOG_EXPORT = "export"
+const SUB_CMD_CATALOG_APPLY = "apply"
+const SUB_CMD_CATALOG_ADD_STORAGE = "add-storage"
 
 /* block device catalog commands. */
 
@@ -74,9 +93,19 @@ const CMD_SET = "set"
 const CMD_CATALOG_ENTRY = "catalog-entry"
 const CMD_EXCLUDE = "exclude"
 const CMD_INCLUDE = "include"
+const CMD_START_ORDER = "start-order"
+const CMD_RESTART = "restart"
+const CMD_METRICS = "metrics"
+const CMD_CAPACITY = "capacity"
+const CMD_LABELS = "labels"
+const CMD_SCRUB = "scrub"
 
 // command line flags
 
+const TXT_CONFIG_FILE = "config-file"
+const TXT_LOG_FILE = "log-file"
+const TXT_LOG_LEVEL = "log-level"
+
 const TXT_DEVICE_NAME = "device-name"
 const TXT_DEVICE_SIZE = "device-size"
 const TXT_STORAGE_FILE = "storage-file"
@@ -98,6 +127,46 @@ const TXT_DEVICE_RAMDISK = "device-ramdisk"
 const TXT_STREE_RAMDISK = "stree-ramdisk"
 
 const TXT_DRAGONS = "here-be-dragons"
+const TXT_FOREGROUND = "foreground"
+
+const TXT_PARALLEL = "parallel"
+const TXT_START_AFTER = "start-after"
+const TXT_PRIORITY = "priority"
+
+const TXT_RESTART = "restart"
+const TXT_RESTART_MAX_RETRIES = "restart-max-retries"
+const TXT_RESTART_BACKOFF = "restart-backoff"
+
+const TXT_METRICS_LISTEN = "metrics-listen"
+
+const TXT_APPLY = "apply"
+const TXT_DESTROY_UNSERVED = "destroy-unserved"
+
+const TXT_FORMAT = "format"
+const TXT_FILE = "file"
+const TXT_PRUNE = "prune"
+const TXT_DRY_RUN = "dry-run"
+
+const TXT_CAPACITY_SOFT_PERCENT = "capacity-soft"
+const TXT_CAPACITY_HARD_PERCENT = "capacity-hard"
+const TXT_CAPACITY_HOOK = "capacity-hook"
+
+const TXT_PROFILE = "profile"
+
+const TXT_ALLOCATION = "allocation"
+
+const TXT_STORAGE_LAYOUT = "storage-layout"
+const TXT_ADDITIONAL_STORAGE_FILE = "additional-storage-file"
+const TXT_MIRROR_STORAGE_FILE = "mirror-storage-file"
+const TXT_FROM_MIRROR = "from-mirror"
+const TXT_CHECKSUMS = "checksums"
+const TXT_SCRUB_RATE = "scrub-rate"
+const TXT_ENCRYPTION_KEYFILE = "encryption-keyfile"
+const TXT_ENCRYPTION_PASSPHRASE_ENV = "encryption-passphrase-env"
+
+const TXT_LABEL = "label"
+const TXT_REMOVE_LABEL = "remove-label"
+const TXT_SELECTOR = "selector"
 
 const TXT_I = "I"
 const TXT_AM = "Am"
@@ -115,6 +184,11 @@ type Lbd_lib struct {
 
 	conf *Lbd_config
 
+	root_cmd        *cobra.Command // so we can tell which flags were actually given
+	log_writer      *Log_writer    // nil if we're just logging to stderr
+	log_writer_lock sync.Mutex     // the SIGHUP handler looks at log_writer while we might be swapping it
+	log_reopen_once sync.Once
+
 	default_config_file  string
 	default_log_file     string
 	default_catalog_file string
@@ -126,6 +200,11 @@ type Lbd_lib struct {
 	catalog        *Catalog // the current in memory catalog.
 
 	data_pipeline *list.List
+	encryption    *encryption_pipeline_element // built in, goes around the data pipeline of encrypted devices
+	/* start all validates devices in parallel, and they all share the one pipeline, which
+	   gets set up for whichever device went last. so only one device at a time gets to have
+		 it set up for it, from process_pipeline_init_last_chance to the end of validation. */
+	pipeline_lock sync.Mutex
 }
 
 type Lbd_device struct { // implements zosbd2interfaces.Device_interface
@@ -147,17 +226,60 @@ type Lbd_device struct { // implements zosbd2interfaces.Device_interface
 
 	Exclude_from_start_all bool // by default we start all devices for start --all unless this is set.
 
+	Start_after []string // catalog entries that have to be up before this one on start --all
+	Priority    int      // lower starts first among devices that can start at the same time
+
+	Restart                 string // never, on-failure or always, what to do when the block device handler fails
+	Restart_max_retries     int    // on-failure gives up after this many restarts in a row
+	Restart_backoff_seconds int    // how long to wait before the first restart, doubles each time after that
+
+	Metrics_listen string // host:port or unix:/path to serve metrics on while the handler runs
+
+	Capacity_soft_percent int    // complain when the backing store is this full, 0 is off
+	Capacity_hard_percent int    // go read only when the backing store is this full, 0 is off
+	Capacity_hook         string // run this with device name, level and percent when we cross a watermark
+
+	Profile string // the config file profile this device's settings came from, if any
+
+	Allocation string // preallocate or sparse to lay out a file backing store up front, empty lets it grow
+
+	Storage_layout           string   // concat or stripe to spread the store over more than one file, empty is just the local storage file
+	Additional_storage_files []string // the files after the local storage file, in order
+	Mirror_storage_file      string   // a second copy of the whole store, empty is no mirror
+
+	Checksums  bool // a checksum on every block in the backing store, only set at catalog add
+	Scrub_rate int  // blocks per second the handler checks in the background, 0 is off
+
+	Encryption_keyfile        string // encrypt every block with a key made from this file, only set at catalog add
+	Encryption_passphrase_env string // or from the passphrase in this environment variable
+	Encryption_salt           string // hex, made at catalog add
+	Encryption_key_check      string // hex, made at catalog add, so we can tell if we've got the wrong key
+
+	Labels map[string]string // key=value labels for picking out groups of devices with a selector
+
 	// the objects that operate on this device, we need to keep the stree_v for shutdown
-	stree   *stree_v_lib.Stree_v // we have to save this so we can shut it down cleanly on exit
-	storage zosbd2interfaces.Storage_mechanism
+	stree         *stree_v_lib.Stree_v // we have to save this so we can shut it down cleanly on exit
+	storage       zosbd2interfaces.Storage_mechanism
+	backing_store Lbd_file_store // what the stree is sitting on, so the scrubber can go around it
+
+	checksum_errors uint64 // atomic, bumped by the checksummed stores of this device
+
+	encryption_lock sync.Mutex
+	encryption_key  []byte // worked out the first time the device is started
 
 	// for testing.
 	device_ramdisk bool // replace the stree with a ramdisk
 	stree_ramdisk  bool // replace the disk backing storage with a ramdisk
+
+	stop_requested int32 // set when we've been signalled to shut down, so we don't restart.
 }
 
 func (this *Lbd_device) Get_node_size_in_bytes() uint32 {
 	var max_node_size_in_byte = this.Stree_value_size * (this.Additional_nodes_per_block + 1)
+	if this.is_encrypted() {
+		/* the encryption pipeline element needs room for its nonce and tag, everybody else gets what's left. */
+		max_node_size_in_byte -= ENCRYPTION_OVERHEAD
+	}
 	return max_node_size_in_byte // this is the max amount of user data we store in a stree tree node
 	// it will/can span the mother node and the offspring in its offspring list.
 }
@@ -174,6 +296,7 @@ func New_blockdevicelib(application_name string) (tools.Ret, *Lbd_lib) {
 	retlib.control_device = ""
 	retlib.catalog = nil // this gets set after log init
 	retlib.data_pipeline = nil
+	retlib.encryption = new_encryption_pipeline_element(&retlib)
 
 	return nil, &retlib
 }
@@ -191,11 +314,21 @@ func (this *Lbd_lib) Get_config_file() string {
 }
 
 func (this *Lbd_lib) parse_config_file() {
-	_, err := toml.DecodeFile(this.Config_file, &this.conf)
+	var conf Lbd_config
+	conf.Log.Log_max_size_mb = DEFAULT_LOG_MAX_SIZE_MB
+	conf.Log.Log_max_files = DEFAULT_LOG_MAX_FILES
+	this.conf = &conf
+
+	md, err := toml.DecodeFile(this.Config_file, this.conf)
 	if err != nil {
-		this.log.Error("Unable to parse config file: ", this.Config_file, ", err: ", err)
-		return
+		/* a half decoded config is worse than none, start over with the defaults. config check will say what's wrong. */
+		this.log.Error("Unable to parse config file: ", this.Config_file, ", err: ", err, ", using defaults")
+		conf = Lbd_config{}
+		conf.Log.Log_max_size_mb = DEFAULT_LOG_MAX_SIZE_MB
+		conf.Log.Log_max_files = DEFAULT_LOG_MAX_FILES
+		md = toml.MetaData{}
 	}
+	this.apply_env_to_config(&conf)
 
 	this.control_device = this.conf.Zosbd2.Control_device
 	if len(this.control_device) == 0 {
@@ -206,9 +339,28 @@ func (this *Lbd_lib) parse_config_file() {
 	if len(this.catalog_file) == 0 {
 		this.catalog_file = this.default_catalog_file
 	}
+
+	/* command line flags win over the config file, the config file wins over the defaults. */
+	if this.flag_changed(TXT_LOG_FILE) == false && len(this.conf.Log.Log_file) > 0 {
+		this.Log_file = this.conf.Log.Log_file
+	}
+	if this.flag_changed(TXT_LOG_LEVEL) == false && md.IsDefined("Log", "Log_level") {
+		this.Log_level = uint32(this.conf.Log.Log_level)
+		this.log.Set_level(int(this.Log_level))
+	}
+}
+
+func (this *Lbd_lib) flag_changed(flag_name string) bool {
+	if this.root_cmd == nil {
+		return false
+	}
+	var flag = this.root_cmd.PersistentFlags().Lookup(flag_name)
+	return flag != nil && flag.Changed
 }
 
 func (this *Lbd_lib) init_config_and_log() {
+	var env_problems = this.apply_env_to_flags()
+
 	if this.Config_file != "" {
 		// Use config file from the flag.
 	} else {
@@ -222,9 +374,18 @@ func (this *Lbd_lib) init_config_and_log() {
 	}
 
 	this.log = tools.New_Nixomosetools_logger(int(this.Log_level))
+	for _, problem := range env_problems {
+		this.log.Error(problem)
+	}
 	this.parse_config_file()
 
-	this.catalog = New_catalog(this.log, this.catalog_file)
+	/* whoever's running this at the terminal still gets to see errors as they happen. */
+	var ret = this.set_log_output(this.Log_file, true)
+	if ret != nil {
+		this.log.Error("logging to stderr only.")
+	}
+
+	this.catalog = New_catalog(this.log, this.catalog_file, this.conf.Catalog.Catalog_dir)
 
 }
 
@@ -251,9 +412,10 @@ func (this *Lbd_lib) Startup(default_config_file string, default_log_file string
 	this.default_log_file = default_log_file
 	this.default_catalog_file = default_catalog_file
 
-	root_cmd.PersistentFlags().StringVarP(&this.Config_file, "config-file", "c", this.default_config_file, "configuration file")
-	root_cmd.PersistentFlags().StringVarP(&this.Log_file, "log-file", "l", this.default_log_file, "log file")
-	root_cmd.PersistentFlags().Uint32VarP(&this.Log_level, "log-level", "v", 200, "log level: 0=debug 200=info 500=error")
+	this.root_cmd = root_cmd
+	root_cmd.PersistentFlags().StringVarP(&this.Config_file, TXT_CONFIG_FILE, "c", this.default_config_file, "configuration file")
+	root_cmd.PersistentFlags().StringVarP(&this.Log_file, TXT_LOG_FILE, "l", this.default_log_file, "log file, overrides the config file")
+	root_cmd.PersistentFlags().Uint32VarP(&this.Log_level, TXT_LOG_LEVEL, "v", 200, "log level: 0=debug 200=info 500=error, overrides the config file")
 
 	if ret := this.cobra_commands_setup(root_cmd); ret != nil {
 		return ret, nil
@@ -298,6 +460,31 @@ func (this *Lbd_lib) New_block_device_from_catalog_entry(catentry *Catalog_entry
 	device.Mount = catentry.Mount
 	device.Mountpoint = catentry.Mountpoint
 
+	device.Start_after = catentry.Start_after
+	device.Priority = catentry.Priority
+
+	device.Restart = catentry.Restart
+	device.Restart_max_retries = catentry.Restart_max_retries
+	device.Restart_backoff_seconds = catentry.Restart_backoff_seconds
+
+	device.Metrics_listen = catentry.Metrics_listen
+
+	device.Capacity_soft_percent = catentry.Capacity_soft_percent
+	device.Capacity_hard_percent = catentry.Capacity_hard_percent
+	device.Capacity_hook = catentry.Capacity_hook
+	device.Profile = catentry.Profile
+	device.Labels = catentry.Labels
+	device.Allocation = catentry.Allocation
+	device.Storage_layout = catentry.Storage_layout
+	device.Additional_storage_files = catentry.Additional_storage_files
+	device.Mirror_storage_file = catentry.Mirror_storage_file
+	device.Checksums = catentry.Checksums
+	device.Scrub_rate = catentry.Scrub_rate
+	device.Encryption_keyfile = catentry.Encryption_keyfile
+	device.Encryption_passphrase_env = catentry.Encryption_passphrase_env
+	device.Encryption_salt = catentry.Encryption_salt
+	device.Encryption_key_check = catentry.Encryption_key_check
+
 	/* for testing */
 	device.device_ramdisk = false
 	device.stree_ramdisk = false
@@ -366,7 +553,7 @@ func (this *Lbd_lib) device_shutdown(device *Lbd_device) tools.Ret {
 	return nil
 }
 
-func (this *Lbd_lib) make_file_store_aligned(device *Lbd_device, stree_block_size uint32) (tools.Ret, *stree_v_lib.File_store_aligned) {
+func (this *Lbd_lib) get_store_alignment(device *Lbd_device, stree_block_size uint32) (tools.Ret, uint32) {
 
 	var alignment = device.Alignment // PHYSICAL_BLOCK_SIZE // 4k will use 8k per block because of our stree block header pushes the whole node size to a bit over 4k
 
@@ -379,7 +566,7 @@ func (this *Lbd_lib) make_file_store_aligned(device *Lbd_device, stree_block_siz
 
 		if alignment%PHYSICAL_BLOCK_SIZE != 0 {
 			return tools.Error(this.log, "your alignment must fall on a ", PHYSICAL_BLOCK_SIZE, " boundary if directio is on. ",
-				"alignment: ", alignment, " % ", PHYSICAL_BLOCK_SIZE, " is ", alignment%PHYSICAL_BLOCK_SIZE), nil
+				"alignment: ", alignment, " % ", PHYSICAL_BLOCK_SIZE, " is ", alignment%PHYSICAL_BLOCK_SIZE), 0
 		}
 	} else {
 		if alignment == 0 {
@@ -387,24 +574,106 @@ func (this *Lbd_lib) make_file_store_aligned(device *Lbd_device, stree_block_siz
 			device.Alignment = alignment // same thing here, if they didn't specify alignment, we tell the device what it should be
 		}
 	}
+	return nil, alignment
+}
 
-	/* first we have to see if we're doing directio or default io path so we can inject that into the
-	   filestore aligned object */
-	var iopath stree_v_lib.File_store_io_path
+func (this *Lbd_lib) get_file_store_io_path(device *Lbd_device) stree_v_lib.File_store_io_path {
 	if device.Directio {
-		iopath = stree_v_lib.New_file_store_io_path_directio()
-	} else {
-		iopath = stree_v_lib.New_file_store_io_path_default()
+		return stree_v_lib.New_file_store_io_path_directio()
+	}
+	return stree_v_lib.New_file_store_io_path_default()
+}
+
+func (this *Lbd_lib) make_file_store_aligned(device *Lbd_device, store_block_size uint32) (tools.Ret, *stree_v_lib.File_store_aligned) {
+	return this.make_file_store_aligned_at(device, device.Local_storage_file, store_block_size)
+}
+
+func (this *Lbd_lib) make_file_store_aligned_at(device *Lbd_device, storage_file string,
+	store_block_size uint32) (tools.Ret, *stree_v_lib.File_store_aligned) {
+
+	var ret, alignment = this.get_store_alignment(device, store_block_size)
+	if ret != nil {
+		return ret, nil
 	}
 
+	/* first we have to see if we're doing directio or default io path so we can inject that into the
+	   filestore aligned object */
+	var iopath = this.get_file_store_io_path(device)
+
 	/* so the backing physical store for the stree is the block device or file passed... */
 	var fstore *stree_v_lib.File_store_aligned = stree_v_lib.New_File_store_aligned(this.log,
-		device.Local_storage_file, uint32(stree_block_size), uint32(alignment),
+		storage_file, uint32(store_block_size), uint32(alignment),
 		device.Additional_nodes_per_block, iopath)
 
 	return nil, fstore
 }
 
+func (this *Lbd_lib) make_multi_file_store(device *Lbd_device, store_block_size uint32) (tools.Ret, *Multi_file_store) {
+	var ret, alignment = this.get_store_alignment(device, store_block_size)
+	if ret != nil {
+		return ret, nil
+	}
+	var mstore = New_multi_file_store(this.log, device.Storage_layout, this.get_storage_files(device),
+		store_block_size, alignment, device.Additional_nodes_per_block, device.Sync,
+		this.get_file_store_io_path(device), this.get_backing_store_size)
+	return nil, mstore
+}
+
+func (this *Lbd_lib) make_primary_store(device *Lbd_device, stree_block_size uint32) (tools.Ret, Lbd_file_store) {
+	/* one file, or a storage layout over several, with checksums on top if the device has them. */
+	var store_block_size = this.get_store_block_size(device, stree_block_size)
+	var ret tools.Ret
+	var fstore Lbd_file_store
+	if len(device.Storage_layout) > 0 {
+		ret, fstore = this.make_multi_file_store(device, store_block_size)
+	} else {
+		ret, fstore = this.make_file_store_aligned(device, store_block_size)
+	}
+	if ret != nil {
+		return ret, nil
+	}
+	return nil, this.wrap_checksums(device, fstore, device.Local_storage_file, stree_block_size)
+}
+
+func (this *Lbd_lib) make_mirror_store(device *Lbd_device, stree_block_size uint32) (tools.Ret, Lbd_file_store) {
+	var ret, fstore = this.make_file_store_aligned_at(device, device.Mirror_storage_file, this.get_store_block_size(device, stree_block_size))
+	if ret != nil {
+		return ret, nil
+	}
+	return nil, this.wrap_checksums(device, fstore, device.Mirror_storage_file, stree_block_size)
+}
+
+func (this *Lbd_lib) make_backing_store(device *Lbd_device, stree_block_size uint32) (tools.Ret, Lbd_file_store) {
+	/* the primary store, with the mirror alongside it if there is one. */
+	var ret, primary = this.make_primary_store(device, stree_block_size)
+	if ret != nil || len(device.Mirror_storage_file) == 0 {
+		return ret, primary
+	}
+	var mirror Lbd_file_store
+	ret, mirror = this.make_mirror_store(device, stree_block_size)
+	if ret != nil {
+		return ret, nil
+	}
+	var get_state = func() (tools.Ret, string) {
+		return this.get_mirror_state(device, stree_block_size)
+	}
+	return nil, New_mirrored_store(this.log, primary, device.Local_storage_file, mirror, device.Mirror_storage_file, get_state)
+}
+
+func (this *Lbd_lib) get_storage_files(device *Lbd_device) []string {
+	var files = []string{device.Local_storage_file}
+	return append(files, device.Additional_storage_files...)
+}
+
+func (this *Lbd_lib) get_storage_and_mirror_files(device *Lbd_device) []string {
+	/* everything the device writes to, for the in use checks and the locks. */
+	var files = this.get_storage_files(device)
+	if len(device.Mirror_storage_file) > 0 {
+		files = append(files, device.Mirror_storage_file)
+	}
+	return files
+}
+
 func (this *Lbd_lib) get_init_size_values(device *Lbd_device) (key_length uint32, value_length_out uint32,
 	additional_nodes_per_block_out uint32, key_type_out string, value_type_out []byte) {
 
@@ -465,12 +734,13 @@ func (this *Lbd_lib) Make_stree(device *Lbd_device) (tools.Ret, *stree_v_lib.Str
 		mstore.Init()
 		store = mstore
 	} else {
-		var fstore *stree_v_lib.File_store_aligned
-		ret, fstore = this.make_file_store_aligned(device, stree_calculated_node_size)
+		var fstore Lbd_file_store
+		ret, fstore = this.make_backing_store(device, stree_calculated_node_size)
 		if ret != nil {
 			return ret, nil
 		}
 		store = fstore
+		device.backing_store = fstore
 	}
 	var s *stree_v_lib.Stree_v = stree_v_lib.New_Stree_v(this.log, store, key_length, value_length,
 		additional_nodes_per_block, stree_calculated_node_size, "", []byte(""))
@@ -526,7 +796,11 @@ func (this *Lbd_lib) make_local_storage(device *Lbd_device, force bool, data_pip
 			return ret, nil, nil
 		}
 		/* now that we have an stree_v, we pass that to the zosbd2_backing_store */
+		if device.is_encrypted() {
+			data_pipeline = this.encryption.Add_to_pipeline(data_pipeline)
+		}
 		z = zosbd2_stree_v_storage_mechanism.New_zosbd2_storage_mechanism(this.log, stree, data_pipeline)
+		z = this.wrap_encryption_room(device, z)
 	}
 
 	return nil, stree, z
@@ -649,16 +923,18 @@ func (this *Lbd_lib) destroy_block_device(device *Lbd_device) tools.Ret {
 }
 
 func (this *Lbd_lib) storage_status(device *Lbd_device) tools.Ret {
-	/* get the json blob from storage, and print it out */
-	var key_length, value_length, additional_nodes_per_block, key_type, value_type = this.get_init_size_values(&Lbd_device{})
+	/* get the json blob from storage, and print it out along with what we can work out from it about
+	   how full it is. if the device came from the catalog, we use its real geometry, if all we have is
+		 a path, we only know what's in the header. */
+	var key_length, value_length, additional_nodes_per_block, key_type, value_type = this.get_init_size_values(device)
 
 	var ret, block_size = stree_v_lib.Calculate_block_size(this.log, key_type, value_type, key_length, value_length, additional_nodes_per_block)
 	if ret != nil {
 		return ret
 	}
 
-	var fstore *stree_v_lib.File_store_aligned
-	ret, fstore = this.make_file_store_aligned(device, block_size)
+	var fstore Lbd_file_store
+	ret, fstore = this.make_backing_store(device, block_size)
 	if ret != nil {
 		return ret
 	}
@@ -685,12 +961,84 @@ func (this *Lbd_lib) storage_status(device *Lbd_device) tools.Ret {
 	// fmt.Println(string(bytesout))
 	// return nil
 
-	var json string
-	ret, json = fstore.Get_store_information()
+	var info_json string
+	ret, info_json = fstore.Get_store_information()
 	if ret != nil {
 		return ret
 	}
-	fmt.Println(json)
+	var m map[string]string
+	var err = json.Unmarshal([]byte(info_json), &m)
+	if err != nil {
+		return tools.Error(this.log, "unable to parse backing store information, err: ", err)
+	}
+
+	/* 10/18/2026 the free position is the high water mark, the stree never hands out anything past it,
+	   so that's as good as used for thin provisioning purposes. block zero is the header. */
+	var total_blocks, used_blocks uint32
+	ret, total_blocks = fstore.Get_total_blocks()
+	if ret != nil {
+		return ret
+	}
+	ret, used_blocks = fstore.Get_free_position()
+	if ret != nil {
+		return ret
+	}
+	var free_blocks uint32 = 0
+	if total_blocks > used_blocks {
+		free_blocks = total_blocks - used_blocks
+	}
+	m["blocks_used"] = tools.Prettylargenumber_uint64(uint64(used_blocks))
+	m["blocks_free"] = tools.Prettylargenumber_uint64(uint64(free_blocks))
+	if total_blocks > 0 {
+		m["percent_full"] = fmt.Sprintf("%.2f", float64(used_blocks)*100/float64(total_blocks))
+	}
+
+	var physical_size uint64
+	ret, physical_size = fstore.Get_usable_storage_bytes(device.Local_storage_file)
+	if ret == nil {
+		m["physical_store_size_in_bytes"] = tools.Prettylargenumber_uint64(physical_size)
+	}
+
+	/* for files, how big they say they are and how much of them is really on disk. */
+	if is_file, apparent, allocated := this.get_backing_store_allocation(this.get_storage_files(device)); is_file {
+		m["apparent_size_in_bytes"] = tools.Prettylargenumber_uint64(apparent)
+		m["allocated_size_in_bytes"] = tools.Prettylargenumber_uint64(allocated)
+		if len(device.Allocation) > 0 {
+			m["allocation"] = device.Allocation
+		}
+	}
+
+	if device.Checksums {
+		m["checksums"] = "crc32c"
+	}
+	if device.is_encrypted() {
+		m["encryption"] = ENCRYPTION_CIPHER
+	}
+
+	if len(device.Mirror_storage_file) > 0 {
+		var state string
+		ret, state = this.get_mirror_state(device, block_size)
+		if ret != nil {
+			return ret
+		}
+		m["mirror_storage_file"] = device.Mirror_storage_file
+		m["mirror"] = state
+	}
+
+	if device.Size > 0 && device.Stree_value_size > 0 && total_blocks > 1 {
+		/* every block holds one node's worth of user data, so that's what the store can actually hold,
+		   before the kompressor gets its hands on it. more than 1 means we've promised more than we have. */
+		var data_capacity = uint64(total_blocks-1) * uint64(device.Stree_value_size)
+		m["logical_device_size_in_bytes"] = tools.Prettylargenumber_uint64(device.Size)
+		m["physical_data_capacity_in_bytes"] = tools.Prettylargenumber_uint64(data_capacity)
+		m["overcommit_ratio"] = fmt.Sprintf("%.2f", float64(device.Size)/float64(data_capacity))
+	}
+
+	bytesout, err := json.MarshalIndent(m, "", " ")
+	if err != nil {
+		return tools.Error(this.log, "unable to marshal backing store information into json")
+	}
+	fmt.Println(string(bytesout))
 	return nil
 }
 
@@ -711,10 +1059,12 @@ func (this *Lbd_lib) process_pipeline_init_last_chance(data_pipeline *list.List,
 			}
 		}
 	}
-	return nil
+	/* and the one that comes with the library, which only does anything if the device is encrypted. */
+	return this.encryption.Process_device(device)
 }
 
-func (this *Lbd_lib) run_block_device(device *Lbd_device, force bool, data_pipeline *list.List, dragons bool) tools.Ret {
+func (this *Lbd_lib) run_block_device(device *Lbd_device, force bool, data_pipeline *list.List, dragons bool,
+	foreground bool) tools.Ret {
 
 	/* 1/22/2022 I would like to detach this from the terminal since it blocks, except in go, you can't.
 	   threads make it impossible to fork, so you have to forkexec which means starting-anew
@@ -729,11 +1079,54 @@ func (this *Lbd_lib) run_block_device(device *Lbd_device, force bool, data_pipel
 		 child process, which is hacky, or a command line param which is visible to the user.
 		 I think I'll go with command line parameter and scare them away with dragons. */
 
-	if dragons == false {
+	if dragons {
+		// we are the child, validation has already been done by our parent, go serve the device.
+		return this.serve_block_device(device, force, data_pipeline)
+	}
+
+	var ret = this.start_block_device(device, force, data_pipeline, false)
+	if foreground {
+		/* 10/18/2026 no child, no syslog, just run the handler right here and return whatever it returns
+		   so systemd or a container runtime or somebody debugging can see the real exit status.
+			 the start gets logged now, not when the handler returns, which could be weeks from now. */
+		this.log_event(EVENT_START, device.Device_name, map[string]interface{}{TXT_FORCE: force, TXT_FOREGROUND: foreground}, ret)
+		if ret != nil {
+			return ret
+		}
+		this.log.Info("starting device: ", device.Device_name, " in the foreground")
+		return this.serve_block_device(device, force, data_pipeline)
+	}
+	if ret != nil {
+		return ret
+	}
+
+	this.log.Info("starting device: ", device.Device_name)
+	// shell to the real deal with dragons
+	var executable, err = os.Executable()
+	if err != nil {
+		return tools.Error(this.log, "unable to determine block device binary to execute: ", err.Error())
+	}
+
+	var cmd = exec.Command(executable, CMD_CATALOG, SUB_CMD_CATALOG_START, "--"+TXT_DEVICE_NAME, device.Device_name, "--"+TXT_DRAGONS)
+	cmd.Env = Sd_notify_child_environment()
+	err = cmd.Start() // and away it goes.
+	if err != nil {
+		return tools.Error(this.log, "unable to start background process ", executable, " err: ", err.Error())
+	}
+	return nil
+}
+
+func (this *Lbd_lib) start_block_device(device *Lbd_device, force bool, data_pipeline *list.List, serve bool) tools.Ret {
+	/* bring up the backing storage and the block device. if we're not serving, this is the validation
+	   phase, we tear it all down again once we know it works. if we are serving, we run the block
+		 device handler until the device goes away. */
+
+	if serve == false {
 		this.log.Info("starting validation phase for: ", device.Device_name)
 	}
 
-	if device.Size%PHYSICAL_BLOCK_SIZE != 0 { // xxxz move these to catalog add
+	/* catalog add checks these before it makes anything, but catalogs from before it did might not be right. */
+	if device.Size%PHYSICAL_BLOCK_SIZE != 0 {
 		return tools.ErrorWithCode(this.log, int(syscall.EINVAL), "block device size is not a multiple of ", PHYSICAL_BLOCK_SIZE)
 	}
 
@@ -743,7 +1136,29 @@ func (this *Lbd_lib) run_block_device(device *Lbd_device, force bool, data_pipel
 
 	var number_of_block_device_blocks uint64 = device.Size / uint64(PHYSICAL_BLOCK_SIZE)
 
-	var ret = this.device_startup(device, force, data_pipeline)
+	/* nobody else gets to use the backing store while we've got it, validating or serving. */
+	var ret, lock = this.lock_backing_store(device)
+	if ret != nil {
+		return ret
+	}
+	defer this.unlock_backing_store(lock)
+
+	/* the stree gives back the end of a preallocated file when it frees blocks, so take it back. */
+	if serve && len(lock) > 0 {
+		if ret = this.allocate_backing_store(device); ret != nil {
+			this.log.Info("WARNING unable to ", device.Allocation, " backing storage: ", device.Local_storage_file,
+				", starting anyway, err: ", ret.Get_errmsg())
+		}
+	}
+
+	/* only the process actually serving the device keeps count of anything. */
+	var metrics *Device_metrics = nil
+	if serve {
+		metrics = New_device_metrics(this.log, device.Device_name)
+		data_pipeline = metrics.Wrap_pipeline(data_pipeline)
+	}
+
+	ret = this.device_startup(device, force, data_pipeline)
 	if ret != nil {
 		return tools.Error(this.log, "can not start up block device, error from backing store:", ret.Get_errmsg())
 	}
@@ -762,6 +1177,22 @@ func (this *Lbd_lib) run_block_device(device *Lbd_device, force bool, data_pipel
 		 and that is not available when we start up the application and first make the
 		 kompressor. so we do it here. */
 
+	/* the pipeline elements hold onto what they were told about the device, see pipeline_lock.
+	   if there aren't any, and the device isn't encrypted so the built in one doesn't hold anything
+		 either, there's nothing to share and everybody can go at once. */
+	var pipeline_locked = false
+	var unlock_pipeline = func() {
+		if pipeline_locked {
+			pipeline_locked = false
+			this.pipeline_lock.Unlock()
+		}
+	}
+	defer unlock_pipeline()
+	if (this.data_pipeline != nil && this.data_pipeline.Len() > 0) || device.is_encrypted() {
+		this.pipeline_lock.Lock()
+		pipeline_locked = true
+	}
+
 	ret = this.process_pipeline_init_last_chance(data_pipeline, device)
 	if ret != nil {
 		return ret
@@ -791,14 +1222,45 @@ func (this *Lbd_lib) run_block_device(device *Lbd_device, force bool, data_pipel
 		return tools.Error(this.log, "Unable to create block device: ", device.Device_name, " error: ", ret.Get_errmsg())
 	}
 
-	if dragons {
+	if serve {
+		/* validation is over, whoever's next can have the pipeline. */
+		unlock_pipeline()
+
 		// start a goroutine to mount the block device if the catentry says to
 		this.attempt_mount(device)
 
-		var block_device_handler = zosbd2cmdlib.New_block_device_handler(this.log, &kmod, device.Device_name, device.storage, handle_id)
+		var storage = this.wrap_capacity_guard(device, device.storage, metrics)
+		storage = metrics.Wrap_storage(storage, device.stree)
+		if device.Checksums {
+			metrics.Watch_checksum_errors(&device.checksum_errors)
+		}
+		var block_device_handler = zosbd2cmdlib.New_block_device_handler(this.log, &kmod, device.Device_name, storage, handle_id)
+
+		/* not being able to serve metrics isn't a good enough reason to not serve the device. */
+		metrics.Start(this.get_metrics_listen(device))
+
+		/* the block device exists and the backing storage is up, if systemd is listening, tell it so. */
+		var notifier = New_sd_notifier(this.log)
+		notifier.Ready("serving block device " + device.Device_name)
+		notifier.Start_watchdog(func() bool {
+			return metrics.Check_progress(device.backing_store)
+		})
+
+		/* from here on a SIGTERM or SIGINT should cleanly take down the device rather than leave the stree dirty */
+		var signal_handler = this.start_signal_handler(device)
+
+		/* reads go through the same lock as the requests, so it's safe to start poking at the store now. */
+		var scrubber = this.start_background_scrub(device, &metrics.lock)
 
 		/* go run the thing */
 		ret = block_device_handler.Run()
+
+		scrubber.Stop()
+		signal_handler.Stop()
+		metrics.Stop()
+		this.log_event(EVENT_HANDLER_EXIT, device.Device_name, nil, ret)
+		notifier.Stop_watchdog()
+		notifier.Stopping("block device " + device.Device_name + " handler exited")
 		if ret != nil {
 			/* if the device ran successfully we only get here when the block device was destroyed by an external
 			   caller, hitting the destroy device ioctl. But if the block device handler failed, then likely nobody
@@ -812,7 +1274,7 @@ func (this *Lbd_lib) run_block_device(device *Lbd_device, force bool, data_pipel
 		}
 		return nil // the actual running of the device completed successfully
 	}
-	// non-dragon mode
+	// validation mode
 	/* First shutdown the backing store, this will get called again on defer, but it's designed to quietly be called twice. */
 	ret = this.device_shutdown(device)
 	if ret != nil {
@@ -823,20 +1285,7 @@ func (this *Lbd_lib) run_block_device(device *Lbd_device, force bool, data_pipel
 	if ret2 != nil {
 		this.log.Error("Error cleaning up block device after block device load test, err: " + ret2.Get_errmsg())
 	}
+	unlock_pipeline()
 	this.log.Info("finished validation phase for: ", device.Device_name)
-	/* at this point the only thing not closed is the file handle to the zosbd2 control device, and that's fine to have
-	that open while we shell. */
-	this.log.Info("starting device: ", device.Device_name)
-	// shell to the real deal with dragons
-	var executable, err = os.Executable()
-	if err != nil {
-		return tools.Error(this.log, "unable to determine block device binary to execute: ", err.Error())
-	}
-
-	var cmd = exec.Command(executable, CMD_CATALOG, SUB_CMD_CATALOG_START, "--"+TXT_DEVICE_NAME, device.Device_name, "--"+TXT_DRAGONS)
-	err = cmd.Start() // and away it goes.
-	if err != nil {
-		return tools.Error(this.log, "unable to start background process ", executable, " err: ", err.Error())
-	}
 	return nil
 }
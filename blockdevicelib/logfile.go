@@ -0,0 +1,222 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/nixomose/nixomosegotools/tools"
+)
+
+/* the tools logger just calls log.Println, so all we have to do to get it into a file is hand
+   the log package a writer. this is that writer. it keeps track of how much it's written so it
+	 can rotate when the file gets too big (file -> file.1 -> file.2... up to max_files), and it can
+	 reopen the file on SIGHUP for when logrotate or somebody else moved it out from under us.
+	 more than one process can be writing to the same file (the command line and the background
+	 handlers), so if somebody else rotated, we'll find out on the next reopen, which is good enough. */
+
+const DEFAULT_LOG_MAX_SIZE_MB = 0 // don't rotate
+const DEFAULT_LOG_MAX_FILES = 5
+
+const LOG_FILE_PERMISSIONS = 0644
+const LOG_DIR_PERMISSIONS = 0755
+const TXT_LOG_SUFFIX = ".log"
+
+type Log_writer struct {
+	lock sync.Mutex
+
+	path      string
+	max_size  int64 // zero means never rotate
+	max_files int
+
+	fh   *os.File
+	size int64
+}
+
+func New_log_writer(path string, max_size_mb int, max_files int) (tools.Ret, *Log_writer) {
+	var ret Log_writer
+	ret.path = path
+	ret.max_size = int64(max_size_mb) * ONE_MEG
+	ret.max_files = max_files
+	if ret.max_files < 1 {
+		ret.max_files = 1
+	}
+	ret.fh = nil
+	ret.size = 0
+
+	var err = ret.open()
+	if err != nil {
+		return tools.Error(nil, "unable to open log file: ", path, " error: ", err), nil
+	}
+	return nil, &ret
+}
+
+func (this *Log_writer) open() error {
+	var err = os.MkdirAll(filepath.Dir(this.path), LOG_DIR_PERMISSIONS)
+	if err != nil {
+		return err
+	}
+	fh, err := os.OpenFile(this.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, LOG_FILE_PERMISSIONS)
+	if err != nil {
+		return err
+	}
+	var info os.FileInfo
+	info, err = fh.Stat()
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	this.fh = fh
+	this.size = info.Size()
+	return nil
+}
+
+func (this *Log_writer) Write(p []byte) (int, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.fh == nil {
+		return 0, os.ErrClosed
+	}
+	if this.max_size > 0 && this.size+int64(len(p)) > this.max_size && this.size > 0 {
+		var err = this.rotate()
+		if err != nil {
+			/* if we can't rotate, keep writing where we are rather than losing the message. */
+			os.Stderr.WriteString("unable to rotate log file: " + this.path + " error: " + err.Error() + "\n")
+		}
+	}
+	var n, err = this.fh.Write(p)
+	this.size += int64(n)
+	return n, err
+}
+
+func (this *Log_writer) rotate() error {
+	/* already locked */
+	this.fh.Close()
+	this.fh = nil
+
+	os.Remove(this.path + "." + strconv.Itoa(this.max_files))
+	for lp := this.max_files - 1; lp >= 1; lp-- {
+		os.Rename(this.path+"."+strconv.Itoa(lp), this.path+"."+strconv.Itoa(lp+1)) // if it's not there, it's not there.
+	}
+	var err = os.Rename(this.path, this.path+".1")
+	if err != nil && os.IsNotExist(err) == false {
+		/* try and get back to where we were. */
+		var err2 = this.open()
+		if err2 != nil {
+			return err2
+		}
+		return err
+	}
+	return this.open()
+}
+
+func (this *Log_writer) Reopen() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.fh != nil {
+		this.fh.Close()
+		this.fh = nil
+	}
+	return this.open()
+}
+
+func (this *Log_writer) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.fh == nil {
+		return nil
+	}
+	var err = this.fh.Close()
+	this.fh = nil
+	return err
+}
+
+func (this *Lbd_lib) set_log_output(log_file string, also_stderr bool) tools.Ret {
+	/* send all logging to log_file, and to stderr as well if this is somebody at a terminal who'd
+	   like to see what went wrong. an empty log file means just stderr like it always was. */
+
+	if len(log_file) == 0 {
+		return nil
+	}
+	var ret, writer = New_log_writer(log_file, this.conf.Log.Log_max_size_mb, this.conf.Log.Log_max_files)
+	if ret != nil {
+		return ret
+	}
+
+	/* point the log package at the new one before we close the old one, so nothing gets written to a closed file. */
+	this.log_writer_lock.Lock()
+	var old_writer = this.log_writer
+	this.log_writer = writer
+	if also_stderr {
+		log.SetOutput(io.MultiWriter(os.Stderr, writer))
+	} else {
+		log.SetOutput(writer)
+	}
+	if old_writer != nil {
+		old_writer.Close()
+	}
+	this.log_writer_lock.Unlock()
+	this.start_log_reopen_handler()
+	return nil
+}
+
+func (this *Lbd_lib) get_device_log_file(device_name string) string {
+	if len(this.conf.Log.Device_log_dir) == 0 {
+		return ""
+	}
+	return filepath.Join(this.conf.Log.Device_log_dir, this.application_name+"-"+device_name+TXT_LOG_SUFFIX)
+}
+
+func (this *Lbd_lib) dragons_to_log(device_name string) {
+	/* the background handler has nobody watching stderr. if there's a per-device log directory
+	   configured, log there, otherwise it goes to syslog like it always has. */
+	var device_log_file = this.get_device_log_file(device_name)
+	if len(device_log_file) == 0 {
+		this.dragons_to_syslog(device_name)
+		return
+	}
+	var ret = this.set_log_output(device_log_file, false)
+	if ret != nil {
+		this.dragons_to_syslog(device_name)
+		this.log.Error("unable to log to device log file: ", device_log_file, ", logging to syslog: ", ret.Get_errmsg())
+	}
+}
+
+func (this *Lbd_lib) start_log_reopen_handler() {
+	/* only once per process, whichever log writer is current at the time of the signal gets reopened. */
+	this.log_reopen_once.Do(func() {
+		var hup = make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				/* held across the reopen, so set_log_output can't close this one while we're reopening it. */
+				this.log_writer_lock.Lock()
+				var writer = this.log_writer
+				var err error
+				if writer != nil {
+					err = writer.Reopen()
+				}
+				this.log_writer_lock.Unlock()
+				if writer == nil {
+					continue
+				}
+				if err != nil {
+					os.Stderr.WriteString("unable to reopen log file: " + writer.path + " error: " + err.Error() + "\n")
+					continue
+				}
+				this.log.Info("reopened log file: ", writer.path)
+			}
+		}()
+	})
+}
@@ -0,0 +1,479 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nixomose/nixomosegotools/tools"
+	"github.com/nixomose/stree_v/stree_v_lib/stree_v_lib"
+	"github.com/nixomose/zosbd2goclient/zosbd2cmdlib/zosbd2interfaces"
+	"github.com/spf13/cobra"
+)
+
+/* the handler process can serve prometheus style metrics about the device it's running.
+   the text format is simple enough that we just write it out ourselves.
+	 we count requests by wrapping the storage mechanism the block device handler calls, and we
+	 measure what the pipeline does to the data by wrapping each pipeline element. the handler only
+	 does one thing at a time, so the lock in here costs nothing and it means we can ask the stree
+	 about itself during a scrape without stepping on a request in flight.
+	 where to listen comes from the catalog entry (host:port or unix:/path) or if that's not set,
+	 a socket named after the device in the configured metrics socket directory. */
+
+const TXT_METRICS_UNIX_PREFIX = "unix:"
+const TXT_METRICS_PATH = "/metrics"
+const TXT_METRICS_SOCKET_SUFFIX = ".sock"
+
+const METRICS_OP_READ = "read"
+const METRICS_OP_WRITE = "write"
+const METRICS_OP_DISCARD = "discard"
+
+var metrics_ops = []string{METRICS_OP_READ, METRICS_OP_WRITE, METRICS_OP_DISCARD}
+
+/* request latency buckets in seconds */
+var metrics_latency_buckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+type metrics_op_stats struct {
+	requests uint64
+	bytes    uint64
+	errors   uint64
+
+	bucket_counts []uint64 // one per latency bucket, not cumulative, we add them up on output
+	latency_sum   float64
+}
+
+type metrics_pipeline_stats struct {
+	name string
+
+	pipe_in_bytes_in   uint64
+	pipe_in_bytes_out  uint64
+	pipe_out_bytes_in  uint64
+	pipe_out_bytes_out uint64
+	errors             uint64
+}
+
+type Device_metrics struct {
+	log  *tools.Nixomosetools_logger
+	lock sync.Mutex
+
+	device_name string
+	stree       *stree_v_lib.Stree_v // nil if it's a ramdisk
+	started     time.Time
+
+	ops      map[string]*metrics_op_stats
+	pipeline []*metrics_pipeline_stats
+
+	capacity_level int // CAPACITY_OK, SOFT or HARD
+	read_only      bool
+
+	checksum_errors *uint64 // the device's counter, nil if it doesn't have checksums
+
+	progress_requests uint64 // how many requests were done the last time the watchdog asked
+
+	server   *http.Server
+	listener net.Listener
+}
+
+func New_device_metrics(log *tools.Nixomosetools_logger, device_name string) *Device_metrics {
+	var ret Device_metrics
+	ret.log = log
+	ret.device_name = device_name
+	ret.stree = nil
+	ret.started = time.Now()
+	ret.ops = make(map[string]*metrics_op_stats)
+	for _, op := range metrics_ops {
+		ret.ops[op] = &metrics_op_stats{bucket_counts: make([]uint64, len(metrics_latency_buckets))}
+	}
+	ret.pipeline = make([]*metrics_pipeline_stats, 0)
+	ret.capacity_level = CAPACITY_OK
+	ret.read_only = false
+	ret.server = nil
+	ret.listener = nil
+	return &ret
+}
+
+func (this *Device_metrics) record(op string, length uint32, started time.Time, ret tools.Ret) {
+	/* already locked */
+	var elapsed = time.Since(started).Seconds()
+	var stats = this.ops[op]
+	stats.requests++
+	if ret != nil {
+		stats.errors++
+	} else {
+		stats.bytes += uint64(length)
+	}
+	stats.latency_sum += elapsed
+	for lp, le := range metrics_latency_buckets {
+		if elapsed <= le {
+			stats.bucket_counts[lp]++
+			break
+		}
+	}
+}
+
+func (this *Device_metrics) Set_capacity_level(level int) {
+	/* only called from inside the storage calls, so we already hold the lock. */
+	this.capacity_level = level
+}
+
+func (this *Device_metrics) Set_read_only(read_only bool) {
+	this.read_only = read_only
+}
+
+func (this *Device_metrics) Watch_checksum_errors(counter *uint64) {
+	this.checksum_errors = counter
+}
+
+func (this *Device_metrics) Check_progress(store Lbd_file_store) bool {
+	/* for the watchdog. if requests have finished since the last time, the handler is getting
+	   somewhere. if not, it might just be idle, so take the lock the requests take and read the
+		 header block. if a request is wedged in the storage we wait here behind it, and the
+		 watchdog doesn't get pinged, which is the point. */
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	var requests uint64 = 0
+	for _, stats := range this.ops {
+		requests += stats.requests
+	}
+	if requests != this.progress_requests {
+		this.progress_requests = requests
+		return true
+	}
+	if store == nil {
+		return true // a ramdisk, nothing to go look at
+	}
+	var ret, _ = store.Read_raw_data(0)
+	return ret == nil
+}
+
+/* the storage mechanism the handler calls. */
+
+type metered_storage struct {
+	metrics *Device_metrics
+	storage zosbd2interfaces.Storage_mechanism
+}
+
+var _ zosbd2interfaces.Storage_mechanism = &metered_storage{}
+var _ zosbd2interfaces.Storage_mechanism = (*metered_storage)(nil)
+
+func (this *Device_metrics) Wrap_storage(storage zosbd2interfaces.Storage_mechanism, stree *stree_v_lib.Stree_v) zosbd2interfaces.Storage_mechanism {
+	this.stree = stree
+	return &metered_storage{metrics: this, storage: storage}
+}
+
+func (this *metered_storage) Read_block(start_in_bytes uint64, length uint32, data []byte) tools.Ret {
+	this.metrics.lock.Lock()
+	defer this.metrics.lock.Unlock()
+	var started = time.Now()
+	var ret = this.storage.Read_block(start_in_bytes, length, data)
+	this.metrics.record(METRICS_OP_READ, length, started, ret)
+	return ret
+}
+
+func (this *metered_storage) Write_block(start_in_bytes uint64, length uint32, data []byte) tools.Ret {
+	this.metrics.lock.Lock()
+	defer this.metrics.lock.Unlock()
+	var started = time.Now()
+	var ret = this.storage.Write_block(start_in_bytes, length, data)
+	this.metrics.record(METRICS_OP_WRITE, length, started, ret)
+	return ret
+}
+
+func (this *metered_storage) Discard_block(start_in_bytes uint64, length uint32) tools.Ret {
+	this.metrics.lock.Lock()
+	defer this.metrics.lock.Unlock()
+	var started = time.Now()
+	var ret = this.storage.Discard_block(start_in_bytes, length)
+	this.metrics.record(METRICS_OP_DISCARD, length, started, ret)
+	return ret
+}
+
+func (this *metered_storage) Get_block_size() uint32 {
+	return this.storage.Get_block_size()
+}
+
+/* the pipeline elements, so we can see how much the kompressor is saving us. */
+
+type metered_pipeline_element struct {
+	metrics *Device_metrics
+	stats   *metrics_pipeline_stats
+	element zosbd2interfaces.Data_pipeline_element
+}
+
+var _ zosbd2interfaces.Data_pipeline_element = &metered_pipeline_element{}
+var _ zosbd2interfaces.Data_pipeline_element = (*metered_pipeline_element)(nil)
+
+func (this *Device_metrics) Wrap_pipeline(data_pipeline *list.List) *list.List {
+	/* make a new list with each element wrapped, the original list is left alone. */
+	var ret = list.New()
+	if data_pipeline == nil {
+		return ret
+	}
+	for item := data_pipeline.Front(); item != nil; item = item.Next() {
+		var pipline_element, ok = item.Value.(zosbd2interfaces.Data_pipeline_element)
+		if ok == false || pipline_element == nil {
+			ret.PushBack(item.Value) // the storage mechanism will complain about it, not us.
+			continue
+		}
+		var stats = &metrics_pipeline_stats{name: this.pipeline_element_name(pipline_element)}
+		this.pipeline = append(this.pipeline, stats)
+		ret.PushBack(&metered_pipeline_element{metrics: this, stats: stats, element: pipline_element})
+	}
+	return ret
+}
+
+func (this *Device_metrics) pipeline_element_name(element zosbd2interfaces.Data_pipeline_element) string {
+	var name = fmt.Sprintf("%T", element)
+	name = strings.TrimLeft(name, "*")
+	if pos := strings.LastIndex(name, "."); pos >= 0 {
+		name = name[pos+1:]
+	}
+	/* if there are two of the same kind, number them so they don't collide */
+	var count = 0
+	for _, stats := range this.pipeline {
+		if stats.name == name || strings.HasPrefix(stats.name, name+"_") {
+			count++
+		}
+	}
+	if count > 0 {
+		name = name + "_" + tools.Inttostring(count)
+	}
+	return name
+}
+
+func (this *metered_pipeline_element) Process_parameters(params *cobra.Command) tools.Ret {
+	return this.element.Process_parameters(params)
+}
+
+func (this *metered_pipeline_element) Process_device(device zosbd2interfaces.Device_interface) tools.Ret {
+	return this.element.Process_device(device)
+}
+
+func (this *metered_pipeline_element) Pipe_in(data_in_out *[]byte) tools.Ret {
+	/* only ever called from inside the storage calls above, so we already hold the lock. */
+	var bytes_in = len(*data_in_out)
+	var ret = this.element.Pipe_in(data_in_out)
+	if ret != nil {
+		this.stats.errors++
+		return ret
+	}
+	this.stats.pipe_in_bytes_in += uint64(bytes_in)
+	this.stats.pipe_in_bytes_out += uint64(len(*data_in_out))
+	return nil
+}
+
+func (this *metered_pipeline_element) Pipe_out(data_in_out *[]byte) tools.Ret {
+	var bytes_in = len(*data_in_out)
+	var ret = this.element.Pipe_out(data_in_out)
+	if ret != nil {
+		this.stats.errors++
+		return ret
+	}
+	this.stats.pipe_out_bytes_in += uint64(bytes_in)
+	this.stats.pipe_out_bytes_out += uint64(len(*data_in_out))
+	return nil
+}
+
+func (this *metered_pipeline_element) Get_context() zosbd2interfaces.Data_pipeline_element_context {
+	return this.element.Get_context()
+}
+
+func (this *metered_pipeline_element) Set_context(context zosbd2interfaces.Data_pipeline_element_context) {
+	this.element.Set_context(context)
+}
+
+/* serving */
+
+func (this *Lbd_lib) get_metrics_listen(device *Lbd_device) string {
+	if len(device.Metrics_listen) > 0 {
+		return device.Metrics_listen
+	}
+	if this.conf == nil || len(this.conf.Metrics.Socket_dir) == 0 {
+		return ""
+	}
+	return TXT_METRICS_UNIX_PREFIX + filepath.Join(this.conf.Metrics.Socket_dir,
+		this.application_name+"-"+device.Device_name+TXT_METRICS_SOCKET_SUFFIX)
+}
+
+func (this *Device_metrics) Start(listen string) tools.Ret {
+	if len(listen) == 0 {
+		return nil // nobody asked for metrics
+	}
+
+	var listener net.Listener
+	var err error
+	if strings.HasPrefix(listen, TXT_METRICS_UNIX_PREFIX) {
+		var path = strings.TrimPrefix(listen, TXT_METRICS_UNIX_PREFIX)
+		err = os.MkdirAll(filepath.Dir(path), LOG_DIR_PERMISSIONS)
+		if err == nil {
+			os.Remove(path) // left over from the last time we crashed
+			listener, err = net.Listen("unix", path)
+		}
+	} else {
+		listener, err = net.Listen("tcp", listen)
+	}
+	if err != nil {
+		return tools.Error(this.log, "unable to listen for metrics on: ", listen, " error: ", err)
+	}
+
+	var mux = http.NewServeMux()
+	mux.HandleFunc(TXT_METRICS_PATH, this.serve_metrics)
+	this.listener = listener
+	this.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		var err = this.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			this.log.Error("metrics server for device: ", this.device_name, " stopped, error: ", err)
+		}
+	}()
+	this.log.Info("serving metrics for device: ", this.device_name, " on ", listen)
+	return nil
+}
+
+func (this *Device_metrics) Stop() {
+	if this.server == nil {
+		return
+	}
+	var ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	this.server.Shutdown(ctx) // this closes the listener, which removes the unix socket too
+	this.server = nil
+	this.listener = nil
+}
+
+func (this *Device_metrics) serve_metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(this.Render()))
+}
+
+func metrics_escape(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return strings.ReplaceAll(value, `"`, `\"`)
+}
+
+func (this *Device_metrics) Render() string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	var sb strings.Builder
+	var device = `device="` + metrics_escape(this.device_name) + `"`
+
+	var header = func(name string, kind string, help string) {
+		fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	header("lbd_requests_total", "counter", "block device requests handled.")
+	for _, op := range metrics_ops {
+		fmt.Fprintf(&sb, "lbd_requests_total{%s,op=\"%s\"} %d\n", device, op, this.ops[op].requests)
+	}
+	header("lbd_request_bytes_total", "counter", "bytes successfully read, written or discarded.")
+	for _, op := range metrics_ops {
+		fmt.Fprintf(&sb, "lbd_request_bytes_total{%s,op=\"%s\"} %d\n", device, op, this.ops[op].bytes)
+	}
+	header("lbd_request_errors_total", "counter", "block device requests that failed.")
+	for _, op := range metrics_ops {
+		fmt.Fprintf(&sb, "lbd_request_errors_total{%s,op=\"%s\"} %d\n", device, op, this.ops[op].errors)
+	}
+	header("lbd_request_duration_seconds", "histogram", "time spent handling block device requests.")
+	for _, op := range metrics_ops {
+		var stats = this.ops[op]
+		var cumulative uint64 = 0
+		for lp, le := range metrics_latency_buckets {
+			cumulative += stats.bucket_counts[lp]
+			fmt.Fprintf(&sb, "lbd_request_duration_seconds_bucket{%s,op=\"%s\",le=\"%g\"} %d\n", device, op, le, cumulative)
+		}
+		fmt.Fprintf(&sb, "lbd_request_duration_seconds_bucket{%s,op=\"%s\",le=\"+Inf\"} %d\n", device, op, stats.requests)
+		fmt.Fprintf(&sb, "lbd_request_duration_seconds_sum{%s,op=\"%s\"} %g\n", device, op, stats.latency_sum)
+		fmt.Fprintf(&sb, "lbd_request_duration_seconds_count{%s,op=\"%s\"} %d\n", device, op, stats.requests)
+	}
+
+	if this.stree != nil {
+		/* the stree only ever allocates from the free position, so that's both how many nodes have been
+		   allocated and how much of the backing store is spoken for. */
+		var ret, free_position = this.stree.Get_used_blocks()
+		if ret == nil {
+			header("lbd_stree_free_position", "gauge", "position of the first never allocated block in the backing store, block 0 is the header.")
+			fmt.Fprintf(&sb, "lbd_stree_free_position{%s} %d\n", device, free_position)
+		}
+		var total_blocks uint32
+		ret, total_blocks = this.stree.Get_total_blocks()
+		if ret == nil {
+			header("lbd_stree_blocks_total", "gauge", "blocks in the backing store.")
+			fmt.Fprintf(&sb, "lbd_stree_blocks_total{%s} %d\n", device, total_blocks)
+			if total_blocks > 0 {
+				header("lbd_stree_usage_ratio", "gauge", "free position over blocks in the backing store.")
+				fmt.Fprintf(&sb, "lbd_stree_usage_ratio{%s} %g\n", device, float64(free_position)/float64(total_blocks))
+			}
+		}
+		header("lbd_stree_block_size_bytes", "gauge", "size of one stree block in the backing store.")
+		fmt.Fprintf(&sb, "lbd_stree_block_size_bytes{%s} %d\n", device, this.stree.Get_node_size_in_bytes())
+	}
+
+	if len(this.pipeline) > 0 {
+		var pipeline = make([]*metrics_pipeline_stats, len(this.pipeline))
+		copy(pipeline, this.pipeline)
+		sort.Slice(pipeline, func(i, j int) bool { return pipeline[i].name < pipeline[j].name })
+
+		header("lbd_pipeline_bytes_in_total", "counter", "bytes handed to a pipeline element, direction in is on the way to storage.")
+		for _, stats := range pipeline {
+			var element = `element="` + metrics_escape(stats.name) + `"`
+			fmt.Fprintf(&sb, "lbd_pipeline_bytes_in_total{%s,%s,direction=\"in\"} %d\n", device, element, stats.pipe_in_bytes_in)
+			fmt.Fprintf(&sb, "lbd_pipeline_bytes_in_total{%s,%s,direction=\"out\"} %d\n", device, element, stats.pipe_out_bytes_in)
+		}
+		header("lbd_pipeline_bytes_out_total", "counter", "bytes a pipeline element handed back.")
+		for _, stats := range pipeline {
+			var element = `element="` + metrics_escape(stats.name) + `"`
+			fmt.Fprintf(&sb, "lbd_pipeline_bytes_out_total{%s,%s,direction=\"in\"} %d\n", device, element, stats.pipe_in_bytes_out)
+			fmt.Fprintf(&sb, "lbd_pipeline_bytes_out_total{%s,%s,direction=\"out\"} %d\n", device, element, stats.pipe_out_bytes_out)
+		}
+		header("lbd_pipeline_ratio", "gauge", "bytes out over bytes in on the way to storage, for the kompressor that's the compression ratio.")
+		for _, stats := range pipeline {
+			if stats.pipe_in_bytes_in == 0 {
+				continue
+			}
+			fmt.Fprintf(&sb, "lbd_pipeline_ratio{%s,element=\"%s\"} %g\n", device, metrics_escape(stats.name),
+				float64(stats.pipe_in_bytes_out)/float64(stats.pipe_in_bytes_in))
+		}
+		header("lbd_pipeline_errors_total", "counter", "pipeline element failures.")
+		for _, stats := range pipeline {
+			fmt.Fprintf(&sb, "lbd_pipeline_errors_total{%s,element=\"%s\"} %d\n", device, metrics_escape(stats.name), stats.errors)
+		}
+	}
+
+	if this.checksum_errors != nil {
+		header("lbd_checksum_errors_total", "counter", "blocks read from the backing store that didn't match their checksum.")
+		fmt.Fprintf(&sb, "lbd_checksum_errors_total{%s} %d\n", device, atomic.LoadUint64(this.checksum_errors))
+	}
+
+	header("lbd_capacity_alarm", "gauge", "1 for the capacity watermark the backing store is currently past.")
+	for level, name := range capacity_level_names {
+		var value = 0
+		if level == this.capacity_level {
+			value = 1
+		}
+		fmt.Fprintf(&sb, "lbd_capacity_alarm{%s,level=\"%s\"} %d\n", device, name, value)
+	}
+	header("lbd_read_only", "gauge", "1 if the device was made read only because the backing store is full.")
+	var read_only = 0
+	if this.read_only {
+		read_only = 1
+	}
+	fmt.Fprintf(&sb, "lbd_read_only{%s} %d\n", device, read_only)
+
+	header("lbd_handler_start_time_seconds", "gauge", "when the block device handler started.")
+	fmt.Fprintf(&sb, "lbd_handler_start_time_seconds{%s} %d\n", device, this.started.Unix())
+	return sb.String()
+}
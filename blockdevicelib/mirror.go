@@ -0,0 +1,725 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"encoding/binary"
+	"os"
+	"syscall"
+
+	"github.com/nixomose/nixomosegotools/tools"
+	"github.com/nixomose/stree_v/stree_v_lib/stree_v_lib"
+)
+
+/* losing the one disk the backing store is on means losing the device, so a catalog entry can have a
+   mirror storage file, a second copy of the whole store on a different disk.
+	 every write goes to both, reads come from the primary (the local storage file, or the storage
+	 layout over it and the additional storage files) and fall back to the mirror if the read fails.
+	 if a write to one side fails, that side gets dropped and we carry on with the other one.
+	 the mirror is a regular single file store, block n lives at the same place it would in any single
+	 file store, so the two sides have their own headers with their own root node, free position and
+	 dirty flag. none of those change when the stree rewrites a node in place though, so they can't tell
+	 us whether a side missed some writes. so each side also has a generation number in its header
+	 block, past where the store header (or a directio write of it) ever reaches. every startup bumps
+	 it on every side we're using, and dropping a side bumps it on the ones that are left, so a side
+	 that missed anything is behind. that's how we know at startup whether they still agree:
+	   same generation, root node, free position and dirty flag, and not both dirty: in sync, use both.
+	   different generations: the higher one is right.
+	   both dirty means we crashed, and a write may have only made it to one side, so the primary
+	   wins. otherwise whichever one was cleanly shut down is right, and if they both were the
+	   primary wins.
+	 a mirror that's out of date (or missing, or blank because the disk got replaced) gets ignored
+	 until storage resync copies the primary over to it. if it's the primary that's out of date we
+	 refuse to start, because the only good copy is the mirror, and storage resync --from-mirror is
+	 how you get it back.
+	 a dropped side is never shut down, that would mark it clean, and then it would look right the
+	 next time we started. it gets closed when we exit.
+	 the mirror can be smaller than the primary, the device just gets what fits in the smaller one. */
+
+const MIRROR_IN_SYNC = "in sync"
+const MIRROR_OUT_OF_DATE = "out of date"
+const MIRROR_PRIMARY_OUT_OF_DATE = "primary out of date"
+
+const RESYNC_PROGRESS_STEPS = 10 // how many times to say how far along we are
+
+const MIRROR_GENERATION_MAGIC uint64 = 0x4c42444d47454e31                   // LBDMGEN1
+const MIRROR_GENERATION_OFFSET = int64(stree_v_lib.CHECK_START_BLANK_BYTES) // in the header block, past the store header
+const MIRROR_GENERATION_END = MIRROR_GENERATION_OFFSET + 16                 // magic and generation
+
+type mirror_side struct {
+	path   string
+	store  Lbd_file_store
+	opened bool // we have it open and have to close it
+	active bool // reads and writes go to it
+}
+
+type mirror_side_header struct {
+	initialized   bool
+	dirty         bool
+	root_node     uint32
+	free_position uint32
+	generation    uint64
+}
+
+type Mirrored_store struct {
+	log        *tools.Nixomosetools_logger
+	sides      []*mirror_side // the primary first
+	generation uint64         // what the active sides have in their headers
+
+	get_state func() (tools.Ret, string) // works out whether the mirror agrees with the primary, with fresh store objects
+}
+
+var _ Lbd_file_store = &Mirrored_store{}
+
+func New_mirrored_store(log *tools.Nixomosetools_logger, primary Lbd_file_store, primary_path string,
+	mirror Lbd_file_store, mirror_path string, get_state func() (tools.Ret, string)) *Mirrored_store {
+	var m Mirrored_store
+	m.log = log
+	m.sides = []*mirror_side{{path: primary_path, store: primary}, {path: mirror_path, store: mirror}}
+	m.get_state = get_state
+	return &m
+}
+
+func (this *Mirrored_store) primary() *mirror_side {
+	return this.sides[0]
+}
+
+func (this *Mirrored_store) mirror() *mirror_side {
+	return this.sides[1]
+}
+
+func (this *Mirrored_store) first_active() (tools.Ret, *mirror_side) {
+	for _, side := range this.sides {
+		if side.active {
+			return nil, side
+		}
+	}
+	return tools.Error(this.log, "mirrored backing storage: ", this.primary().path, " has no working side, not started or everything failed"), nil
+}
+
+func (this *Mirrored_store) drop(side *mirror_side, ret tools.Ret) {
+	/* left open on purpose, see above. and the sides that are left move on a generation so this one
+	   is behind from now on. */
+	side.active = false
+	this.log.Error("WARNING dropping backing storage: ", side.path, " from the mirror, error: ", ret.Get_errmsg(),
+		". carrying on without it until it's brought back with storage resync.")
+	for _, other := range this.sides {
+		if other.active {
+			this.bump_generation()
+			return
+		}
+	}
+}
+
+func (this *Mirrored_store) bump_generation() tools.Ret {
+	/* a side we can't write the new generation to is dropped, without bumping again, it's behind already. */
+	this.generation++
+	var written = 0
+	for _, side := range this.sides {
+		if side.active == false {
+			continue
+		}
+		var ret = write_store_generation(this.log, side.path, this.generation)
+		if ret != nil {
+			side.active = false
+			this.log.Error("WARNING dropping backing storage: ", side.path, " from the mirror, error: ", ret.Get_errmsg(),
+				". carrying on without it until it's brought back with storage resync.")
+			continue
+		}
+		written++
+	}
+	if written == 0 {
+		return tools.Error(this.log, "unable to write the mirror generation to any side of: ", this.primary().path)
+	}
+	return nil
+}
+
+func read_store_generation(log *tools.Nixomosetools_logger, path string) (tools.Ret, uint64) {
+	/* no magic (an older store, or a short file) is generation zero. */
+	var fh, err = os.Open(path)
+	if err != nil {
+		return tools.Error(log, "unable to open backing storage: ", path, " to read its mirror generation, err: ", err), 0
+	}
+	defer fh.Close()
+	var data = make([]byte, MIRROR_GENERATION_END-MIRROR_GENERATION_OFFSET)
+	var n, _ = fh.ReadAt(data, MIRROR_GENERATION_OFFSET)
+	if n != len(data) || binary.BigEndian.Uint64(data[0:8]) != MIRROR_GENERATION_MAGIC {
+		return nil, 0
+	}
+	return nil, binary.BigEndian.Uint64(data[8:16])
+}
+
+func write_store_generation(log *tools.Nixomosetools_logger, path string, generation uint64) tools.Ret {
+	var fh, err = os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return tools.Error(log, "unable to open backing storage: ", path, " to write its mirror generation, err: ", err)
+	}
+	defer fh.Close()
+	var data = make([]byte, MIRROR_GENERATION_END-MIRROR_GENERATION_OFFSET)
+	binary.BigEndian.PutUint64(data[0:8], MIRROR_GENERATION_MAGIC)
+	binary.BigEndian.PutUint64(data[8:16], generation)
+	if _, err = fh.WriteAt(data, MIRROR_GENERATION_OFFSET); err != nil {
+		return tools.Error(log, "unable to write mirror generation to backing storage: ", path, ", err: ", err)
+	}
+	if err = fh.Sync(); err != nil {
+		return tools.Error(log, "unable to sync mirror generation to backing storage: ", path, ", err: ", err)
+	}
+	return nil
+}
+
+func (this *Mirrored_store) read(block_num uint32, op func(store Lbd_file_store) tools.Ret) tools.Ret {
+	var ret, _ = this.first_active()
+	if ret != nil {
+		return ret
+	}
+	for _, side := range this.sides {
+		if side.active == false {
+			continue
+		}
+		ret = op(side.store)
+		if ret == nil {
+			return nil
+		}
+		this.log.Error("WARNING unable to read block ", block_num, " from backing storage: ", side.path,
+			", trying the other side of the mirror.")
+	}
+	return ret
+}
+
+func (this *Mirrored_store) write(op func(store Lbd_file_store) tools.Ret) tools.Ret {
+	var ret tools.Ret
+	ret, _ = this.first_active()
+	if ret != nil {
+		return ret
+	}
+	var written = 0
+	var last tools.Ret
+	for _, side := range this.sides {
+		if side.active == false {
+			continue
+		}
+		ret = op(side.store)
+		if ret != nil {
+			this.drop(side, ret)
+			last = ret
+			continue
+		}
+		written++
+	}
+	if written == 0 {
+		return last
+	}
+	return nil
+}
+
+func (this *Mirrored_store) Is_backing_store_uninitialized() (tools.Ret, bool) {
+	/* only blank if both sides are, if the mirror has something on it we don't want catalog add
+	   laying a new store over it. a file that isn't there yet is blank. */
+	var first_ret tools.Ret
+	for lp, side := range this.sides {
+		var ret, uninitialized = side.store.Is_backing_store_uninitialized()
+		if ret != nil {
+			if ret.Get_errcode() != int(syscall.ENOENT) {
+				return ret, false
+			}
+			if lp == 0 {
+				first_ret = ret
+			}
+			uninitialized = true
+		}
+		if uninitialized == false {
+			return nil, false
+		}
+	}
+	if first_ret != nil {
+		return first_ret, false // same as a single store that doesn't exist yet
+	}
+	return nil, true
+}
+
+func (this *Mirrored_store) Init() tools.Ret {
+	for _, side := range this.sides {
+		var ret = side.store.Init()
+		if ret != nil {
+			return ret
+		}
+		side.opened = true
+		side.active = true
+	}
+	this.generation = 0 // whatever was there before means nothing now
+	return this.bump_generation()
+}
+
+func (this *Mirrored_store) Startup(force bool) tools.Ret {
+	var ret, state = this.get_state()
+	if ret != nil {
+		return ret
+	}
+	if state == MIRROR_PRIMARY_OUT_OF_DATE {
+		return tools.Error(this.log, "backing storage: ", this.primary().path, " is out of date, its mirror: ", this.mirror().path,
+			" has newer data. run storage resync with --", TXT_FROM_MIRROR, " to bring it up to date before starting.")
+	}
+
+	ret, this.generation = read_store_generation(this.log, this.primary().path)
+	if ret != nil {
+		return ret
+	}
+	ret = this.primary().store.Startup(force)
+	if ret != nil {
+		return ret
+	}
+	this.primary().opened = true
+	this.primary().active = true
+
+	/* whether the mirror comes along or not, this is a new generation, and if it doesn't it's behind. */
+	if state != MIRROR_IN_SYNC {
+		this.log.Info("WARNING mirror backing storage: ", this.mirror().path, " is ", state,
+			", running without it until it's brought up to date with storage resync.")
+		return this.bump_generation()
+	}
+	ret = this.mirror().store.Startup(force)
+	if ret != nil {
+		this.log.Error("WARNING unable to start mirror backing storage: ", this.mirror().path, ", error: ", ret.Get_errmsg(),
+			". running without it.")
+		return this.bump_generation()
+	}
+	this.mirror().opened = true
+	this.mirror().active = true
+	return this.bump_generation()
+}
+
+func (this *Mirrored_store) Shutdown() tools.Ret {
+	var ret tools.Ret
+	var any_opened = false
+	for _, side := range this.sides {
+		if side.opened == false || side.active == false {
+			continue // a dropped side stays open, see above.
+		}
+		any_opened = true
+		var r = side.store.Shutdown()
+		side.opened = false
+		side.active = false
+		if r != nil && ret == nil {
+			ret = r
+		}
+	}
+	if any_opened == false {
+		return tools.Error(this.log, "mirrored backing storage: ", this.primary().path, " not started or already shut down.")
+	}
+	return ret
+}
+
+func (this *Mirrored_store) Open_datastore_readonly() tools.Ret {
+	/* the status and diag commands only look at the primary. */
+	var ret = this.primary().store.Open_datastore_readonly()
+	if ret != nil {
+		return ret
+	}
+	this.primary().opened = true
+	this.primary().active = true
+	return nil
+}
+
+func (this *Mirrored_store) Load_header_and_check_magic(check_device_params bool) tools.Ret {
+	return this.primary().store.Load_header_and_check_magic(check_device_params)
+}
+
+func (this *Mirrored_store) Get_store_information() (tools.Ret, string) {
+	return this.primary().store.Get_store_information()
+}
+
+func (this *Mirrored_store) Get_usable_storage_bytes(path string) (tools.Ret, uint64) {
+	return this.primary().store.Get_usable_storage_bytes(path)
+}
+
+func (this *Mirrored_store) Read_raw_data(block_num uint32) (tools.Ret, []byte) {
+	var data []byte
+	var ret = this.read(block_num, func(store Lbd_file_store) tools.Ret {
+		var r tools.Ret
+		r, data = store.Read_raw_data(block_num)
+		return r
+	})
+	return ret, data
+}
+
+func (this *Mirrored_store) Load(block_num uint32) (tools.Ret, *[]byte) {
+	var data *[]byte
+	var ret = this.read(block_num, func(store Lbd_file_store) tools.Ret {
+		var r tools.Ret
+		r, data = store.Load(block_num)
+		return r
+	})
+	return ret, data
+}
+
+func (this *Mirrored_store) Load_limit(block_num uint32, length uint32) (tools.Ret, *[]byte) {
+	var data *[]byte
+	var ret = this.read(block_num, func(store Lbd_file_store) tools.Ret {
+		var r tools.Ret
+		r, data = store.Load_limit(block_num, length)
+		return r
+	})
+	return ret, data
+}
+
+func (this *Mirrored_store) Store(block_num uint32, data *[]byte) tools.Ret {
+	return this.write(func(store Lbd_file_store) tools.Ret {
+		return store.Store(block_num, data)
+	})
+}
+
+func (this *Mirrored_store) Get_root_node() (tools.Ret, uint32) {
+	var ret, side = this.first_active()
+	if ret != nil {
+		return ret, 0
+	}
+	return side.store.Get_root_node()
+}
+
+func (this *Mirrored_store) Set_root_node(block_num uint32) tools.Ret {
+	return this.write(func(store Lbd_file_store) tools.Ret {
+		return store.Set_root_node(block_num)
+	})
+}
+
+func (this *Mirrored_store) Get_free_position() (tools.Ret, uint32) {
+	var ret, side = this.first_active()
+	if ret != nil {
+		return ret, 0
+	}
+	return side.store.Get_free_position()
+}
+
+func (this *Mirrored_store) Get_total_blocks() (tools.Ret, uint32) {
+	/* the smaller side, so the stree never allocates past the end of either. */
+	var ret, _ = this.first_active()
+	if ret != nil {
+		return ret, 0
+	}
+	var total uint32 = 0
+	var found = false
+	for _, side := range this.sides {
+		if side.active == false {
+			continue
+		}
+		var blocks uint32
+		ret, blocks = side.store.Get_total_blocks()
+		if ret != nil {
+			return ret, 0
+		}
+		if found == false || blocks < total {
+			total = blocks
+			found = true
+		}
+	}
+	return nil, total
+}
+
+func (this *Mirrored_store) Allocate(amount uint32) (tools.Ret, []uint32) {
+	/* both sides have the same free position, so they should hand out the same blocks,
+	   if one doesn't, it doesn't agree with the other side anymore. */
+	var positions []uint32
+	var ret = this.write(func(store Lbd_file_store) tools.Ret {
+		var r, p = store.Allocate(amount)
+		if r != nil {
+			return r
+		}
+		if positions == nil {
+			positions = p
+			return nil
+		}
+		for lp := range p {
+			if p[lp] != positions[lp] {
+				return tools.Error(this.log, "mirror allocated block ", p[lp], " where the primary allocated block ", positions[lp])
+			}
+		}
+		return nil
+	})
+	if ret != nil {
+		return ret, nil
+	}
+	return nil, positions
+}
+
+func (this *Mirrored_store) Deallocate() tools.Ret {
+	return this.write(func(store Lbd_file_store) tools.Ret {
+		return store.Deallocate()
+	})
+}
+
+func (this *Mirrored_store) Wipe() tools.Ret {
+	var ret, _ = this.first_active()
+	if ret != nil {
+		return ret
+	}
+	for _, side := range this.sides {
+		if side.active == false {
+			continue
+		}
+		ret = side.store.Wipe()
+		if ret != nil {
+			return ret
+		}
+	}
+	return nil
+}
+
+func (this *Mirrored_store) Dispose() tools.Ret {
+	for _, side := range this.sides {
+		var ret = side.store.Dispose()
+		if ret != nil {
+			return ret
+		}
+	}
+	return nil
+}
+
+func (this *Lbd_lib) read_mirror_side_header(fstore Lbd_file_store, path string) (tools.Ret, *mirror_side_header) {
+	/* not there or no header means not initialized, which is not an error here. */
+	var side mirror_side_header
+	var ret, blank = fstore.Is_backing_store_uninitialized()
+	if (ret != nil && ret.Get_errcode() == int(syscall.ENOENT)) || (ret == nil && blank) {
+		return nil, &side
+	}
+	ret = fstore.Open_datastore_readonly()
+	if ret != nil {
+		if ret.Get_errcode() == int(syscall.ENOENT) {
+			return nil, &side
+		}
+		return ret, nil
+	}
+	defer fstore.Shutdown()
+
+	ret = fstore.Load_header_and_check_magic(false)
+	if ret != nil {
+		return nil, &side
+	}
+	side.initialized = true
+	ret, side.dirty = this.get_store_dirty(fstore)
+	if ret != nil {
+		return ret, nil
+	}
+	ret, side.root_node = fstore.Get_root_node()
+	if ret != nil {
+		return ret, nil
+	}
+	ret, side.free_position = fstore.Get_free_position()
+	if ret != nil {
+		return ret, nil
+	}
+	ret, side.generation = read_store_generation(this.log, path)
+	if ret != nil {
+		return ret, nil
+	}
+	return nil, &side
+}
+
+func (this *Lbd_lib) get_mirror_state(device *Lbd_device, stree_block_size uint32) (tools.Ret, string) {
+	var ret, primary = this.make_primary_store(device, stree_block_size)
+	if ret != nil {
+		return ret, ""
+	}
+	var mirror Lbd_file_store
+	ret, mirror = this.make_mirror_store(device, stree_block_size)
+	if ret != nil {
+		return ret, ""
+	}
+
+	var p, m *mirror_side_header
+	ret, p = this.read_mirror_side_header(primary, device.Local_storage_file)
+	if ret != nil {
+		return ret, ""
+	}
+	ret, m = this.read_mirror_side_header(mirror, device.Mirror_storage_file)
+	if ret != nil {
+		return ret, ""
+	}
+
+	if m.initialized == false {
+		return nil, MIRROR_OUT_OF_DATE
+	}
+	if p.initialized == false {
+		return nil, MIRROR_PRIMARY_OUT_OF_DATE
+	}
+	if p.generation != m.generation {
+		if m.generation > p.generation {
+			return nil, MIRROR_PRIMARY_OUT_OF_DATE
+		}
+		return nil, MIRROR_OUT_OF_DATE
+	}
+	if p.root_node == m.root_node && p.free_position == m.free_position && p.dirty == false && m.dirty == false {
+		return nil, MIRROR_IN_SYNC
+	}
+	if p.dirty && m.dirty == false {
+		return nil, MIRROR_PRIMARY_OUT_OF_DATE
+	}
+	return nil, MIRROR_OUT_OF_DATE
+}
+
+func (this *Lbd_lib) storage_resync(cat *Catalog, device_name string, from_mirror bool, force bool) tools.Ret {
+	/* copy one side of a mirror over the other, the primary to the mirror unless from mirror.
+	   the device can't be running, we take the same locks it does. */
+	var ret, catentry = this.get_catalog_entry(cat, device_name)
+	if ret != nil {
+		if ret.Get_errcode() == int(syscall.ENOENT) {
+			return tools.Error(this.log, "device: ", device_name, " not found")
+		}
+		return ret
+	}
+	return this.storage_resync_device(this.New_block_device_from_catalog_entry(catentry), from_mirror, force)
+}
+
+func (this *Lbd_lib) storage_resync_device(device *Lbd_device, from_mirror bool, force bool) tools.Ret {
+	if len(device.Mirror_storage_file) == 0 {
+		return tools.Error(this.log, "device: ", device.Device_name, " doesn't have a mirror storage file")
+	}
+
+	var ret, lock, created = this.create_and_lock_backing_store(device)
+	if ret != nil {
+		return ret
+	}
+	var copied = false
+	defer func() {
+		this.unlock_backing_store(lock)
+		if copied == false {
+			this.remove_created_backing_files(created)
+		}
+	}()
+
+	var key_length, value_length, additional_nodes_per_block, key_type, value_type = this.get_init_size_values(device)
+	var block_size uint32
+	ret, block_size = stree_v_lib.Calculate_block_size(this.log, key_type, value_type, key_length, value_length, additional_nodes_per_block)
+	if ret != nil {
+		return ret
+	}
+
+	var state string
+	ret, state = this.get_mirror_state(device, block_size)
+	if ret != nil {
+		return ret
+	}
+	this.log.Info("mirror of device: ", device.Device_name, " is ", state)
+	if force == false {
+		if from_mirror == false && state == MIRROR_PRIMARY_OUT_OF_DATE {
+			return tools.Error(this.log, "the mirror: ", device.Mirror_storage_file, " is newer than the primary, ",
+				"did you mean --", TXT_FROM_MIRROR, "? add -f to copy the primary over it anyway.")
+		}
+		if from_mirror && state == MIRROR_OUT_OF_DATE {
+			return tools.Error(this.log, "the mirror: ", device.Mirror_storage_file, " is out of date, ",
+				"add -f to copy it over the primary anyway.")
+		}
+	}
+
+	var primary, mirror Lbd_file_store
+	ret, primary = this.make_primary_store(device, block_size)
+	if ret != nil {
+		return ret
+	}
+	ret, mirror = this.make_mirror_store(device, block_size)
+	if ret != nil {
+		return ret
+	}
+	var source, target = primary, mirror
+	var source_name, target_name = device.Local_storage_file, device.Mirror_storage_file
+	if from_mirror {
+		source, target = mirror, primary
+		source_name, target_name = target_name, source_name
+	}
+	ret = this.copy_backing_store(source, source_name, target, target_name, force)
+	if ret != nil {
+		return ret
+	}
+	copied = true
+	this.log.Info("backing storage: ", target_name, " is now a copy of: ", source_name)
+	return nil
+}
+
+func (this *Lbd_lib) copy_backing_store(source Lbd_file_store, source_name string, target Lbd_file_store, target_name string,
+	force bool) tools.Ret {
+	/* lay a new header on the target, copy every block up to the free position, and only then set the
+	   free position and root node. if anything goes wrong we leave the target open and dirty, so nobody
+	   mistakes a half copy for a good one. */
+	var ret = source.Open_datastore_readonly()
+	if ret != nil {
+		return ret
+	}
+	defer source.Shutdown()
+
+	ret = source.Load_header_and_check_magic(true)
+	if ret != nil {
+		return tools.Error(this.log, "unable to use backing storage: ", source_name, " as the source, error: ", ret.Get_errmsg())
+	}
+	var dirty bool
+	ret, dirty = this.get_store_dirty(source)
+	if ret != nil {
+		return ret
+	}
+	if dirty && force == false {
+		return tools.Error(this.log, "backing storage: ", source_name, " was not cleanly shut down, start and stop the ",
+			"device first, or add -f to copy it anyway.")
+	}
+	var generation uint64
+	ret, generation = read_store_generation(this.log, source_name)
+	if ret != nil {
+		return ret
+	}
+	var root_node, free_position uint32
+	ret, root_node = source.Get_root_node()
+	if ret != nil {
+		return ret
+	}
+	ret, free_position = source.Get_free_position()
+	if ret != nil {
+		return ret
+	}
+
+	ret = target.Init()
+	if ret != nil {
+		return ret
+	}
+	var total_blocks uint32
+	ret, total_blocks = target.Get_total_blocks()
+	if ret != nil {
+		return ret
+	}
+	if total_blocks < free_position {
+		return tools.Error(this.log, "backing storage: ", target_name, " can only hold ", tools.Prettylargenumber_uint64(uint64(total_blocks)),
+			" blocks, ", source_name, " is using ", tools.Prettylargenumber_uint64(uint64(free_position)))
+	}
+
+	this.log.Info("copying ", tools.Prettylargenumber_uint64(uint64(free_position-1)), " blocks from: ", source_name, " to: ", target_name)
+	var step = (free_position + RESYNC_PROGRESS_STEPS - 1) / RESYNC_PROGRESS_STEPS
+	for block_num := uint32(1); block_num < free_position; block_num++ {
+		var data []byte
+		ret, data = source.Read_raw_data(block_num)
+		if ret != nil {
+			return ret
+		}
+		ret = target.Store(block_num, &data)
+		if ret != nil {
+			return ret
+		}
+		if block_num%step == 0 {
+			this.log.Info("copied ", tools.Prettylargenumber_uint64(uint64(block_num)), " of ",
+				tools.Prettylargenumber_uint64(uint64(free_position-1)), " blocks")
+		}
+	}
+
+	if free_position > 1 {
+		ret, _ = target.Allocate(free_position - 1)
+		if ret != nil {
+			return ret
+		}
+	}
+	ret = target.Set_root_node(root_node)
+	if ret != nil {
+		return ret
+	}
+	ret = target.Shutdown()
+	if ret != nil {
+		return ret
+	}
+	/* and it's the same generation as the source now, so they come up in sync. */
+	return write_store_generation(this.log, target_name, generation)
+}
@@ -0,0 +1,952 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/nixomose/nixomosegotools/tools"
+	stree_v_interfaces "github.com/nixomose/stree_v/stree_v_lib/stree_v_interfaces"
+	"github.com/nixomose/stree_v/stree_v_lib/stree_v_lib"
+)
+
+/* the file store aligned that stree comes with only knows about one file. so if you want a device to
+   span a few nvme drives, or to be able to grow it later by adding another file, the catalog entry can
+	 have a storage layout, and a list of additional storage files to go with the local storage file.
+	 concat: the blocks fill up the first file, then the second and so on. you can add files to the end
+	         later with catalog add-storage, which is why you might want a concat store of only one file.
+	 stripe: block n goes on file n % number of files, so reads and writes get spread over all of them.
+	         every file holds the same number of blocks, so the smallest one sets the size, and you
+	         can't add to it later, that would mean moving every block.
+	 every file starts with a header block that says which store it belongs to and where it goes in
+	 the list, so if the catalog lists them in the wrong order, or one got swapped out, we find out
+	 at startup rather than by handing out somebody else's data. the first file's header block also
+	 has the regular stree store header in it (with a different magic number so the single file store
+	 won't go near it) and that's where the root node, free position and dirty flag live.
+	 files that live on the same filesystem split the 80% of it that a single file would get, block
+	 devices get all of themselves. a file added later gets the share it would have gotten if it had
+	 been there from the start, so a store grown on one filesystem is overcommitted the same way two
+	 devices on one filesystem are, that's what the capacity watermarks are for.
+	 this store doesn't truncate the files when blocks are freed off the end like the single file
+	 store does, so preallocated files stay preallocated. */
+
+const LBD_MULTI_FILE_STORE_MAGIC uint64 = 0x4c42444d554c5449  // LBDMULTI
+const LBD_MULTI_FILE_MEMBER_MAGIC uint64 = 0x4c42444d454d4252 // LBDMEMBR
+
+const STORAGE_LAYOUT_CONCAT = "concat"
+const STORAGE_LAYOUT_STRIPE = "stripe"
+
+var storage_layout_codes = map[string]uint32{STORAGE_LAYOUT_CONCAT: 1, STORAGE_LAYOUT_STRIPE: 2}
+
+/*
+the parts of a backing store that storage status, catalog status and the diag commands need,
+
+	which both the single file store and the multi file store have.
+*/
+type Lbd_file_store interface {
+	stree_v_interfaces.Stree_v_backing_store_interface
+	Open_datastore_readonly() tools.Ret
+	Load_header_and_check_magic(check_device_params bool) tools.Ret
+	Get_store_information() (tools.Ret, string)
+	Read_raw_data(block_num uint32) (tools.Ret, []byte)
+	Get_usable_storage_bytes(path string) (tools.Ret, uint64)
+}
+
+var _ Lbd_file_store = &stree_v_lib.File_store_aligned{}
+var _ Lbd_file_store = &Multi_file_store{}
+
+type multi_file_member_header struct {
+	M_magic        uint64
+	M_store_id     uint64 // random, the same in every file of a store
+	M_layout       uint32
+	M_member_index uint32
+	M_data_blocks  uint32 // how many blocks this file holds, not counting its header block
+}
+
+type multi_file_member struct {
+	path        string
+	datastore   *os.File
+	data_blocks uint32
+}
+
+type Multi_file_store struct {
+	log *tools.Nixomosetools_logger
+
+	layout             string
+	members            []*multi_file_member
+	block_size         uint32
+	nodes_per_block    uint32
+	alignment          uint32
+	aligned_block_size uint64
+	sync               bool
+
+	header   stree_v_lib.File_store_header
+	store_id uint64
+
+	iopath   stree_v_lib.File_store_io_path
+	sizer    func(path string) (tools.Ret, uint64) // how big a file or block device can get, without creating it
+	opened   bool
+	readonly bool
+}
+
+func New_multi_file_store(log *tools.Nixomosetools_logger, layout string, paths []string, block_size uint32,
+	alignment uint32, nodes_per_block uint32, sync bool, iopath stree_v_lib.File_store_io_path,
+	sizer func(path string) (tools.Ret, uint64)) *Multi_file_store {
+	var m Multi_file_store
+	m.log = log
+	m.layout = layout
+	m.members = make([]*multi_file_member, 0, len(paths))
+	for _, path := range paths {
+		m.members = append(m.members, &multi_file_member{path: path})
+	}
+	m.sync = sync
+	m.iopath = iopath
+	m.sizer = sizer
+	m.set_geometry(block_size, alignment, nodes_per_block)
+	return &m
+}
+
+func (this *Multi_file_store) set_geometry(block_size uint32, alignment uint32, nodes_per_block uint32) {
+	this.block_size = block_size
+	this.alignment = alignment
+	this.nodes_per_block = nodes_per_block
+	this.aligned_block_size = uint64(block_size)
+	if alignment > 0 {
+		this.aligned_block_size = (uint64(block_size) + uint64(alignment) - 1) / uint64(alignment) * uint64(alignment)
+	}
+}
+
+func (this *Multi_file_store) get_paths() []string {
+	var paths = make([]string, 0, len(this.members))
+	for _, member := range this.members {
+		paths = append(paths, member.path)
+	}
+	return paths
+}
+
+func is_block_device_path(path string) bool {
+	var info, err = os.Stat(path)
+	return err == nil && info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0
+}
+
+func get_filesystem_id(path string) uint64 {
+	var st syscall.Stat_t
+	if err := syscall.Stat(filepath.Dir(path), &st); err != nil {
+		return 0
+	}
+	return uint64(st.Dev)
+}
+
+func (this *Multi_file_store) calc_member_data_blocks(paths []string, others []string) (tools.Ret, []uint32) {
+	/* how many blocks each of these can hold after its header block. files on the same filesystem,
+	   counting the others already in the store, split it evenly. */
+	var sharing = make(map[uint64]uint64)
+	for _, path := range append(append([]string{}, paths...), others...) {
+		if is_block_device_path(path) == false {
+			sharing[get_filesystem_id(path)]++
+		}
+	}
+
+	var data_blocks = make([]uint32, 0, len(paths))
+	for _, path := range paths {
+		var ret, size = this.sizer(path)
+		if ret != nil {
+			return ret, nil
+		}
+		if is_block_device_path(path) == false {
+			size = size / sharing[get_filesystem_id(path)]
+		}
+		var blocks = size / this.aligned_block_size
+		if blocks < 2 {
+			return tools.ErrorWithCode(this.log, int(syscall.ENOSPC), "backing storage: ", path,
+				" doesn't have room for a header block and a data block"), nil
+		}
+		blocks-- // its header block
+		if blocks > math.MaxUint32 {
+			blocks = math.MaxUint32
+		}
+		data_blocks = append(data_blocks, uint32(blocks))
+	}
+
+	if this.layout == STORAGE_LAYOUT_STRIPE {
+		var smallest = data_blocks[0]
+		for _, blocks := range data_blocks {
+			if blocks < smallest {
+				smallest = blocks
+			}
+		}
+		for lp := range data_blocks {
+			data_blocks[lp] = smallest
+		}
+	}
+	return nil, data_blocks
+}
+
+func (this *Multi_file_store) get_total_data_blocks(data_blocks []uint32) uint32 {
+	/* the stree counts blocks in a uint32 and block zero is the header, so that's as far as we go. */
+	var total uint64 = 0
+	for _, blocks := range data_blocks {
+		total += uint64(blocks)
+	}
+	if total > math.MaxUint32-1 {
+		total = math.MaxUint32 - 1
+	}
+	return uint32(total)
+}
+
+func (this *Multi_file_store) Calc_total_blocks() (tools.Ret, uint64) {
+	/* how many blocks the store would have if we initialized it now, header block included. */
+	var ret, data_blocks = this.calc_member_data_blocks(this.get_paths(), nil)
+	if ret != nil {
+		return ret, 0
+	}
+	return nil, uint64(this.get_total_data_blocks(data_blocks)) + 1
+}
+
+func (this *Multi_file_store) Calc_member_extents(blocks uint64) (tools.Ret, []uint64) {
+	/* how many bytes of each file the first 'blocks' blocks of the store (header included) end up using.
+	   if it's already been laid out, what the headers say wins, otherwise what we'd lay out now. */
+	var data_blocks []uint32
+	if ret, blank := this.Is_backing_store_uninitialized(); ret == nil && blank == false && this.Open_datastore_readonly() == nil {
+		if this.Load_header_and_check_magic(false) == nil {
+			data_blocks = make([]uint32, 0, len(this.members))
+			for _, member := range this.members {
+				data_blocks = append(data_blocks, member.data_blocks)
+			}
+		}
+		this.Shutdown()
+	}
+	if data_blocks == nil {
+		var ret tools.Ret
+		ret, data_blocks = this.calc_member_data_blocks(this.get_paths(), nil)
+		if ret != nil {
+			return ret, nil
+		}
+	}
+	var remaining uint64 = 0
+	if blocks > 0 {
+		remaining = blocks - 1
+	}
+	var count = uint64(len(data_blocks))
+	var extents = make([]uint64, len(data_blocks))
+	for lp, capacity := range data_blocks {
+		var local uint64
+		if this.layout == STORAGE_LAYOUT_STRIPE {
+			if remaining > uint64(lp) {
+				local = (remaining - uint64(lp) + count - 1) / count
+			}
+		} else {
+			local = remaining
+		}
+		if local > uint64(capacity) {
+			local = uint64(capacity)
+		}
+		if this.layout != STORAGE_LAYOUT_STRIPE {
+			remaining -= local
+		}
+		extents[lp] = (local + 1) * this.aligned_block_size
+	}
+	return nil, extents
+}
+
+func (this *Multi_file_store) locate(block_num uint32) (tools.Ret, *multi_file_member, uint64) {
+	/* which file a block lives in and the byte offset in that file. */
+	if block_num == 0 {
+		return nil, this.members[0], 0
+	}
+	if block_num >= this.header.M_block_count {
+		return tools.Error(this.log, "block: ", block_num, " is past the end of the store, which has ",
+			this.header.M_block_count, " blocks"), nil, 0
+	}
+	var data_block = block_num - 1
+	if this.layout == STORAGE_LAYOUT_STRIPE {
+		var count = uint32(len(this.members))
+		return nil, this.members[data_block%count], (uint64(data_block/count) + 1) * this.aligned_block_size
+	}
+	for _, member := range this.members {
+		if data_block < member.data_blocks {
+			return nil, member, (uint64(data_block) + 1) * this.aligned_block_size
+		}
+		data_block -= member.data_blocks
+	}
+	return tools.Error(this.log, "block: ", block_num, " doesn't fall in any of the backing storage files"), nil, 0
+}
+
+func (this *Multi_file_store) serialize_header(include_store_header bool, member_index int) (tools.Ret, []byte) {
+	/* the first file gets the store header and its checksum, then everybody gets their member header and its checksum. */
+	var buf = &bytes.Buffer{}
+	if include_store_header {
+		var workarea = stree_v_lib.New_file_store_header_copy(&this.header)
+		if err := binary.Write(buf, binary.BigEndian, workarea); err != nil {
+			return tools.Error(this.log, "unable to serialize store header: ", err), nil
+		}
+		var m5 = md5.Sum(buf.Bytes())
+		buf.Write(m5[:])
+	}
+	var member_header = multi_file_member_header{
+		M_magic:        LBD_MULTI_FILE_MEMBER_MAGIC,
+		M_store_id:     this.store_id,
+		M_layout:       storage_layout_codes[this.layout],
+		M_member_index: uint32(member_index),
+		M_data_blocks:  this.members[member_index].data_blocks,
+	}
+	var start = buf.Len()
+	if err := binary.Write(buf, binary.BigEndian, member_header); err != nil {
+		return tools.Error(this.log, "unable to serialize member header: ", err), nil
+	}
+	var m5 = md5.Sum(buf.Bytes()[start:])
+	buf.Write(m5[:])
+	return nil, buf.Bytes()
+}
+
+func (this *Multi_file_store) get_header_length(include_store_header bool) int {
+	var member_header multi_file_member_header
+	var length = binary.Size(member_header) + md5.Size
+	if include_store_header {
+		length += int(this.header.Serialized_size()) + md5.Size
+	}
+	return length
+}
+
+func (this *Multi_file_store) write_member_header(member_index int, initting bool) tools.Ret {
+	var ret, data = this.serialize_header(member_index == 0, member_index)
+	if ret != nil {
+		return ret
+	}
+	var length = len(data)
+	if initting {
+		/* the first time, write out enough so the uninitialized check reads a whole block without EOF. */
+		length = tools.Maxint(stree_v_lib.CHECK_START_BLANK_BYTES, length)
+	}
+	var to_write = this.iopath.AllocBuffer(length)
+	copy(to_write, data)
+	var member = this.members[member_index]
+	var written, err = member.datastore.WriteAt(to_write, 0)
+	if err != nil {
+		return tools.Error(this.log, "error writing header to backing storage: ", member.path, " error: ", err)
+	}
+	if written != len(to_write) {
+		return tools.Error(this.log, "error writing header to backing storage: ", member.path, ", tried to write ",
+			len(to_write), " bytes, only wrote ", written)
+	}
+	return nil
+}
+
+func (this *Multi_file_store) write_header_to_disk() tools.Ret {
+	/* only the first file has anything that changes after init. */
+	return this.write_member_header(0, false)
+}
+
+func (this *Multi_file_store) read_member_header(member_index int) (tools.Ret, *multi_file_member_header) {
+	var member = this.members[member_index]
+	var include_store_header = member_index == 0
+	var length = this.get_header_length(include_store_header)
+	var data = this.iopath.AllocBuffer(length)
+	var _, err = member.datastore.ReadAt(data, 0)
+	if err != nil && errors.Is(err, io.EOF) == false {
+		return tools.Error(this.log, "error reading header from backing storage: ", member.path, " error: ", err), nil
+	}
+	data = data[:length]
+
+	if include_store_header {
+		if binary.BigEndian.Uint64(data) == LBD_MULTI_FILE_MEMBER_MAGIC {
+			return tools.Error(this.log, "backing storage: ", member.path, " is listed first but it isn't the first file of its store"), nil
+		}
+		var size = int(this.header.Serialized_size())
+		var header_data = data[:size]
+		var m5 = md5.Sum(header_data)
+		if bytes.Equal(m5[:], data[size:size+md5.Size]) == false {
+			return tools.Error(this.log, "unable to read header from backing storage: ", member.path, ", hash check failed"), nil
+		}
+		var ret = this.header.Deserialize(this.log, &header_data)
+		if ret != nil {
+			return ret, nil
+		}
+		if this.header.M_magic != LBD_MULTI_FILE_STORE_MAGIC {
+			return tools.Error(this.log, "magic number doesn't match in backing storage: ", member.path), nil
+		}
+		data = data[size+md5.Size:]
+	}
+
+	var member_header multi_file_member_header
+	var size = binary.Size(member_header)
+	var m5 = md5.Sum(data[:size])
+	if bytes.Equal(m5[:], data[size:size+md5.Size]) == false {
+		return tools.Error(this.log, "unable to read member header from backing storage: ", member.path, ", hash check failed"), nil
+	}
+	if err = binary.Read(bytes.NewReader(data[:size]), binary.BigEndian, &member_header); err != nil {
+		return tools.Error(this.log, "unable to deserialize member header from backing storage: ", member.path, " error: ", err), nil
+	}
+	if member_header.M_magic != LBD_MULTI_FILE_MEMBER_MAGIC {
+		return tools.Error(this.log, "member magic number doesn't match in backing storage: ", member.path), nil
+	}
+	return nil, &member_header
+}
+
+func (this *Multi_file_store) open_members(flags int) tools.Ret {
+	if this.opened {
+		return tools.Error(this.log, "physical store already opened")
+	}
+	for _, member := range this.members {
+		var err error
+		member.datastore, err = this.iopath.OpenFile(member.path, flags, stree_v_lib.STREE_FILEMODE)
+		if err != nil {
+			member.datastore = nil
+			this.close_members()
+			return tools.Error(this.log, "Unable to open physical store: ", member.path, " error: ", err)
+		}
+	}
+	this.opened = true
+	this.readonly = flags&(os.O_WRONLY|os.O_RDWR) == 0
+	return nil
+}
+
+func (this *Multi_file_store) close_members() tools.Ret {
+	var ret tools.Ret = nil
+	for _, member := range this.members {
+		if member.datastore == nil {
+			continue
+		}
+		if err := member.datastore.Close(); err != nil && ret == nil {
+			ret = tools.Error(this.log, "Unable to close datastore: ", member.path, " error: ", err)
+		}
+		member.datastore = nil
+	}
+	this.opened = false
+	return ret
+}
+
+func (this *Multi_file_store) Open_datastore_readonly() tools.Ret {
+	/* like the single file store, a file that isn't there is ENOENT and the caller works out what that means. */
+	for _, member := range this.members {
+		var ret, found = tools.File_exists(this.log, member.path)
+		if ret != nil {
+			return ret
+		}
+		if found == false {
+			return tools.ErrorWithCodeNoLog(this.log, int(syscall.ENOENT), "file does not exist: ", member.path)
+		}
+	}
+	return this.open_members(os.O_RDONLY)
+}
+
+func (this *Multi_file_store) open_datastore() tools.Ret {
+	var flags = os.O_RDWR
+	if this.sync {
+		flags |= os.O_SYNC
+	}
+	return this.open_members(flags)
+}
+
+func (this *Multi_file_store) Is_backing_store_uninitialized() (tools.Ret, bool) {
+	/* it's only uninitialized if every file is, a file that isn't there yet counts. */
+	for _, member := range this.members {
+		var fh, err = this.iopath.OpenFile(member.path, os.O_RDONLY, stree_v_lib.STREE_FILEMODE)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return tools.Error(this.log, "Unable to open physical store: ", member.path, " error: ", err), false
+		}
+		var data = this.iopath.AllocBuffer(stree_v_lib.CHECK_START_BLANK_BYTES)
+		var bytes_read int
+		bytes_read, err = fh.ReadAt(data, 0)
+		fh.Close()
+		if err != nil && errors.Is(err, io.EOF) == false {
+			return tools.Error(this.log, "Error reading from header block of: ", member.path, " error: ", err), false
+		}
+		for lp := 0; lp < bytes_read && lp < stree_v_lib.CHECK_START_BLANK_BYTES; lp++ {
+			if data[lp] != 0 {
+				return nil, false
+			}
+		}
+	}
+	return nil, true
+}
+
+func (this *Multi_file_store) Init() tools.Ret {
+	this.log.Info(strings.Join(this.get_paths(), ", "), " will be formatted as a ", this.layout, " stree store.")
+
+	var ret, data_blocks = this.calc_member_data_blocks(this.get_paths(), nil)
+	if ret != nil {
+		return ret
+	}
+	if this.get_header_length(true) > int(this.block_size) {
+		return tools.Error(this.log, "block size: ", this.block_size, " is too small to hold the store header of ",
+			this.get_header_length(true), " bytes")
+	}
+
+	var id = make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return tools.Error(this.log, "unable to make a store id, err: ", err)
+	}
+	this.store_id = binary.BigEndian.Uint64(id)
+
+	var store_size uint64 = 0
+	for lp, member := range this.members {
+		member.data_blocks = data_blocks[lp]
+		store_size += (uint64(member.data_blocks) + 1) * this.aligned_block_size
+	}
+
+	this.header.M_magic = LBD_MULTI_FILE_STORE_MAGIC
+	this.header.M_store_size_in_bytes = store_size
+	this.header.M_nodes_per_block = this.nodes_per_block
+	this.header.M_block_size = this.block_size
+	this.header.M_block_count = this.get_total_data_blocks(data_blocks) + 1
+	this.header.M_root_node = 0
+	this.header.M_free_position = 1
+	this.header.M_alignment = this.alignment
+	this.header.M_dirty = 1
+
+	var json string
+	ret, json = this.Get_store_information()
+	if ret != nil {
+		return ret
+	}
+	this.log.Info(json)
+
+	ret = this.open_members(os.O_RDWR | os.O_CREATE) // caller of init closes this.
+	if ret != nil {
+		return ret
+	}
+	/* the first file last, so if we die part way through, the store still reads as uninitialized. */
+	for lp := len(this.members) - 1; lp >= 0; lp-- {
+		ret = this.write_member_header(lp, true)
+		if ret != nil {
+			return ret
+		}
+	}
+	return nil
+}
+
+func (this *Multi_file_store) Load_header_and_check_magic(check_device_params bool) tools.Ret {
+	/* read every file's header and make sure they're all from the same store and in the right order. */
+	var ret, first = this.read_member_header(0)
+	if ret != nil {
+		return ret
+	}
+	this.store_id = first.M_store_id
+
+	if check_device_params {
+		if this.header.M_block_size != this.block_size {
+			return tools.Error(this.log, "block size stored in backing storage ", this.header.M_block_size,
+				" doesn't match initial block size ", this.block_size)
+		}
+		if this.header.M_nodes_per_block != this.nodes_per_block {
+			return tools.Error(this.log, "nodes per block stored in backing storage ", this.header.M_nodes_per_block,
+				" doesn't match initial nodes per block ", this.nodes_per_block)
+		}
+		if this.header.M_alignment != this.alignment {
+			return tools.Error(this.log, "alignment ", this.header.M_alignment, " doesn't match initial alignment ", this.alignment)
+		}
+	} else {
+		/* same as the single file store, when we're just looking, what's on disk wins. */
+		this.set_geometry(this.header.M_block_size, this.header.M_alignment, this.header.M_nodes_per_block)
+	}
+
+	var data_blocks = make([]uint32, len(this.members))
+	for lp, member := range this.members {
+		var member_header = first
+		if lp > 0 {
+			ret, member_header = this.read_member_header(lp)
+			if ret != nil {
+				return ret
+			}
+		}
+		if member_header.M_store_id != this.store_id {
+			return tools.Error(this.log, "backing storage: ", member.path, " belongs to a different store than ", this.members[0].path)
+		}
+		if member_header.M_member_index != uint32(lp) {
+			return tools.Error(this.log, "backing storage: ", member.path, " is file ", member_header.M_member_index+1,
+				" of its store, but it's listed as file ", lp+1)
+		}
+		if member_header.M_layout != storage_layout_codes[this.layout] {
+			return tools.Error(this.log, "backing storage: ", member.path, " was not made with a ", this.layout, " storage layout")
+		}
+		member.data_blocks = member_header.M_data_blocks
+		data_blocks[lp] = member.data_blocks
+	}
+
+	if this.get_total_data_blocks(data_blocks)+1 != this.header.M_block_count {
+		return tools.Error(this.log, "the backing storage files hold ", this.get_total_data_blocks(data_blocks)+1,
+			" blocks but the store header says there should be ", this.header.M_block_count, ", is a file missing?")
+	}
+	return nil
+}
+
+func (this *Multi_file_store) Startup(force bool) tools.Ret {
+	var ret = this.open_datastore()
+	if ret != nil {
+		return ret
+	}
+	ret = this.Load_header_and_check_magic(true)
+	if ret != nil {
+		this.close_members()
+		return ret
+	}
+	if this.header.M_dirty != 0 {
+		if force == false {
+			this.close_members()
+			return tools.Error(this.log, "backing store was not cleanly shut down. add -f to force starting up anyawy.")
+		}
+		this.log.Info("backing store was not cleanly shut down, forcing startup anyway, data may be corrupt.")
+	}
+	this.header.M_dirty = 1
+	return this.write_header_to_disk()
+}
+
+func (this *Multi_file_store) Shutdown() tools.Ret {
+	if this.opened == false {
+		return tools.Error(this.log, "not initialized or already shut down.")
+	}
+	if this.readonly == false {
+		this.header.M_dirty = 0
+		var ret = this.write_header_to_disk()
+		if ret != nil {
+			return ret
+		}
+	}
+	return this.close_members()
+}
+
+func (this *Multi_file_store) read_block(block_num uint32, length uint32) (tools.Ret, []byte) {
+	var ret, member, offset = this.locate(block_num)
+	if ret != nil {
+		return ret, nil
+	}
+	var data = this.iopath.AllocBuffer(int(length))
+	var bytes_read, err = member.datastore.ReadAt(data, int64(offset))
+	if err != nil {
+		/* off the end of a file that hasn't been written that far yet, that's zeroes. */
+		if errors.Is(err, io.EOF) == false {
+			return tools.Error(this.log, "Error reading from data store: ", member.path, " at position ", offset,
+				" length ", length, " error: ", err), nil
+		}
+		for lp := bytes_read; lp < len(data); lp++ {
+			data[lp] = 0
+		}
+	}
+	return nil, data[:length]
+}
+
+func (this *Multi_file_store) Read_raw_data(block_num uint32) (tools.Ret, []byte) {
+	return this.read_block(block_num, this.block_size)
+}
+
+func (this *Multi_file_store) Load(block_num uint32) (tools.Ret, *[]byte) {
+	var ret, data = this.read_block(block_num, this.block_size)
+	if ret != nil {
+		return ret, nil
+	}
+	return nil, &data
+}
+
+func (this *Multi_file_store) Load_limit(block_num uint32, length uint32) (tools.Ret, *[]byte) {
+	var ret, data = this.read_block(block_num, length)
+	if ret != nil {
+		return ret, nil
+	}
+	return nil, &data
+}
+
+func (this *Multi_file_store) Store(block_num uint32, data *[]byte) tools.Ret {
+	if len(*data) > int(this.header.M_block_size) {
+		return tools.Error(this.log, "store asked to write ", len(*data), " bytes but the block size is only ", this.header.M_block_size)
+	}
+	if block_num == 0 {
+		return tools.Error(this.log, "store asked to write over the header block")
+	}
+	var ret, member, offset = this.locate(block_num)
+	if ret != nil {
+		return ret
+	}
+	var to_write = this.iopath.AllocBuffer(len(*data))
+	copy(to_write, *data)
+	var written, err = member.datastore.WriteAt(to_write, int64(offset))
+	if err != nil {
+		return tools.Error(this.log, "Error writing to data store: ", member.path, " at position ", offset,
+			" length ", len(to_write), " error: ", err)
+	}
+	if written != len(to_write) {
+		return tools.Error(this.log, "Error writing to data store: ", member.path, ", tried to write ", len(to_write),
+			" bytes, only wrote ", written)
+	}
+	return nil
+}
+
+func (this *Multi_file_store) Get_root_node() (tools.Ret, uint32) {
+	return nil, this.header.M_root_node
+}
+
+func (this *Multi_file_store) Set_root_node(block_num uint32) tools.Ret {
+	this.header.M_root_node = block_num
+	return this.write_header_to_disk()
+}
+
+func (this *Multi_file_store) Get_free_position() (tools.Ret, uint32) {
+	return nil, this.header.M_free_position
+}
+
+func (this *Multi_file_store) Get_total_blocks() (tools.Ret, uint32) {
+	return nil, this.header.M_block_count
+}
+
+func (this *Multi_file_store) Allocate(amount uint32) (tools.Ret, []uint32) {
+	if uint64(this.header.M_free_position)+uint64(amount) > uint64(this.header.M_block_count) {
+		return tools.Error(this.log, "Not enough space available to allocate ", amount, " blocks."), nil
+	}
+	var rvals = make([]uint32, amount)
+	for lp := uint32(0); lp < amount; lp++ {
+		rvals[lp] = this.header.M_free_position
+		this.header.M_free_position++
+	}
+	var ret = this.write_header_to_disk()
+	if ret != nil {
+		return ret, nil
+	}
+	return nil, rvals
+}
+
+func (this *Multi_file_store) Deallocate() tools.Ret {
+	this.header.M_free_position--
+	return this.write_header_to_disk()
+}
+
+func (this *Multi_file_store) Wipe() tools.Ret {
+	/* zero the header block of every file, so they can all be used again. */
+	if this.opened == false {
+		return tools.Error(this.log, "Can't wipe stree multi file store, filestore is shut down or not started.")
+	}
+	var zeros = this.iopath.AllocBuffer(stree_v_lib.CHECK_START_BLANK_BYTES)
+	for _, member := range this.members {
+		this.log.Info("wiping stree backing file store: ", member.path)
+		if _, err := member.datastore.WriteAt(zeros, 0); err != nil {
+			return tools.Error(this.log, "error trying to wipe: ", member.path, " error: ", err)
+		}
+	}
+	return nil
+}
+
+func (this *Multi_file_store) Dispose() tools.Ret {
+	if this.opened {
+		return tools.Error(this.log, "Can't dispose of stree multi file store, filestore not shut down.")
+	}
+	for _, member := range this.members {
+		if is_block_device_path(member.path) {
+			this.log.Info("backing store: ", member.path, " is a block device, nothing to delete.")
+			continue
+		}
+		this.log.Info("deleting stree backing file store: ", member.path)
+		if err := os.Remove(member.path); err != nil {
+			return tools.Error(this.log, "error trying to delete: ", member.path, " error: ", err)
+		}
+	}
+	return nil
+}
+
+func (this *Multi_file_store) Get_usable_storage_bytes(path string) (tools.Ret, uint64) {
+	/* all of the files put together, whichever one you ask about. */
+	if this.header.M_store_size_in_bytes == 0 {
+		return tools.Error(this.log, "multi file store header has not been loaded"), 0
+	}
+	return nil, this.header.M_store_size_in_bytes
+}
+
+func (this *Multi_file_store) Get_store_information() (tools.Ret, string) {
+	if this.header.M_store_size_in_bytes == 0 {
+		return tools.Error(this.log, "invalid file store parameters, store size is zero."), "{}"
+	}
+	var m = make(map[string]string)
+	m["backing_storage"] = strings.Join(this.get_paths(), ", ")
+	m["storage_layout"] = this.layout
+	m["store_size_in_bytes"] = tools.Prettylargenumber_uint64(this.header.M_store_size_in_bytes)
+	m["nodes_per_block"] = tools.Prettylargenumber_uint64(uint64(this.header.M_nodes_per_block))
+	m["block_size_in_bytes"] = tools.Prettylargenumber_uint64(uint64(this.header.M_block_size))
+	m["number_of_blocks_available_in_backing_store"] = tools.Prettylargenumber_uint64(uint64(this.header.M_block_count))
+	m["physical_store_block_alignment"] = tools.Prettylargenumber_uint64(uint64(this.header.M_alignment))
+	m["number_of_physical_bytes_used_for_a_block"] = tools.Prettylargenumber_uint64(this.aligned_block_size)
+	m["dirty"] = tools.Prettylargenumber_uint64(uint64(this.header.M_dirty))
+	for lp, member := range this.members {
+		m["file_"+tools.Inttostring(lp+1)] = member.path + " blocks: " + tools.Prettylargenumber_uint64(uint64(member.data_blocks))
+	}
+	var bytesout, err = json.MarshalIndent(m, "", " ")
+	if err != nil {
+		return tools.Error(this.log, "unable to marshal backing store information into json"), "{}"
+	}
+	return nil, string(bytesout)
+}
+
+func (this *Multi_file_store) Add_member(path string) tools.Ret {
+	/* add a file to the end of a concat store that's been started up, its blocks go on the end. */
+	if this.layout != STORAGE_LAYOUT_CONCAT {
+		return tools.Error(this.log, "only a ", STORAGE_LAYOUT_CONCAT, " store can have files added to it, a ",
+			this.layout, " store would have to move every block")
+	}
+	if this.opened == false || this.readonly {
+		return tools.Error(this.log, "the store has to be started to add a file to it")
+	}
+
+	var ret, data_blocks = this.calc_member_data_blocks([]string{path}, this.get_paths())
+	if ret != nil {
+		return ret
+	}
+	var total = uint64(this.header.M_block_count) + uint64(data_blocks[0])
+	if total > math.MaxUint32 {
+		return tools.Error(this.log, "the store already has as many blocks as it can address")
+	}
+
+	var member = &multi_file_member{path: path, data_blocks: data_blocks[0]}
+	var err error
+	member.datastore, err = this.iopath.OpenFile(path, os.O_RDWR|os.O_CREATE, stree_v_lib.STREE_FILEMODE)
+	if err != nil {
+		return tools.Error(this.log, "Unable to open physical store: ", path, " error: ", err)
+	}
+	this.members = append(this.members, member)
+	ret = this.write_member_header(len(this.members)-1, true)
+	if ret != nil {
+		member.datastore.Close()
+		this.members = this.members[:len(this.members)-1]
+		return ret
+	}
+
+	/* if the header doesn't make it out, put it back, or shutdown would write it out for us. */
+	var old_header = this.header
+	this.header.M_block_count = uint32(total)
+	this.header.M_store_size_in_bytes += (uint64(member.data_blocks) + 1) * this.aligned_block_size
+	ret = this.write_header_to_disk()
+	if ret != nil {
+		this.header = old_header
+		member.datastore.Close()
+		this.members = this.members[:len(this.members)-1]
+		return ret
+	}
+	this.log.Info("added ", path, " with ", tools.Prettylargenumber_uint64(uint64(member.data_blocks)),
+		" blocks, the store now has ", tools.Prettylargenumber_uint64(total), " blocks")
+	return nil
+}
+
+func (this *Lbd_lib) catalog_add_storage(cat *Catalog, device_name string, storage_file string) tools.Ret {
+	/* grow a concat device by a file. the handler holds the lock on the files while it's running, so
+	   if we can get them, it's not, and nobody's going to start it while we're in here. */
+	var ret = this.catalog.Read_catalog(cat)
+	if ret != nil {
+		return ret
+	}
+	var catentry = this.find_catalog_entry(cat, device_name)
+	if catentry == nil {
+		return tools.Error(this.log, "device ", device_name, " not found")
+	}
+	var device = this.New_block_device_from_catalog_entry(catentry)
+	if device.Storage_layout != STORAGE_LAYOUT_CONCAT {
+		return tools.Error(this.log, "device: ", device.Device_name, " does not have a ", STORAGE_LAYOUT_CONCAT,
+			" storage layout, only those can have backing storage added to them")
+	}
+	if problem := this.validate_storage_file(storage_file); len(problem) > 0 {
+		return tools.ErrorWithCode(this.log, int(syscall.EINVAL), problem)
+	}
+	var resolved = this.resolve_storage_path(storage_file)
+	for _, existing := range this.get_storage_files(device) {
+		if this.resolve_storage_path(existing) == resolved {
+			return tools.ErrorWithCode(this.log, int(syscall.EBUSY), "backing storage: ", storage_file,
+				" is already part of device: ", device.Device_name)
+		}
+	}
+
+	var grown = this.New_block_device_from_catalog_entry(catentry)
+	grown.Additional_storage_files = append(append([]string{}, device.Additional_storage_files...), storage_file)
+	ret = this.check_storage_in_use(cat, grown)
+	if ret != nil {
+		return ret
+	}
+	var locks []*os.File
+	var created []string
+	ret, locks, created = this.create_and_lock_backing_store(grown)
+	if ret != nil {
+		return ret
+	}
+	var added = false
+	defer func() {
+		this.unlock_backing_store(locks)
+		if added == false {
+			this.remove_created_backing_files(created)
+		}
+	}()
+
+	var key_length, value_length, additional_nodes_per_block, key_type, value_type = this.get_init_size_values(device)
+	var block_size uint32
+	ret, block_size = stree_v_lib.Calculate_block_size(this.log, key_type, value_type, key_length, value_length, additional_nodes_per_block)
+	if ret != nil {
+		return ret
+	}
+	block_size = this.get_store_block_size(device, block_size)
+
+	/* same rule as catalog add, we don't write over anything that has something in it. */
+	var newcomer = New_multi_file_store(this.log, device.Storage_layout, []string{storage_file}, block_size, 0,
+		device.Additional_nodes_per_block, false, this.get_file_store_io_path(device), this.get_backing_store_size)
+	var blank bool
+	ret, blank = newcomer.Is_backing_store_uninitialized()
+	if ret != nil {
+		return ret
+	}
+	if blank == false {
+		return tools.Error(this.log, "can not add backing storage: ", storage_file, ", it contains data.")
+	}
+
+	/* the catalog goes first. if we can't write it, nothing's changed, and if we can't add the file
+	   to the store after that, we put the catalog back. the other way around, a catalog we couldn't
+		 write would leave the store with a file in it the catalog doesn't know about. */
+	var old_storage_files = catentry.Additional_storage_files
+	catentry.Additional_storage_files = grown.Additional_storage_files
+	ret = cat.Write_catalog()
+	if ret != nil {
+		catentry.Additional_storage_files = old_storage_files
+		return ret
+	}
+	var rollback = func() {
+		catentry.Additional_storage_files = old_storage_files
+		var ret = cat.Write_catalog()
+		if ret != nil {
+			this.log.Error("unable to take backing storage: ", storage_file, " back out of the catalog entry for device: ",
+				device.Device_name, ", it has to be removed by hand, error: ", ret.Get_errmsg())
+		}
+	}
+
+	var mstore *Multi_file_store
+	ret, mstore = this.make_multi_file_store(device, block_size)
+	if ret != nil {
+		rollback()
+		return ret
+	}
+	ret = mstore.Startup(false)
+	if ret != nil {
+		rollback()
+		return ret
+	}
+	ret = mstore.Add_member(storage_file)
+	var shutdown_ret = mstore.Shutdown()
+	if ret != nil {
+		rollback()
+		return ret
+	}
+	added = true
+	if shutdown_ret != nil {
+		return shutdown_ret // the file made it into the store, so it stays in the catalog
+	}
+
+	if ret = this.allocate_backing_store(grown); ret != nil {
+		this.log.Info("WARNING unable to ", grown.Allocation, " backing storage: ", storage_file, ", err: ", ret.Get_errmsg())
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nixomose/nixomosegotools/tools"
+	"github.com/nixomose/stree_v/stree_v_lib/stree_v_lib"
+)
+
+const TEST_BLOCK_SIZE = 4096
+
+/* all the files of a test store are in the same temp directory, so calc_member_data_blocks splits
+   whatever the sizer says between all of them. paths takes how many blocks each file should get,
+	 header block included, and sets the sizer up to hand back enough for exactly that many. */
+
+type test_multi_store struct {
+	t     *testing.T
+	log   *tools.Nixomosetools_logger
+	dir   string
+	sizes map[string]uint64
+}
+
+func new_test_multi_store(t *testing.T) *test_multi_store {
+	var ret test_multi_store
+	ret.t = t
+	ret.log = tools.New_Nixomosetools_logger(tools.ERROR)
+	ret.dir = t.TempDir()
+	ret.sizes = make(map[string]uint64)
+	return &ret
+}
+
+func (this *test_multi_store) paths(blocks []uint64, names ...string) []string {
+	var paths = make([]string, 0, len(names))
+	for lp, name := range names {
+		var path = filepath.Join(this.dir, name)
+		this.sizes[path] = blocks[lp] * TEST_BLOCK_SIZE * uint64(len(names))
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func (this *test_multi_store) sizer(path string) (tools.Ret, uint64) {
+	var size, ok = this.sizes[path]
+	if ok == false {
+		return tools.Error(this.log, "test has no size for: ", path), 0
+	}
+	return nil, size
+}
+
+func (this *test_multi_store) make_store(layout string, paths []string) *Multi_file_store {
+	return New_multi_file_store(this.log, layout, paths, TEST_BLOCK_SIZE, TEST_BLOCK_SIZE, 0, false,
+		stree_v_lib.New_file_store_io_path_default(), this.sizer)
+}
+
+func (this *test_multi_store) init_store(layout string, paths []string) *Multi_file_store {
+	var store = this.make_store(layout, paths)
+	var ret = store.Init()
+	if ret != nil {
+		this.t.Fatalf("init failed: %s", ret.Get_errmsg())
+	}
+	ret = store.Shutdown()
+	if ret != nil {
+		this.t.Fatalf("shutdown after init failed: %s", ret.Get_errmsg())
+	}
+	return store
+}
+
+func (this *test_multi_store) start_store(layout string, paths []string) *Multi_file_store {
+	var store = this.make_store(layout, paths)
+	var ret = store.Startup(false)
+	if ret != nil {
+		this.t.Fatalf("startup failed: %s", ret.Get_errmsg())
+	}
+	return store
+}
+
+func expect_error_containing(t *testing.T, ret tools.Ret, want string) {
+	t.Helper()
+	if ret == nil {
+		t.Fatalf("expected an error containing %q, got none", want)
+	}
+	if strings.Contains(ret.Get_errmsg(), want) == false {
+		t.Fatalf("expected an error containing %q, got %q", want, ret.Get_errmsg())
+	}
+}
+
+type locate_case struct {
+	block_num uint32
+	member    int
+	offset    uint64
+}
+
+func check_locate(t *testing.T, store *Multi_file_store, cases []locate_case) {
+	t.Helper()
+	for _, c := range cases {
+		var ret, member, offset = store.locate(c.block_num)
+		if ret != nil {
+			t.Fatalf("locate %d failed: %s", c.block_num, ret.Get_errmsg())
+		}
+		if member != store.members[c.member] || offset != c.offset {
+			var got = -1
+			for lp := range store.members {
+				if store.members[lp] == member {
+					got = lp
+				}
+			}
+			t.Fatalf("locate %d: expected file %d offset %d, got file %d offset %d", c.block_num, c.member, c.offset, got, offset)
+		}
+	}
+}
+
+func TestMultiFileStoreLocateConcat(t *testing.T) {
+	var ts = new_test_multi_store(t)
+	var paths = ts.paths([]uint64{5, 3, 7}, "a", "b", "c")
+	ts.init_store(STORAGE_LAYOUT_CONCAT, paths)
+	var store = ts.start_store(STORAGE_LAYOUT_CONCAT, paths)
+	defer store.Shutdown()
+
+	var ret, total = store.Get_total_blocks()
+	if ret != nil || total != 1+4+2+6 {
+		t.Fatalf("expected %d blocks, got %d", 1+4+2+6, total)
+	}
+	check_locate(t, store, []locate_case{
+		{0, 0, 0},
+		{1, 0, 1 * TEST_BLOCK_SIZE},
+		{4, 0, 4 * TEST_BLOCK_SIZE},
+		{5, 1, 1 * TEST_BLOCK_SIZE},
+		{6, 1, 2 * TEST_BLOCK_SIZE},
+		{7, 2, 1 * TEST_BLOCK_SIZE},
+		{12, 2, 6 * TEST_BLOCK_SIZE},
+	})
+	ret, _, _ = store.locate(13)
+	expect_error_containing(t, ret, "past the end of the store")
+}
+
+func TestMultiFileStoreLocateStripe(t *testing.T) {
+	var ts = new_test_multi_store(t)
+	var paths = ts.paths([]uint64{5, 3, 7}, "a", "b", "c")
+	ts.init_store(STORAGE_LAYOUT_STRIPE, paths)
+	var store = ts.start_store(STORAGE_LAYOUT_STRIPE, paths)
+	defer store.Shutdown()
+
+	/* a stripe only gets as much of each file as the smallest one has. */
+	var ret, total = store.Get_total_blocks()
+	if ret != nil || total != 1+3*2 {
+		t.Fatalf("expected %d blocks, got %d", 1+3*2, total)
+	}
+	check_locate(t, store, []locate_case{
+		{0, 0, 0},
+		{1, 0, 1 * TEST_BLOCK_SIZE},
+		{2, 1, 1 * TEST_BLOCK_SIZE},
+		{3, 2, 1 * TEST_BLOCK_SIZE},
+		{4, 0, 2 * TEST_BLOCK_SIZE},
+		{6, 2, 2 * TEST_BLOCK_SIZE},
+	})
+	ret, _, _ = store.locate(7)
+	expect_error_containing(t, ret, "past the end of the store")
+}
+
+func TestMultiFileStoreBlocksLandWhereLocateSays(t *testing.T) {
+	var ts = new_test_multi_store(t)
+	var paths = ts.paths([]uint64{3, 4}, "a", "b")
+	ts.init_store(STORAGE_LAYOUT_CONCAT, paths)
+	var store = ts.start_store(STORAGE_LAYOUT_CONCAT, paths)
+
+	var ret, total = store.Get_total_blocks()
+	if ret != nil {
+		t.Fatal(ret.Get_errmsg())
+	}
+	for block_num := uint32(1); block_num < total; block_num++ {
+		var data = bytes.Repeat([]byte{byte(block_num)}, TEST_BLOCK_SIZE)
+		ret = store.Store(block_num, &data)
+		if ret != nil {
+			t.Fatalf("store %d failed: %s", block_num, ret.Get_errmsg())
+		}
+	}
+	ret = store.Shutdown()
+	if ret != nil {
+		t.Fatal(ret.Get_errmsg())
+	}
+
+	/* block 3 is the last one in the first file, block 4 is the first one in the second. */
+	var expect = map[string]map[int64]byte{
+		paths[0]: {1 * TEST_BLOCK_SIZE: 1, 2 * TEST_BLOCK_SIZE: 2},
+		paths[1]: {1 * TEST_BLOCK_SIZE: 3, 2 * TEST_BLOCK_SIZE: 4, 3 * TEST_BLOCK_SIZE: 5},
+	}
+	for path, offsets := range expect {
+		var contents, err = os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for offset, value := range offsets {
+			if contents[offset] != value {
+				t.Fatalf("%s at offset %d: expected block %d, got %d", path, offset, value, contents[offset])
+			}
+		}
+	}
+}
+
+func TestMultiFileStoreHeaderMismatch(t *testing.T) {
+	var ts = new_test_multi_store(t)
+	var paths = ts.paths([]uint64{3, 3, 3}, "a", "b", "c")
+	ts.init_store(STORAGE_LAYOUT_CONCAT, paths)
+	var others = ts.paths([]uint64{3, 3, 3}, "x", "y", "z")
+	ts.init_store(STORAGE_LAYOUT_CONCAT, others)
+
+	var cases = []struct {
+		name   string
+		layout string
+		paths  []string
+		want   string
+	}{
+		{"first file moved", STORAGE_LAYOUT_CONCAT, []string{paths[1], paths[0], paths[2]}, "isn't the first file of its store"},
+		{"files swapped", STORAGE_LAYOUT_CONCAT, []string{paths[0], paths[2], paths[1]}, "is file 3 of its store, but it's listed as file 2"},
+		{"file from another store", STORAGE_LAYOUT_CONCAT, []string{paths[0], others[1], paths[2]}, "belongs to a different store"},
+		{"file missing", STORAGE_LAYOUT_CONCAT, []string{paths[0], paths[1]}, "is a file missing?"},
+		{"wrong layout", STORAGE_LAYOUT_STRIPE, paths, "was not made with a stripe storage layout"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var store = ts.make_store(c.layout, c.paths)
+			var ret = store.Startup(false)
+			if ret == nil {
+				store.Shutdown()
+			}
+			expect_error_containing(t, ret, c.want)
+		})
+	}
+
+	/* and none of that should have hurt the real thing. */
+	var store = ts.start_store(STORAGE_LAYOUT_CONCAT, paths)
+	var ret = store.Shutdown()
+	if ret != nil {
+		t.Fatal(ret.Get_errmsg())
+	}
+}
+
+func TestMultiFileStoreAddMember(t *testing.T) {
+	var ts = new_test_multi_store(t)
+	var paths = ts.paths([]uint64{3, 3, 5}, "a", "b", "c")
+	ts.init_store(STORAGE_LAYOUT_CONCAT, paths[:2])
+
+	var store = ts.make_store(STORAGE_LAYOUT_CONCAT, paths[:2])
+	expect_error_containing(t, store.Add_member(paths[2]), "has to be started")
+
+	store = ts.start_store(STORAGE_LAYOUT_CONCAT, paths[:2])
+	var ret, before = store.Get_total_blocks()
+	if ret != nil {
+		t.Fatal(ret.Get_errmsg())
+	}
+	var last = bytes.Repeat([]byte{0xaa}, TEST_BLOCK_SIZE)
+	ret = store.Store(before-1, &last)
+	if ret != nil {
+		t.Fatal(ret.Get_errmsg())
+	}
+	ret = store.Add_member(paths[2])
+	if ret != nil {
+		t.Fatalf("add member failed: %s", ret.Get_errmsg())
+	}
+	var after uint32
+	ret, after = store.Get_total_blocks()
+	if ret != nil || after != before+4 {
+		t.Fatalf("expected %d blocks after adding a file, got %d", before+4, after)
+	}
+	var added = bytes.Repeat([]byte{0xbb}, TEST_BLOCK_SIZE)
+	ret = store.Store(after-1, &added)
+	if ret != nil {
+		t.Fatalf("store to the new file failed: %s", ret.Get_errmsg())
+	}
+	ret = store.Shutdown()
+	if ret != nil {
+		t.Fatal(ret.Get_errmsg())
+	}
+
+	/* the old list of files isn't the store anymore, the new one is, and everything is where we left it. */
+	store = ts.make_store(STORAGE_LAYOUT_CONCAT, paths[:2])
+	expect_error_containing(t, store.Startup(false), "is a file missing?")
+
+	store = ts.start_store(STORAGE_LAYOUT_CONCAT, paths)
+	defer store.Shutdown()
+	for block_num, want := range map[uint32][]byte{before - 1: last, after - 1: added} {
+		var data *[]byte
+		ret, data = store.Load(block_num)
+		if ret != nil {
+			t.Fatalf("load %d failed: %s", block_num, ret.Get_errmsg())
+		}
+		if bytes.Equal(*data, want) == false {
+			t.Fatalf("block %d didn't come back the way it was written", block_num)
+		}
+	}
+}
+
+func TestMultiFileStoreAddMemberStripe(t *testing.T) {
+	var ts = new_test_multi_store(t)
+	var paths = ts.paths([]uint64{3, 3, 3}, "a", "b", "c")
+	ts.init_store(STORAGE_LAYOUT_STRIPE, paths[:2])
+	var store = ts.start_store(STORAGE_LAYOUT_STRIPE, paths[:2])
+	defer store.Shutdown()
+	expect_error_containing(t, store.Add_member(paths[2]), "only a concat store can have files added to it")
+}
+
+func check_extents(t *testing.T, store *Multi_file_store, blocks uint64, want []uint64) {
+	t.Helper()
+	var ret, extents = store.Calc_member_extents(blocks)
+	if ret != nil {
+		t.Fatalf("calc member extents for %d blocks failed: %s", blocks, ret.Get_errmsg())
+	}
+	if len(extents) != len(want) {
+		t.Fatalf("%d blocks: expected %d extents, got %d", blocks, len(want), len(extents))
+	}
+	for lp := range want {
+		if extents[lp] != want[lp]*TEST_BLOCK_SIZE {
+			t.Fatalf("%d blocks: file %d expected %d blocks, got %d bytes", blocks, lp, want[lp], extents[lp])
+		}
+	}
+}
+
+func TestMultiFileStoreCalcMemberExtentsConcat(t *testing.T) {
+	var ts = new_test_multi_store(t)
+	var paths = ts.paths([]uint64{5, 3, 7}, "a", "b", "c")
+	var store = ts.make_store(STORAGE_LAYOUT_CONCAT, paths)
+
+	/* every file always has its header block, then they fill up in order. */
+	check_extents(t, store, 0, []uint64{1, 1, 1})
+	check_extents(t, store, 1, []uint64{1, 1, 1})
+	check_extents(t, store, 3, []uint64{3, 1, 1})
+	check_extents(t, store, 1+4+1, []uint64{5, 2, 1})
+	check_extents(t, store, 1+4+2+6, []uint64{5, 3, 7})
+	check_extents(t, store, 1000, []uint64{5, 3, 7})
+
+	/* once it's laid out, the headers say how big each file is, not the sizer. */
+	ts.init_store(STORAGE_LAYOUT_CONCAT, paths)
+	for path := range ts.sizes {
+		ts.sizes[path] *= 2
+	}
+	check_extents(t, store, 1000, []uint64{5, 3, 7})
+}
+
+func TestMultiFileStoreCalcMemberExtentsStripe(t *testing.T) {
+	var ts = new_test_multi_store(t)
+	var paths = ts.paths([]uint64{5, 3, 7}, "a", "b", "c")
+	var store = ts.make_store(STORAGE_LAYOUT_STRIPE, paths)
+
+	check_extents(t, store, 1, []uint64{1, 1, 1})
+	check_extents(t, store, 1+1, []uint64{2, 1, 1})
+	check_extents(t, store, 1+5, []uint64{3, 3, 2})
+	check_extents(t, store, 1+6, []uint64{3, 3, 3})
+	check_extents(t, store, 1000, []uint64{3, 3, 3})
+}
@@ -0,0 +1,248 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/nixomose/nixomosegotools/tools"
+	"github.com/nixomose/stree_v/stree_v_lib/stree_v_lib"
+	"github.com/nixomose/zosbd2goclient/zosbd2cmdlib"
+)
+
+/* catalog add used to initialize a backing store for anything you gave it, and you'd find out the
+   size was wrong when you went to start it, after the store was already laid out. so before anything
+	 touches the disk, check everything we can: the name has to be something the kernel will take,
+	 the size has to be whole 4k blocks and at least a meg, the node sizes have to make an stree, directio
+	 needs 4k alignment, the mountpoint has to be there, and the backing store has to be big enough.
+	 big enough is: it can hold at least one node per tree entry, which is what you'd need if
+	 everything compressed as well as it possibly could. if it can't hold the whole thing
+	 uncompressed, that's allowed (that's the point of the kompressor) but we say so.
+	 note that stree's own size check creates the backing file if it isn't there, so we do our own.
+	 we report every problem at once, so you don't have to fix them one at a time. */
+
+const TXT_VALID_DEVICE_NAME_CHARACTERS = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789._-"
+
+func (this *Lbd_lib) validate_device_name(device_name string) string {
+	if len(device_name) == 0 {
+		return "device name is required"
+	}
+	if len(device_name) > zosbd2cmdlib.MAX_DEVICE_NAME_LENGTH {
+		return "device name: " + device_name + " is longer than " + tools.Inttostring(zosbd2cmdlib.MAX_DEVICE_NAME_LENGTH) + " characters"
+	}
+	if device_name == "." || device_name == ".." || strings.HasPrefix(device_name, "-") {
+		return "device name: " + device_name + " is not a usable name in /dev"
+	}
+	for _, c := range device_name {
+		if strings.ContainsRune(TXT_VALID_DEVICE_NAME_CHARACTERS, c) == false {
+			return "device name: " + device_name + " can only contain letters, numbers, dots, dashes and underscores"
+		}
+	}
+	return ""
+}
+
+func (this *Lbd_lib) get_backing_store_size(path string) (tools.Ret, uint64) {
+	/* the same numbers File_store_aligned is going to come up with, without creating anything:
+	   the whole block device, or 80% of the filesystem the file is going to live on. */
+	var info, err = os.Stat(path)
+	if err == nil && info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0 {
+		var fh *os.File
+		fh, err = os.Open(path)
+		if err != nil {
+			return tools.Error(this.log, "unable to open backing store: ", path, " err: ", err), 0
+		}
+		defer fh.Close()
+		var pos int64
+		pos, err = fh.Seek(0, io.SeekEnd)
+		if err != nil {
+			return tools.Error(this.log, "unable to get the size of backing store: ", path, " err: ", err), 0
+		}
+		return nil, uint64(pos)
+	}
+	var stat syscall.Statfs_t
+	err = syscall.Statfs(filepath.Dir(path), &stat)
+	if err != nil {
+		return tools.Error(this.log, "unable to get the size of the filesystem for backing store: ", path, " err: ", err), 0
+	}
+	return nil, stat.Blocks * uint64(stat.Bsize) * stree_v_lib.USABLE_SPACE_PERCENTAGE / 100
+}
+
+func (this *Lbd_lib) validate_storage_file(storage_file string) string {
+	/* it doesn't have to exist yet, but it can't be a directory and where it's going has to be there. */
+	var info, err = os.Stat(storage_file)
+	if err == nil && info.IsDir() {
+		return "backing storage: " + storage_file + " is a directory"
+	} else if err != nil && os.IsNotExist(err) == false {
+		return "backing storage: " + err.Error()
+	} else if dir_info, err := os.Stat(filepath.Dir(storage_file)); err != nil || dir_info.IsDir() == false {
+		return "backing storage: the directory for " + storage_file + " does not exist"
+	}
+	return ""
+}
+
+func (this *Lbd_lib) get_backing_store_total_blocks(device *Lbd_device, block_size uint32, alignment uint32) (tools.Ret, uint64) {
+	/* how many blocks, header included, the store is going to end up with. */
+	if len(device.Storage_layout) > 0 {
+		var mstore = New_multi_file_store(this.log, device.Storage_layout, this.get_storage_files(device), block_size,
+			alignment, device.Additional_nodes_per_block, device.Sync, this.get_file_store_io_path(device), this.get_backing_store_size)
+		return mstore.Calc_total_blocks()
+	}
+	var ret, store_size = this.get_backing_store_size(device.Local_storage_file)
+	if ret != nil {
+		return ret, 0
+	}
+	var aligned_block_size = (uint64(block_size) + uint64(alignment) - 1) / uint64(alignment) * uint64(alignment)
+	return nil, store_size / aligned_block_size
+}
+
+func (this *Lbd_lib) validate_device_definition(device *Lbd_device, device_names map[string]bool) tools.Ret {
+	/* device_names is the lowercase names of the devices this one is allowed to start after. */
+	var problems = make([]string, 0)
+
+	if problem := this.validate_device_name(device.Device_name); len(problem) > 0 {
+		problems = append(problems, problem)
+	} else if _, err := os.Stat(TXT_DEVICE_PATH_PREFIX + device.Device_name); err == nil {
+		problems = append(problems, TXT_DEVICE_PATH_PREFIX+device.Device_name+" already exists")
+	}
+
+	problems = append(problems, this.get_start_after_problems(device.Device_name, device.Start_after, device_names)...)
+
+	if device.Size%PHYSICAL_BLOCK_SIZE != 0 {
+		problems = append(problems, "block device size: "+tools.Prettylargenumber_uint64(device.Size)+
+			" is not a multiple of "+tools.Inttostring(PHYSICAL_BLOCK_SIZE))
+	}
+	if device.Size < ONE_MEG {
+		problems = append(problems, "block device size must be at least "+tools.Prettylargenumber_uint64(ONE_MEG))
+	}
+
+	var block_size uint32 = 0
+	if device.Stree_value_size == 0 {
+		problems = append(problems, "node value size can not be zero")
+	} else {
+		var key_length, value_length, additional_nodes_per_block, key_type, value_type = this.get_init_size_values(device)
+		var ret tools.Ret
+		ret, block_size = stree_v_lib.Calculate_block_size(this.log, key_type, value_type, key_length, value_length, additional_nodes_per_block)
+		if ret != nil {
+			problems = append(problems, "bad node size combination: "+ret.Get_errmsg())
+			block_size = 0
+		} else {
+			block_size = this.get_store_block_size(device, block_size)
+		}
+	}
+
+	var alignment = device.Alignment
+	if device.Directio {
+		if alignment == 0 {
+			alignment = PHYSICAL_BLOCK_SIZE
+		}
+		if alignment%PHYSICAL_BLOCK_SIZE != 0 {
+			problems = append(problems, "alignment: "+tools.Inttostring(int(alignment))+" must fall on a "+
+				tools.Inttostring(PHYSICAL_BLOCK_SIZE)+" boundary if directio is on")
+		}
+	} else if alignment == 0 {
+		alignment = block_size
+	}
+
+	if device.Mount && len(device.Mountpoint) == 0 {
+		problems = append(problems, "mount is set but there is no mountpoint")
+	}
+	if len(device.Mountpoint) > 0 {
+		var info, err = os.Stat(device.Mountpoint)
+		if err != nil {
+			problems = append(problems, "mountpoint: "+err.Error())
+		} else if info.IsDir() == false {
+			problems = append(problems, "mountpoint: "+device.Mountpoint+" is not a directory")
+		}
+	}
+
+	if len(device.Storage_layout) > 0 {
+		if _, ok := storage_layout_codes[device.Storage_layout]; ok == false {
+			problems = append(problems, "storage layout: "+device.Storage_layout+" must be "+STORAGE_LAYOUT_CONCAT+" or "+STORAGE_LAYOUT_STRIPE)
+		} else if device.Storage_layout == STORAGE_LAYOUT_STRIPE && len(device.Additional_storage_files) == 0 {
+			problems = append(problems, "a "+STORAGE_LAYOUT_STRIPE+" storage layout needs at least one additional storage file")
+		}
+	} else if len(device.Additional_storage_files) > 0 {
+		problems = append(problems, "additional storage files need a storage layout")
+	}
+
+	if len(device.Local_storage_file) == 0 {
+		problems = append(problems, "backing storage file is required")
+	} else if device.stree_ramdisk == false && device.device_ramdisk == false {
+		var storage_ok = true
+		var seen = make(map[string]string)
+		for _, storage_file := range this.get_storage_and_mirror_files(device) {
+			var problem = this.validate_storage_file(storage_file)
+			if len(problem) == 0 {
+				var resolved = this.resolve_storage_path(storage_file)
+				if other, ok := seen[resolved]; ok {
+					problem = "backing storage: " + storage_file + " is the same as " + other
+				}
+				seen[resolved] = storage_file
+			}
+			if len(problem) > 0 {
+				problems = append(problems, problem)
+				storage_ok = false
+			}
+		}
+		if len(device.Mirror_storage_file) > 0 && block_size > 0 && alignment > 0 {
+			/* the mirror generation lives in the header block, so it has to be big enough to hold it. */
+			var aligned_block_size = (uint64(block_size) + uint64(alignment) - 1) / uint64(alignment) * uint64(alignment)
+			if aligned_block_size < uint64(MIRROR_GENERATION_END) {
+				problems = append(problems, "mirrored backing storage needs a block size of at least "+
+					tools.Prettylargenumber_uint64(uint64(MIRROR_GENERATION_END))+" bytes, this device's is "+
+					tools.Prettylargenumber_uint64(aligned_block_size))
+			}
+		}
+		if storage_ok && block_size > 0 && alignment > 0 && device.Size > 0 {
+			var entry_size = uint64(device.Stree_value_size) * uint64(device.Additional_nodes_per_block+1)
+			var entries = (device.Size + entry_size - 1) / entry_size
+			var ret, total_blocks = this.get_backing_store_total_blocks(device, block_size, alignment)
+			if ret != nil {
+				problems = append(problems, ret.Get_errmsg())
+			} else {
+				var blocks_uncompressed = entries * uint64(device.Additional_nodes_per_block+1)
+				var storage_files = strings.Join(this.get_storage_files(device), ", ")
+				if total_blocks < entries+1 { // +1 for the header block
+					problems = append(problems, "backing storage: "+storage_files+" can hold "+
+						tools.Prettylargenumber_uint64(total_blocks)+" blocks, a device of "+tools.Prettylargenumber_uint64(device.Size)+
+						" bytes needs at least "+tools.Prettylargenumber_uint64(entries+1)+" even if it all compresses")
+				} else if total_blocks < blocks_uncompressed+1 {
+					this.log.Info("WARNING backing storage: ", storage_files, " can hold ", tools.Prettylargenumber_uint64(total_blocks),
+						" blocks, the device needs ", tools.Prettylargenumber_uint64(blocks_uncompressed+1),
+						" if nothing compresses. consider setting capacity watermarks.")
+				}
+			}
+			if ret == nil && len(device.Mirror_storage_file) > 0 {
+				/* the mirror is a single file store, and the device gets the smaller of the two. */
+				var mirror_size uint64
+				ret, mirror_size = this.get_backing_store_size(device.Mirror_storage_file)
+				if ret != nil {
+					problems = append(problems, ret.Get_errmsg())
+				} else {
+					var aligned_block_size = (uint64(block_size) + uint64(alignment) - 1) / uint64(alignment) * uint64(alignment)
+					var mirror_blocks = mirror_size / aligned_block_size
+					if mirror_blocks < entries+1 {
+						problems = append(problems, "mirror storage: "+device.Mirror_storage_file+" can hold "+
+							tools.Prettylargenumber_uint64(mirror_blocks)+" blocks, a device of "+tools.Prettylargenumber_uint64(device.Size)+
+							" bytes needs at least "+tools.Prettylargenumber_uint64(entries+1)+" even if it all compresses")
+					} else if mirror_blocks < total_blocks {
+						this.log.Info("WARNING mirror storage: ", device.Mirror_storage_file, " can hold ",
+							tools.Prettylargenumber_uint64(mirror_blocks), " blocks, less than the backing storage's ",
+							tools.Prettylargenumber_uint64(total_blocks), ", the device only gets what fits in the mirror.")
+					}
+				}
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return tools.ErrorWithCode(this.log, int(syscall.EINVAL), "invalid device definition for: ", device.Device_name,
+			": ", strings.Join(problems, "; "))
+	}
+	return nil
+}
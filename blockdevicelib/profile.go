@@ -0,0 +1,160 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/nixomose/nixomosegotools/tools"
+	"github.com/nixomose/stree_v/stree_v_lib/stree_v_lib"
+	"github.com/spf13/pflag"
+)
+
+/* everybody ends up typing the same --directio --alignment --node-value-size --additional-nodes-per-block
+   on every catalog add, and if the combination is bad you don't find out till we try and make the stree.
+	 so the config file can define named profiles, like:
+
+	 [Profiles.compressed-64k-directio]
+	 Directio = true
+	 Alignment = 4096
+	 Node_value_size_bytes = 4096
+	 Additional_nodes_per_block = 15
+
+	 and catalog add --profile fills in whatever you didn't say on the command line from the profile.
+	 anything you do say on the command line wins. a zero in the profile means it doesn't say.
+	 the catalog entry remembers which profile it came from, but it's a copy, changing the profile
+	 later doesn't change devices that were made with it, their backing store is already laid out. */
+
+type Profile struct {
+	Directio                   bool
+	Sync                       bool
+	Alignment                  uint32
+	Node_value_size_bytes      uint32
+	Additional_nodes_per_block uint32
+
+	Restart                 string
+	Restart_max_retries     int
+	Restart_backoff_seconds int
+
+	Capacity_soft_percent int
+	Capacity_hard_percent int
+	Capacity_hook         string
+
+	Allocation string
+}
+
+func (this *Lbd_lib) get_profile(profile_name string) (tools.Ret, string, *Profile) {
+	/* case insensitive like device names, hands back the name as it's spelled in the config file. */
+	if this.conf != nil {
+		var lower_profile_name = strings.ToLower(profile_name)
+		for k, v := range this.conf.Profiles {
+			if strings.ToLower(k) == lower_profile_name && v != nil {
+				return nil, k, v
+			}
+		}
+	}
+	return tools.Error(this.log, "profile: ", profile_name, " is not defined in config file: ", this.Config_file,
+		", defined profiles: ", strings.Join(this.get_profile_names(), ", ")), "", nil
+}
+
+func (this *Lbd_lib) get_profile_names() []string {
+	var names = make([]string, 0)
+	if this.conf != nil {
+		for k := range this.conf.Profiles {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (this *Lbd_lib) validate_profile(profile_name string, profile *Profile) tools.Ret {
+	/* catch the things Make_stree would catch, without needing a backing store to do it. */
+	var value_size = profile.Node_value_size_bytes
+	if value_size == 0 {
+		value_size = DEFAULT_NODE_VALUE_SIZE
+	}
+	var device Lbd_device
+	device.Stree_value_size = value_size
+	device.Additional_nodes_per_block = profile.Additional_nodes_per_block
+	var key_length, value_length, additional_nodes_per_block, key_type, value_type = this.get_init_size_values(&device)
+	var ret, _ = stree_v_lib.Calculate_block_size(this.log, key_type, value_type, key_length, value_length, additional_nodes_per_block)
+	if ret != nil {
+		return tools.Error(this.log, "profile: ", profile_name, " has a bad node size combination: ", ret.Get_errmsg())
+	}
+	if profile.Directio && profile.Alignment%PHYSICAL_BLOCK_SIZE != 0 {
+		return tools.Error(this.log, "profile: ", profile_name, " uses directio so its alignment must fall on a ",
+			PHYSICAL_BLOCK_SIZE, " boundary, alignment: ", profile.Alignment)
+	}
+	if len(profile.Restart) > 0 {
+		ret = this.validate_restart_policy(profile.Restart, profile.Restart_max_retries, profile.Restart_backoff_seconds)
+		if ret != nil {
+			return tools.Error(this.log, "profile: ", profile_name, " has a bad restart policy: ", ret.Get_errmsg())
+		}
+	}
+	ret = this.validate_capacity_watermarks(profile.Capacity_soft_percent, profile.Capacity_hard_percent)
+	if ret != nil {
+		return tools.Error(this.log, "profile: ", profile_name, " has bad capacity watermarks: ", ret.Get_errmsg())
+	}
+	ret = this.validate_allocation(profile.Allocation)
+	if ret != nil {
+		return tools.Error(this.log, "profile: ", profile_name, " has a bad allocation: ", ret.Get_errmsg())
+	}
+	return nil
+}
+
+func (this *Lbd_lib) apply_profile(device *Lbd_device, profile_name string, flags *pflag.FlagSet) tools.Ret {
+	/* fill in the device from the profile, for everything the command line didn't explicitly set. */
+	var ret, name, profile = this.get_profile(profile_name)
+	if ret != nil {
+		return ret
+	}
+	ret = this.validate_profile(name, profile)
+	if ret != nil {
+		return ret
+	}
+	var unset = func(flag_name string) bool {
+		return flags.Changed(flag_name) == false
+	}
+
+	if profile.Directio && unset(TXT_DIRECTIO) {
+		device.Directio = true
+	}
+	if profile.Sync && unset(TXT_SYNC) {
+		device.Sync = true
+	}
+	if profile.Alignment != 0 && unset(TXT_ALIGNMENT) {
+		device.Alignment = profile.Alignment
+	}
+	if profile.Node_value_size_bytes != 0 && unset(TXT_NODE_VALUE_SIZE) {
+		device.Stree_value_size = profile.Node_value_size_bytes
+	}
+	if profile.Additional_nodes_per_block != 0 && unset(TXT_ADDITIONAL_NODES_PER_BLOCK) {
+		device.Additional_nodes_per_block = profile.Additional_nodes_per_block
+	}
+	if len(profile.Restart) > 0 && unset(TXT_RESTART) {
+		device.Restart = profile.Restart
+	}
+	if profile.Restart_max_retries != 0 && unset(TXT_RESTART_MAX_RETRIES) {
+		device.Restart_max_retries = profile.Restart_max_retries
+	}
+	if profile.Restart_backoff_seconds != 0 && unset(TXT_RESTART_BACKOFF) {
+		device.Restart_backoff_seconds = profile.Restart_backoff_seconds
+	}
+	if profile.Capacity_soft_percent != 0 && unset(TXT_CAPACITY_SOFT_PERCENT) {
+		device.Capacity_soft_percent = profile.Capacity_soft_percent
+	}
+	if profile.Capacity_hard_percent != 0 && unset(TXT_CAPACITY_HARD_PERCENT) {
+		device.Capacity_hard_percent = profile.Capacity_hard_percent
+	}
+	if len(profile.Capacity_hook) > 0 && unset(TXT_CAPACITY_HOOK) {
+		device.Capacity_hook = profile.Capacity_hook
+	}
+	if len(profile.Allocation) > 0 && unset(TXT_ALLOCATION) {
+		device.Allocation = profile.Allocation
+	}
+	device.Profile = name
+	return nil
+}
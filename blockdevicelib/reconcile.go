@@ -0,0 +1,199 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/nixomose/nixomosegotools/tools"
+	"github.com/nixomose/zosbd2goclient/zosbd2cmdlib"
+)
+
+/* the catalog and the kernel can disagree. a handler crash can leave a zosbd2 device behind with
+   nobody serving it, a catalog delete can leave a running device with no catalog entry, and
+	 somebody can delete a backing file out from under a catalog entry. reconcile lists all of that,
+	 and with apply, destroys the kernel devices that aren't in the catalog and marks the catalog
+	 entries that can't be started as broken, so start all doesn't keep tripping over them.
+	 when the problem goes away, the next reconcile with apply clears the mark.
+	 a catalog device that looks like nobody is serving it is only reported. looking for the handler
+	 process can miss one started through a symlink or by some other program, so we also try the
+	 flock the handler holds on the backing store, and if we get it, there's nobody there. even then
+	 we only destroy it if you say destroy unserved as well, and we unmount it first either way. */
+
+const PROBLEM_ORPHANED = "running in the kernel but not in the catalog"
+const PROBLEM_NO_HANDLER = "running in the kernel but no handler process is serving it"
+const PROBLEM_MISSING_STORAGE = "backing storage does not exist"
+const PROBLEM_FIXED = "marked broken but the problem is gone"
+
+const ACTION_DESTROY = "destroy kernel device"
+const ACTION_REPORT_ONLY = "none, destroy unserved will destroy it"
+const ACTION_MARK_BROKEN = "mark catalog entry broken"
+const ACTION_CLEAR_BROKEN = "clear broken mark on catalog entry"
+
+type Discrepancy struct {
+	Device_name string `json:"device_name"`
+	Problem     string `json:"problem"`
+	Action      string `json:"action"`
+	Applied     bool   `json:"applied"`
+	Error       string `json:"error,omitempty"`
+}
+
+func (this *Lbd_lib) is_device_served(catentry *Catalog_entry) (tools.Ret, bool) {
+	/* a handler process we can find, or somebody holding the lock on the backing store. */
+	if this.find_handler_pid(catentry.Device_name) != 0 {
+		return nil, true
+	}
+	var ret, lock = this.lock_backing_store(this.New_block_device_from_catalog_entry(catentry))
+	if ret != nil {
+		if ret.Get_errcode() == int(syscall.EBUSY) {
+			return nil, true
+		}
+		return ret, false
+	}
+	this.unlock_backing_store(lock)
+	return nil, false
+}
+
+func (this *Lbd_lib) reconcile_destroy(device_name string) tools.Ret {
+	/* unmount whatever is mounted off it, and only if that all worked, destroy it. */
+	syscall.Sync()
+	var is_block, device_number = this.get_block_device_number(TXT_DEVICE_PATH_PREFIX + device_name)
+	if is_block {
+		for _, mountpoint := range this.get_mounted_device_numbers()[device_number] {
+			var device Lbd_device
+			device.Device_name = device_name
+			device.Mount = true
+			device.Mountpoint = mountpoint
+			var ret = this.attempt_unmount(&device)
+			if ret != nil {
+				return tools.Error(this.log, "not destroying device: ", device_name, ", unable to unmount it from: ", mountpoint)
+			}
+		}
+	}
+	var device Lbd_device
+	device.Device_name = device_name
+	return this.destroy_block_device(&device)
+}
+
+func (this *Lbd_lib) catalog_reconcile(cat *Catalog, apply bool, destroy_unserved bool) tools.Ret {
+
+	var ret = this.catalog.Read_catalog(cat)
+	if ret != nil {
+		return ret
+	}
+
+	var map_of_devices map[string]zosbd2cmdlib.Device_status
+	ret, map_of_devices = this.get_active_device_map()
+	if ret != nil {
+		return ret
+	}
+
+	var discrepancies = make([]*Discrepancy, 0)
+	var catalog_changed = false
+
+	/* kernel side */
+	for lower_device_name, status := range map_of_devices {
+		var problem string
+		var action = ACTION_DESTROY
+		var catentry = this.find_catalog_entry(cat, lower_device_name)
+		if catentry == nil {
+			problem = PROBLEM_ORPHANED
+		} else {
+			var ret, served = this.is_device_served(catentry)
+			if ret != nil || served {
+				continue // if we can't tell, don't claim anything
+			}
+			problem = PROBLEM_NO_HANDLER
+			if destroy_unserved == false {
+				action = ACTION_REPORT_ONLY
+			}
+		}
+		var d = &Discrepancy{Device_name: status.Device_name, Problem: problem, Action: action}
+		if apply && action == ACTION_DESTROY {
+			var ret = this.reconcile_destroy(status.Device_name)
+			if ret != nil {
+				d.Error = ret.Get_errmsg()
+			} else {
+				d.Applied = true
+			}
+		}
+		discrepancies = append(discrepancies, d)
+	}
+
+	/* catalog side */
+	for _, catentry := range cat.catalog_list.Device_list {
+		var ret tools.Ret
+		var exists = true
+		for _, storage_file := range this.get_storage_files(this.New_block_device_from_catalog_entry(catentry)) {
+			var found bool
+			ret, found = tools.File_exists(this.log, storage_file)
+			if ret != nil {
+				break
+			}
+			exists = exists && found
+		}
+		if ret != nil {
+			continue // it logged, and we don't know, so don't claim anything
+		}
+		if exists == false {
+			if catentry.Broken == PROBLEM_MISSING_STORAGE {
+				continue // already marked, nothing new to say
+			}
+			var d = &Discrepancy{Device_name: catentry.Device_name, Problem: PROBLEM_MISSING_STORAGE, Action: ACTION_MARK_BROKEN}
+			if apply {
+				catentry.Broken = PROBLEM_MISSING_STORAGE
+				catalog_changed = true
+				d.Applied = true
+			}
+			discrepancies = append(discrepancies, d)
+			continue
+		}
+		if len(catentry.Broken) > 0 {
+			var d = &Discrepancy{Device_name: catentry.Device_name, Problem: PROBLEM_FIXED, Action: ACTION_CLEAR_BROKEN}
+			if apply {
+				catentry.Broken = ""
+				catalog_changed = true
+				d.Applied = true
+			}
+			discrepancies = append(discrepancies, d)
+		}
+	}
+
+	if catalog_changed {
+		ret = cat.Write_catalog()
+		if ret != nil {
+			return ret
+		}
+	}
+
+	if apply {
+		for _, d := range discrepancies {
+			var result tools.Ret = nil
+			if len(d.Error) > 0 {
+				result = tools.ErrorWithCodeNoLog(this.log, 0, d.Error)
+			}
+			this.log_event(EVENT_RECONCILE, d.Device_name, map[string]interface{}{"problem": d.Problem, "action": d.Action}, result)
+		}
+	}
+
+	sort.Slice(discrepancies, func(i, j int) bool {
+		return strings.ToLower(discrepancies[i].Device_name) < strings.ToLower(discrepancies[j].Device_name)
+	})
+	var bytesout, err = json.MarshalIndent(discrepancies, "", " ")
+	if err != nil {
+		return tools.Error(this.log, "unable to marshal reconcile results into json, err: ", err)
+	}
+	fmt.Println(string(bytesout))
+
+	for _, d := range discrepancies {
+		if len(d.Error) > 0 {
+			return tools.Error(this.log, "not all discrepancies could be fixed")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"container/list"
+	"sync/atomic"
+	"time"
+
+	"github.com/nixomose/nixomosegotools/tools"
+)
+
+/* if the block device handler fails, we clean up the block device and the device is just gone
+   until somebody notices. the restart policy lets the process that owns the handler (the dragons
+	 child or the foreground process) bring it back by itself.
+	 never: don't restart, which is what happens if you don't say anything.
+	 on-failure: restart after the handler fails, up to max retries times in a row.
+	 always: restart after the handler fails, no matter how many times it has failed.
+	 a clean handler exit only happens when somebody destroyed the device or stopped it, so neither
+	 policy restarts after that, and neither restarts if we were signalled to shut down.
+	 every restart goes through the validation phase again and does not force the backing store,
+	 so if the handler left the stree dirty, we stop there and a human has to look at it. */
+
+const RESTART_NEVER = "never"
+const RESTART_ON_FAILURE = "on-failure"
+const RESTART_ALWAYS = "always"
+
+const DEFAULT_RESTART_MAX_RETRIES = 5
+const DEFAULT_RESTART_BACKOFF_SECONDS = 1
+const MAX_RESTART_BACKOFF_SECONDS = 300
+
+/* if the handler ran this long before failing, it's not failing in a loop, start counting again. */
+const RESTART_RESET_AFTER_SECONDS = 600
+
+func (this *Lbd_lib) validate_restart_policy(restart string, max_retries int, backoff_seconds int) tools.Ret {
+	switch restart {
+	case "", RESTART_NEVER, RESTART_ON_FAILURE, RESTART_ALWAYS:
+	default:
+		return tools.Error(this.log, "invalid restart policy: ", restart, ", must be one of ",
+			RESTART_NEVER, ", ", RESTART_ON_FAILURE, " or ", RESTART_ALWAYS)
+	}
+	if max_retries < 0 {
+		return tools.Error(this.log, "restart max retries can not be negative")
+	}
+	if backoff_seconds < 0 {
+		return tools.Error(this.log, "restart backoff can not be negative")
+	}
+	return nil
+}
+
+func (this *Lbd_lib) serve_block_device(device *Lbd_device, force bool, data_pipeline *list.List) tools.Ret {
+	/* run the handler, and if it fails and the policy says so, validate again and run it again. */
+
+	var backoff = time.Duration(device.Restart_backoff_seconds) * time.Second
+	var retries = 0
+	for {
+		var started = time.Now()
+		var ret = this.start_block_device(device, force, data_pipeline, true)
+		if ret == nil {
+			return nil
+		}
+		if atomic.LoadInt32(&device.stop_requested) != 0 {
+			return ret
+		}
+		if time.Since(started) > RESTART_RESET_AFTER_SECONDS*time.Second {
+			retries = 0
+			backoff = time.Duration(device.Restart_backoff_seconds) * time.Second
+		}
+
+		switch device.Restart {
+		case RESTART_ALWAYS:
+		case RESTART_ON_FAILURE:
+			if retries >= device.Restart_max_retries {
+				this.log.Error("block device: ", device.Device_name, " failed ", retries+1, " times in a row, giving up.")
+				return ret
+			}
+		default:
+			return ret
+		}
+		retries++
+
+		this.log.Info("block device handler for: ", device.Device_name, " failed, restarting in ", backoff,
+			" (restart ", retries, ")")
+		time.Sleep(backoff)
+		if backoff == 0 {
+			backoff = time.Second
+		} else {
+			backoff *= 2
+		}
+		if backoff > MAX_RESTART_BACKOFF_SECONDS*time.Second {
+			backoff = MAX_RESTART_BACKOFF_SECONDS * time.Second
+		}
+
+		/* the handler may have left things in a bad state, prove it all works before serving again.
+		   we never force here, we only clean up after a handler failure we know about. */
+		ret = this.start_block_device(device, false, data_pipeline, false)
+		if ret != nil {
+			return tools.Error(this.log, "not restarting block device: ", device.Device_name,
+				", validation failed: ", ret.Get_errmsg())
+		}
+		force = false
+	}
+}
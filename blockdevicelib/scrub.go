@@ -0,0 +1,367 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nixomose/nixomosegotools/tools"
+	"github.com/nixomose/stree_v/stree_v_lib/stree_v_lib"
+)
+
+/* a scrub reads back every live block in the backing store to find the bad ones before the
+   filesystem on the device does. the stree packs its nodes below the free position, so that's
+	 every block from 1 up to there.
+	 with checksums a bad block is one that doesn't match its checksum, without them it's only one we
+	 can't read at all. with a mirror we read both sides, and if one side is bad and the other isn't
+	 we write the good copy over the bad one. if both sides read fine but don't agree, the primary
+	 wins, same as at startup.
+	 storage scrub does it on a stopped device and says what it found. it reads everything with the
+	 store open readonly first, so looking doesn't change anything, not even the dirty flag, and only
+	 starts the store up for real if there's something to fix. a catalog entry can also have a
+	 scrub rate, and then the handler does it in the background on the running device, that many
+	 blocks a second so it doesn't get in the way, starting a new pass a day after the last one
+	 started. it takes the same lock the metrics take around every request, so it's never reading
+	 a block while the stree is in the middle of changing it. */
+
+const SCRUB_PASS_INTERVAL = 24 * time.Hour
+const SCRUB_PROGRESS_STEPS = 10
+const SCRUB_MAX_RATE = 1000000 // any faster and the ticker can't keep up anyway
+
+type Scrub_result struct {
+	Blocks_scrubbed      uint64   `json:"blocks_scrubbed"`
+	Bad_copies           uint64   `json:"bad_copies"`
+	Repaired             uint64   `json:"repaired"`
+	Unrecoverable_blocks []uint32 `json:"unrecoverable_blocks,omitempty"`
+}
+
+func (this *Lbd_lib) validate_scrub_rate(scrub_rate int) tools.Ret {
+	if scrub_rate < 0 || scrub_rate > SCRUB_MAX_RATE {
+		return tools.Error(this.log, "scrub rate is blocks per second, between 0 and ", SCRUB_MAX_RATE, ", 0 means off")
+	}
+	return nil
+}
+
+func (this *Mirrored_store) Open_datastore_readonly_with_mirror() tools.Ret {
+	/* like startup, the mirror only comes along if it's in sync, but nothing gets written. */
+	var ret, state = this.get_state()
+	if ret != nil {
+		return ret
+	}
+	if state == MIRROR_PRIMARY_OUT_OF_DATE {
+		return tools.Error(this.log, "backing storage: ", this.primary().path, " is out of date, its mirror: ", this.mirror().path,
+			" has newer data. run storage resync with --", TXT_FROM_MIRROR, " to bring it up to date first.")
+	}
+	for _, side := range this.sides {
+		if side != this.primary() && state != MIRROR_IN_SYNC {
+			this.log.Info("WARNING mirror backing storage: ", side.path, " is ", state, ", only looking at the primary.")
+			continue
+		}
+		ret = side.store.Open_datastore_readonly()
+		if ret != nil {
+			return ret
+		}
+		side.opened = true
+		side.active = true
+		ret = side.store.Load_header_and_check_magic(true)
+		if ret != nil {
+			return ret
+		}
+	}
+	return nil
+}
+
+func (this *Mirrored_store) Scrub_block(block_num uint32, repair bool) (tools.Ret, uint64, uint64) {
+	/* read every side, rewrite the ones that are bad or don't match the first good one if we're
+	   repairing. returns how many bad copies there were and how many got fixed. */
+	var good []byte
+	var bad = make([]*mirror_side, 0)
+	for _, side := range this.sides {
+		if side.active == false {
+			continue
+		}
+		var ret, data = side.store.Read_raw_data(block_num)
+		if ret != nil {
+			bad = append(bad, side)
+			continue
+		}
+		if good == nil {
+			good = data
+			continue
+		}
+		if bytes.Equal(good, data) == false {
+			this.log.Error("block ", block_num, " on backing storage: ", side.path, " doesn't match the primary")
+			bad = append(bad, side)
+		}
+	}
+	if good == nil {
+		return tools.ErrorWithCode(this.log, int(syscall.EIO), "no good copy of block ", block_num, " on any side of the mirror"),
+			uint64(len(bad)), 0
+	}
+	var repaired uint64 = 0
+	if repair == false {
+		return nil, uint64(len(bad)), repaired
+	}
+	for _, side := range bad {
+		var ret = side.store.Store(block_num, &good)
+		if ret != nil {
+			this.drop(side, ret)
+			continue
+		}
+		this.log.Info("repaired block ", block_num, " on backing storage: ", side.path)
+		repaired++
+	}
+	return nil, uint64(len(bad)), repaired
+}
+
+func (this *Lbd_lib) scrub_block(fstore Lbd_file_store, block_num uint32, repair bool, result *Scrub_result) {
+	result.Blocks_scrubbed++
+	if mirrored, ok := fstore.(*Mirrored_store); ok {
+		var ret, bad, repaired = mirrored.Scrub_block(block_num, repair)
+		result.Bad_copies += bad
+		result.Repaired += repaired
+		if ret != nil {
+			result.Unrecoverable_blocks = append(result.Unrecoverable_blocks, block_num)
+		}
+		return
+	}
+	var ret, _ = fstore.Read_raw_data(block_num)
+	if ret != nil {
+		result.Bad_copies++
+		result.Unrecoverable_blocks = append(result.Unrecoverable_blocks, block_num)
+	}
+}
+
+func (this *Lbd_lib) storage_scrub(cat *Catalog, device_name string, force bool) tools.Ret {
+	var ret, catentry = this.get_catalog_entry(cat, device_name)
+	if ret != nil {
+		if ret.Get_errcode() == int(syscall.ENOENT) {
+			return tools.Error(this.log, "device: ", device_name, " not found")
+		}
+		return ret
+	}
+	return this.scrub_device(this.New_block_device_from_catalog_entry(catentry), force)
+}
+
+func (this *Lbd_lib) scrub_device(device *Lbd_device, force bool) tools.Ret {
+	/* the device can't be running, we take the same locks it does. */
+	var ret, lock = this.lock_backing_store(device)
+	if ret != nil {
+		return ret
+	}
+	defer this.unlock_backing_store(lock)
+
+	if device.Checksums == false {
+		this.log.Info("device: ", device.Device_name, " doesn't have checksums, only looking for blocks that can't be read",
+			" or that don't match their mirror.")
+	}
+
+	var key_length, value_length, additional_nodes_per_block, key_type, value_type = this.get_init_size_values(device)
+	var block_size uint32
+	ret, block_size = stree_v_lib.Calculate_block_size(this.log, key_type, value_type, key_length, value_length, additional_nodes_per_block)
+	if ret != nil {
+		return ret
+	}
+	var fstore Lbd_file_store
+	ret, fstore = this.make_backing_store(device, block_size)
+	if ret != nil {
+		return ret
+	}
+	if mirrored, ok := fstore.(*Mirrored_store); ok {
+		ret = mirrored.Open_datastore_readonly_with_mirror()
+	} else {
+		ret = fstore.Open_datastore_readonly()
+		if ret != nil {
+			return ret
+		}
+		ret = fstore.Load_header_and_check_magic(true)
+	}
+	if ret != nil {
+		fstore.Shutdown()
+		return ret
+	}
+
+	var dirty bool
+	ret, dirty = this.get_store_dirty(fstore)
+	if ret != nil {
+		fstore.Shutdown()
+		return ret
+	}
+	if dirty && force == false {
+		fstore.Shutdown()
+		return tools.Error(this.log, "backing storage for device: ", device.Device_name, " was not cleanly shut down. ",
+			"add -f to scrub it anyway.")
+	}
+
+	var free_position uint32
+	ret, free_position = fstore.Get_free_position()
+	if ret != nil {
+		fstore.Shutdown()
+		return ret
+	}
+
+	var result Scrub_result
+	var to_repair = make([]uint32, 0)
+	this.log.Info("scrubbing ", tools.Prettylargenumber_uint64(uint64(free_position-1)), " blocks of device: ", device.Device_name)
+	var step = (free_position + SCRUB_PROGRESS_STEPS - 1) / SCRUB_PROGRESS_STEPS
+	for block_num := uint32(1); block_num < free_position; block_num++ {
+		var bad_copies = result.Bad_copies
+		var unrecoverable = len(result.Unrecoverable_blocks)
+		this.scrub_block(fstore, block_num, false, &result)
+		if result.Bad_copies > bad_copies && len(result.Unrecoverable_blocks) == unrecoverable {
+			to_repair = append(to_repair, block_num) // there's a good copy to fix the bad one from
+		}
+		if block_num%step == 0 {
+			this.log.Info("scrubbed ", tools.Prettylargenumber_uint64(uint64(block_num)), " of ",
+				tools.Prettylargenumber_uint64(uint64(free_position-1)), " blocks")
+		}
+	}
+
+	ret = fstore.Shutdown() // readonly, this doesn't write anything
+	if ret != nil {
+		return ret
+	}
+
+	if len(to_repair) > 0 {
+		/* the mirror is only in sync when both sides were shut down cleanly, so there shouldn't be
+		   anything to fix on a dirty store, but if there is, starting it up and shutting it down
+			 again would mark it clean, and it isn't. */
+		if dirty {
+			this.log.Error("not repairing ", len(to_repair), " blocks of device: ", device.Device_name,
+				" because its backing storage was not cleanly shut down, start and stop the device first.")
+		} else {
+			ret = this.repair_blocks(device, block_size, to_repair, &result)
+			if ret != nil {
+				return ret
+			}
+		}
+	}
+
+	bytesout, err := json.MarshalIndent(result, "", " ")
+	if err != nil {
+		return tools.Error(this.log, "unable to marshal scrub results into json")
+	}
+	fmt.Println(string(bytesout))
+
+	if len(result.Unrecoverable_blocks) > 0 {
+		return tools.ErrorWithCode(this.log, int(syscall.EIO), len(result.Unrecoverable_blocks),
+			" blocks of device: ", device.Device_name, " have no good copy")
+	}
+	return nil
+}
+
+func (this *Lbd_lib) repair_blocks(device *Lbd_device, block_size uint32, to_repair []uint32, result *Scrub_result) tools.Ret {
+	/* the store was clean when we looked, so starting it up and shutting it down leaves it clean. */
+	this.log.Info("repairing ", len(to_repair), " blocks of device: ", device.Device_name)
+	var ret, fstore = this.make_backing_store(device, block_size)
+	if ret != nil {
+		return ret
+	}
+	ret = fstore.Startup(false)
+	if ret != nil {
+		return ret
+	}
+	var mirrored, ok = fstore.(*Mirrored_store)
+	if ok == false {
+		fstore.Shutdown()
+		return tools.Error(this.log, "backing storage for device: ", device.Device_name, " has no mirror to repair from")
+	}
+	for _, block_num := range to_repair {
+		var _, _, repaired = mirrored.Scrub_block(block_num, true)
+		result.Repaired += repaired
+	}
+	return fstore.Shutdown()
+}
+
+/* the background scrub in the handler */
+
+type background_scrubber struct {
+	lib  *Lbd_lib
+	log  *tools.Nixomosetools_logger
+	lock sync.Locker // held around every block, so we don't race a request
+
+	device_name string
+	store       Lbd_file_store
+	rate        int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (this *Lbd_lib) start_background_scrub(device *Lbd_device, lock sync.Locker) *background_scrubber {
+	if device.Scrub_rate <= 0 || device.backing_store == nil {
+		return nil
+	}
+	var ret background_scrubber
+	ret.lib = this
+	ret.log = this.log
+	ret.lock = lock
+	ret.device_name = device.Device_name
+	ret.store = device.backing_store
+	ret.rate = device.Scrub_rate
+	ret.stop = make(chan struct{})
+	ret.done = make(chan struct{})
+	go ret.run()
+	this.log.Info("scrubbing device: ", device.Device_name, " in the background at ", device.Scrub_rate, " blocks per second")
+	return &ret
+}
+
+func (this *background_scrubber) Stop() {
+	if this == nil {
+		return
+	}
+	close(this.stop)
+	<-this.done
+}
+
+func (this *background_scrubber) run() {
+	defer close(this.done)
+	var ticker = time.NewTicker(time.Second / time.Duration(this.rate))
+	defer ticker.Stop()
+
+	for {
+		var started = time.Now()
+		if this.pass(ticker) == false {
+			return
+		}
+		select {
+		case <-this.stop:
+			return
+		case <-time.After(time.Until(started.Add(SCRUB_PASS_INTERVAL))):
+		}
+	}
+}
+
+func (this *background_scrubber) pass(ticker *time.Ticker) bool {
+	/* one block a tick, until we catch up with the free position. false if we were told to stop. */
+	var result Scrub_result
+	for block_num := uint32(1); ; block_num++ {
+		select {
+		case <-this.stop:
+			return false
+		case <-ticker.C:
+		}
+		this.lock.Lock()
+		var ret, free_position = this.store.Get_free_position()
+		if ret == nil && block_num < free_position {
+			this.lib.scrub_block(this.store, block_num, true, &result)
+		}
+		this.lock.Unlock()
+		if ret != nil || block_num >= free_position {
+			break
+		}
+	}
+	this.log.Info("background scrub of device: ", this.device_name, " scrubbed ", tools.Prettylargenumber_uint64(result.Blocks_scrubbed),
+		" blocks, found ", result.Bad_copies, " bad copies, repaired ", result.Repaired)
+	if len(result.Unrecoverable_blocks) > 0 {
+		this.log.Error("background scrub of device: ", this.device_name, " found ", len(result.Unrecoverable_blocks),
+			" blocks with no good copy: ", result.Unrecoverable_blocks)
+	}
+	return true
+}
@@ -0,0 +1,177 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/nixomose/nixomosegotools/tools"
+)
+
+/* the sd_notify protocol is simple enough that we don't need to pull in a library for it,
+   it's just a datagram with newline separated key=value pairs sent to the unix socket named
+	 in the NOTIFY_SOCKET environment variable. if that variable isn't set, nobody is listening
+	 and everything here quietly does nothing.
+	 the watchdog is only worth anything if a ping means we're still doing our job, so we don't
+	 just ping on a timer, every ping has to be earned by the progress check the caller gives us,
+	 and if WATCHDOG_PID says the watchdog is for some other process, it's not ours to ping. */
+
+const TXT_NOTIFY_SOCKET = "NOTIFY_SOCKET"
+const TXT_WATCHDOG_USEC = "WATCHDOG_USEC"
+const TXT_WATCHDOG_PID = "WATCHDOG_PID"
+
+const SD_NOTIFY_READY = "READY=1"
+const SD_NOTIFY_STOPPING = "STOPPING=1"
+const SD_NOTIFY_WATCHDOG = "WATCHDOG=1"
+const SD_NOTIFY_MAINPID = "MAINPID="
+const SD_NOTIFY_STATUS = "STATUS="
+
+type Sd_notifier struct {
+	log *tools.Nixomosetools_logger
+
+	socket_path       string        // empty if there's nobody to notify
+	watchdog_interval time.Duration // zero if the watchdog isn't enabled
+
+	check_progress func() bool // true if we've gotten something done since the last time it was asked
+	watchdog_stop  chan bool
+	watchdog_done  chan bool
+}
+
+func New_sd_notifier(log *tools.Nixomosetools_logger) *Sd_notifier {
+	var ret Sd_notifier
+	ret.log = log
+	ret.socket_path = os.Getenv(TXT_NOTIFY_SOCKET)
+	ret.watchdog_interval = 0
+	ret.check_progress = nil
+	ret.watchdog_stop = nil
+	ret.watchdog_done = nil
+
+	var usec_string = os.Getenv(TXT_WATCHDOG_USEC)
+	var pid_string = os.Getenv(TXT_WATCHDOG_PID)
+	if len(usec_string) > 0 && len(pid_string) > 0 && pid_string != strconv.Itoa(os.Getpid()) {
+		log.Info("the watchdog is for pid ", pid_string, ", not us, not pinging it.")
+	} else if len(usec_string) > 0 {
+		var usec, err = strconv.ParseUint(usec_string, 10, 64)
+		if err != nil || usec == 0 {
+			log.Error("invalid ", TXT_WATCHDOG_USEC, " value: ", usec_string, ", watchdog disabled.")
+		} else {
+			/* systemd recommends pinging at half the timeout so one late ping doesn't get us killed. */
+			ret.watchdog_interval = time.Duration(usec) * time.Microsecond / 2
+		}
+	}
+	return &ret
+}
+
+func (this *Sd_notifier) Is_enabled() bool {
+	return len(this.socket_path) > 0
+}
+
+func (this *Sd_notifier) Notify(state string) tools.Ret {
+	if this.Is_enabled() == false {
+		return nil
+	}
+	/* go's net package treats a leading @ as the abstract namespace on linux, which is exactly
+	   what systemd means by it, so no translation is necessary. */
+	var addr = &net.UnixAddr{Name: this.socket_path, Net: "unixgram"}
+	var conn, err = net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return tools.Error(this.log, "unable to connect to notify socket: ", this.socket_path, " error: ", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return tools.Error(this.log, "unable to send ", state, " to notify socket: ", this.socket_path, " error: ", err)
+	}
+	return nil
+}
+
+func (this *Sd_notifier) Ready(status string) tools.Ret {
+	/* the dragons child is not the process systemd started, the parent exits right after it
+	   forkexecs us, so tell systemd who the main pid really is along with the ready message.
+		 this requires NotifyAccess=all in the unit file. */
+	var state = SD_NOTIFY_READY + "\n" + SD_NOTIFY_MAINPID + strconv.Itoa(os.Getpid())
+	if len(status) > 0 {
+		state += "\n" + SD_NOTIFY_STATUS + status
+	}
+	return this.Notify(state)
+}
+
+func (this *Sd_notifier) Stopping(status string) tools.Ret {
+	var state = SD_NOTIFY_STOPPING
+	if len(status) > 0 {
+		state += "\n" + SD_NOTIFY_STATUS + status
+	}
+	return this.Notify(state)
+}
+
+func Sd_notify_child_environment() []string {
+	/* the dragons child is who should be pinging the watchdog, not us, and we're going away. we
+	   don't know its pid until it's started, so if the watchdog is ours, we leave WATCHDOG_PID out
+		 and let it have it. if it's somebody else's, the child will see that too. */
+	var env = make([]string, 0)
+	var ours = TXT_WATCHDOG_PID + "=" + strconv.Itoa(os.Getpid())
+	for _, kv := range os.Environ() {
+		if kv != ours {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+func (this *Sd_notifier) Start_watchdog(check_progress func() bool) {
+	/* ping the watchdog for as long as the block device handler is running. the handler blocks
+	   in the kernel waiting for requests so there's no good place to hook in on each pass through
+		 the loop, so we ping from the side until the handler returns and we're told to stop, but
+		 only when check_progress says the handler is still getting somewhere. if it's stuck, the
+		 pings stop and systemd does what it's configured to do about it. */
+	if this.Is_enabled() == false || this.watchdog_interval == 0 {
+		return
+	}
+	if this.watchdog_stop != nil {
+		return // already running
+	}
+	this.check_progress = check_progress
+	this.watchdog_stop = make(chan bool)
+	this.watchdog_done = make(chan bool)
+	go this.watchdog_runner(this.watchdog_stop, this.watchdog_done)
+}
+
+func (this *Sd_notifier) Stop_watchdog() {
+	if this.watchdog_stop == nil {
+		return
+	}
+	close(this.watchdog_stop)
+	<-this.watchdog_done
+	this.watchdog_stop = nil
+	this.watchdog_done = nil
+}
+
+func (this *Sd_notifier) watchdog_runner(stop chan bool, done chan bool) {
+	defer close(done)
+
+	var ticker = time.NewTicker(this.watchdog_interval)
+	defer ticker.Stop()
+
+	this.ping_watchdog() // don't wait a whole interval for the first one
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			this.ping_watchdog()
+		}
+	}
+}
+
+func (this *Sd_notifier) ping_watchdog() {
+	if this.check_progress != nil && this.check_progress() == false {
+		this.log.Error("block device handler isn't making progress, not pinging the watchdog.")
+		return
+	}
+	this.Notify(SD_NOTIFY_WATCHDOG) // it already logged if it failed
+}
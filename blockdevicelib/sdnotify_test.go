@@ -0,0 +1,139 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nixomose/nixomosegotools/tools"
+)
+
+/* a fake systemd, a unixgram socket in a temp directory that NOTIFY_SOCKET points at. */
+
+const TEST_WATCHDOG_USEC = 20000 // so we ping every 10ms
+
+type fake_notify_socket struct {
+	t    *testing.T
+	conn *net.UnixConn
+}
+
+func new_fake_notify_socket(t *testing.T) *fake_notify_socket {
+	var path = filepath.Join(t.TempDir(), "notify")
+	var conn, err = net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("unable to listen on %s: %s", path, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv(TXT_NOTIFY_SOCKET, path)
+	return &fake_notify_socket{t: t, conn: conn}
+}
+
+func (this *fake_notify_socket) receive(timeout time.Duration) (string, bool) {
+	var data = make([]byte, 4096)
+	this.conn.SetReadDeadline(time.Now().Add(timeout))
+	var n, err = this.conn.Read(data)
+	if err != nil {
+		return "", false
+	}
+	return string(data[:n]), true
+}
+
+func (this *fake_notify_socket) expect(want ...string) {
+	this.t.Helper()
+	var message, ok = this.receive(time.Second)
+	if ok == false {
+		this.t.Fatalf("expected a notify message with %v, got nothing", want)
+	}
+	var lines = strings.Split(message, "\n")
+	for _, w := range want {
+		var found = false
+		for _, line := range lines {
+			if line == w {
+				found = true
+			}
+		}
+		if found == false {
+			this.t.Fatalf("expected %q in notify message %q", w, message)
+		}
+	}
+}
+
+func (this *fake_notify_socket) drain() {
+	for {
+		if _, ok := this.receive(10 * time.Millisecond); ok == false {
+			return
+		}
+	}
+}
+
+func new_test_notifier(t *testing.T, watchdog_pid int) *Sd_notifier {
+	t.Setenv(TXT_WATCHDOG_USEC, strconv.Itoa(TEST_WATCHDOG_USEC))
+	t.Setenv(TXT_WATCHDOG_PID, strconv.Itoa(watchdog_pid))
+	return New_sd_notifier(tools.New_Nixomosetools_logger(tools.ERROR))
+}
+
+func TestSdNotifyReadyWatchdogStopping(t *testing.T) {
+	var socket = new_fake_notify_socket(t)
+	var notifier = new_test_notifier(t, os.Getpid())
+
+	notifier.Ready("serving block device test")
+	socket.expect(SD_NOTIFY_READY, SD_NOTIFY_MAINPID+strconv.Itoa(os.Getpid()), SD_NOTIFY_STATUS+"serving block device test")
+
+	var progressing int32 = 1
+	notifier.Start_watchdog(func() bool { return atomic.LoadInt32(&progressing) == 1 })
+	socket.expect(SD_NOTIFY_WATCHDOG)
+	socket.expect(SD_NOTIFY_WATCHDOG)
+
+	/* stuck, so no more pings. */
+	atomic.StoreInt32(&progressing, 0)
+	socket.drain()
+	if message, ok := socket.receive(5 * TEST_WATCHDOG_USEC * time.Microsecond); ok {
+		t.Fatalf("expected no pings without progress, got %q", message)
+	}
+
+	atomic.StoreInt32(&progressing, 1)
+	socket.expect(SD_NOTIFY_WATCHDOG)
+
+	notifier.Stop_watchdog()
+	socket.drain()
+	notifier.Stopping("block device test handler exited")
+	socket.expect(SD_NOTIFY_STOPPING, SD_NOTIFY_STATUS+"block device test handler exited")
+}
+
+func TestSdNotifyWatchdogForSomebodyElse(t *testing.T) {
+	var socket = new_fake_notify_socket(t)
+	var notifier = new_test_notifier(t, os.Getpid()+1)
+
+	notifier.Start_watchdog(func() bool { return true })
+	defer notifier.Stop_watchdog()
+	if message, ok := socket.receive(5 * TEST_WATCHDOG_USEC * time.Microsecond); ok {
+		t.Fatalf("expected no pings for somebody else's watchdog, got %q", message)
+	}
+}
+
+func TestSdNotifyChildEnvironment(t *testing.T) {
+	t.Setenv(TXT_WATCHDOG_PID, strconv.Itoa(os.Getpid()))
+	for _, kv := range Sd_notify_child_environment() {
+		if strings.HasPrefix(kv, TXT_WATCHDOG_PID+"=") {
+			t.Fatalf("our watchdog pid should not be passed to the child, got %q", kv)
+		}
+	}
+	t.Setenv(TXT_WATCHDOG_PID, strconv.Itoa(os.Getpid()+1))
+	var found = false
+	for _, kv := range Sd_notify_child_environment() {
+		if kv == TXT_WATCHDOG_PID+"="+strconv.Itoa(os.Getpid()+1) {
+			found = true
+		}
+	}
+	if found == false {
+		t.Fatal("somebody else's watchdog pid should be passed to the child")
+	}
+}
@@ -0,0 +1,81 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+/* if the handler process gets killed, the deferred device_shutdown never runs, the stree is left
+   dirty and the next start needs --force. so while the handler is running we trap the polite
+	 signals and turn them into the same thing catalog stop does: unmount if we mounted, and destroy
+	 the block device. destroying the block device makes the kernel send the handler an exit request,
+	 the handler returns cleanly and the defers in start_block_device flush and close the stree.
+	 if somebody is impatient and signals us again, we just leave. */
+
+type Signal_handler struct {
+	lib    *Lbd_lib
+	device *Lbd_device
+
+	signals chan os.Signal
+	done    chan bool
+}
+
+func (this *Lbd_lib) start_signal_handler(device *Lbd_device) *Signal_handler {
+	var ret Signal_handler
+	ret.lib = this
+	ret.device = device
+	ret.signals = make(chan os.Signal, 2)
+	ret.done = make(chan bool)
+
+	signal.Notify(ret.signals, syscall.SIGTERM, syscall.SIGINT)
+	go ret.runner()
+	return &ret
+}
+
+func (this *Signal_handler) Stop() {
+	signal.Stop(this.signals)
+	close(this.done)
+}
+
+func (this *Signal_handler) runner() {
+	var log = this.lib.log
+	var shutting_down bool = false
+	for {
+		select {
+		case <-this.done:
+			return
+		case sig := <-this.signals:
+			if shutting_down {
+				log.Error("got second signal ", sig, " while shutting down device: ", this.device.Device_name, ", aborting immediately.")
+				os.Exit(1)
+			}
+			shutting_down = true
+			atomic.StoreInt32(&this.device.stop_requested, 1) // so the restart policy leaves it alone
+			log.Info("got signal ", sig, ", shutting down device: ", this.device.Device_name)
+			/* do this on the side so we can still see a second signal while the kernel hangs up on the handler. */
+			go this.lib.signal_shutdown_device(this.device)
+		}
+	}
+}
+
+func (this *Lbd_lib) signal_shutdown_device(device *Lbd_device) {
+	/* same as catalog stop except we don't let a failed unmount stop us, if we don't shut down
+	   now we're likely to get killed for real and then we're dirty anyway. */
+	syscall.Sync()
+
+	var ret = this.attempt_unmount(device)
+	if ret != nil {
+		this.log.Error("unable to unmount device: ", device.Device_name, " during signal shutdown, destroying it anyway.")
+	}
+
+	ret = this.destroy_block_device(device)
+	this.log_event(EVENT_STOP, device.Device_name, map[string]interface{}{"signal": true}, ret)
+	if ret != nil {
+		this.log.Error("unable to destroy block device: ", device.Device_name, " during signal shutdown, error: ", ret.Get_errmsg())
+	}
+}
@@ -0,0 +1,221 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nixomose/nixomosegotools/tools"
+)
+
+/* start all and stop all used to just walk the catalog map, which go hands you in random order.
+   that's fine until somebody mounts one lbd device inside another one's filesystem, or has
+	 30 of them to bring up at boot and doesn't want to wait for them one at a time.
+	 so each catalog entry can list the devices it has to start after, and we sort the entries
+	 into levels: everything in a level only depends on things in earlier levels, so everything in
+	 a level can be started at the same time. stop goes through the levels backwards. */
+
+const DEFAULT_START_PARALLEL = 4
+const START_AFTER_TIMEOUT_IN_SECONDS = 120
+const START_AFTER_POLL_INTERVAL = 250 * time.Millisecond
+
+func (this *Lbd_lib) get_start_levels(cat *Catalog, entries map[string]*Catalog_entry) (tools.Ret, [][]*Catalog_entry) {
+	/* entries is the set of things we're actually going to start or stop. a dependency on something
+	   that isn't in that set (excluded, or not running) doesn't hold anything up. add, apply and set
+		 start-order don't let you name something that isn't in the catalog, and delete takes it out
+		 of everybody's list, but if one gets in anyway (somebody edited the catalog by hand) we
+		 say so and carry on without it, we're not going to leave everything down over it. */
+
+	var remaining = make(map[string]*Catalog_entry)
+	for _, catentry := range entries {
+		remaining[strings.ToLower(catentry.Device_name)] = catentry
+	}
+
+	for _, catentry := range remaining {
+		for _, after := range catentry.Start_after {
+			if _, ok := remaining[strings.ToLower(after)]; ok == false && this.find_catalog_entry(cat, after) == nil {
+				this.log.Info("WARNING device: ", catentry.Device_name, " is set to start after device: ", after,
+					" which is not in the catalog, ignoring it.")
+			}
+		}
+	}
+
+	var levels = make([][]*Catalog_entry, 0)
+	for len(remaining) > 0 {
+		var level = make([]*Catalog_entry, 0)
+		for _, catentry := range remaining {
+			var ready = true
+			for _, after := range catentry.Start_after {
+				if _, waiting := remaining[strings.ToLower(after)]; waiting {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				level = append(level, catentry)
+			}
+		}
+		if len(level) == 0 {
+			var cycle = make([]string, 0, len(remaining))
+			for _, catentry := range remaining {
+				cycle = append(cycle, catentry.Device_name)
+			}
+			sort.Strings(cycle)
+			return tools.Error(this.log, "the start after settings for these devices depend on each other in a loop: ",
+				strings.Join(cycle, " ")), nil
+		}
+
+		/* within a level, lower priority number goes first, then by name so it's the same every time. */
+		sort.Slice(level, func(i, j int) bool {
+			if level[i].Priority != level[j].Priority {
+				return level[i].Priority < level[j].Priority
+			}
+			return strings.ToLower(level[i].Device_name) < strings.ToLower(level[j].Device_name)
+		})
+		for _, catentry := range level {
+			delete(remaining, strings.ToLower(catentry.Device_name))
+		}
+		levels = append(levels, level)
+	}
+	return nil, levels
+}
+
+func (this *Lbd_lib) get_catalog_device_names(cat *Catalog) map[string]bool {
+	/* lowercase, for checking start after lists against. */
+	var device_names = make(map[string]bool)
+	for _, catentry := range cat.catalog_list.Device_list {
+		device_names[strings.ToLower(catentry.Device_name)] = true
+	}
+	return device_names
+}
+
+func (this *Lbd_lib) get_start_after_problems(device_name string, start_after []string, device_names map[string]bool) []string {
+	/* device_names is the lowercase names of everything this device could start after. */
+	var problems = make([]string, 0)
+	for _, after := range start_after {
+		if strings.ToLower(after) == strings.ToLower(device_name) {
+			problems = append(problems, "device: "+device_name+" can not start after itself")
+		} else if device_names[strings.ToLower(after)] == false {
+			problems = append(problems, "device: "+device_name+" is set to start after device: "+after+
+				" which is not in the catalog")
+		}
+	}
+	return problems
+}
+
+func (this *Lbd_lib) remove_start_after_references(cat *Catalog, device_name string) {
+	/* when a device goes away, nobody should be waiting on it anymore. */
+	var lower_device_name = strings.ToLower(device_name)
+	for _, catentry := range cat.catalog_list.Device_list {
+		var start_after = make([]string, 0, len(catentry.Start_after))
+		for _, after := range catentry.Start_after {
+			if strings.ToLower(after) != lower_device_name {
+				start_after = append(start_after, after)
+			}
+		}
+		if len(start_after) != len(catentry.Start_after) {
+			this.log.Info("device: ", catentry.Device_name, " no longer starts after device: ", device_name)
+			catentry.Start_after = start_after
+		}
+	}
+}
+
+func (this *Lbd_lib) run_parallel(level []*Catalog_entry, parallel int, fn func(catentry *Catalog_entry) tools.Ret) []string {
+	/* run fn on every entry in the level, no more than parallel at a time, in the order they're
+	   in the level, and return the names of the ones that failed. */
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var failed_device_list = make([]string, 0)
+	var failed_lock sync.Mutex
+	var slots = make(chan bool, parallel)
+	var wg sync.WaitGroup
+
+	for _, catentry := range level {
+		slots <- true
+		wg.Add(1)
+		go func(catentry *Catalog_entry) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			var ret = fn(catentry)
+			if ret != nil {
+				failed_lock.Lock()
+				failed_device_list = append(failed_device_list, catentry.Device_name)
+				failed_lock.Unlock()
+			}
+		}(catentry)
+	}
+	wg.Wait()
+	sort.Strings(failed_device_list)
+	return failed_device_list
+}
+
+func (this *Lbd_lib) wait_for_start_after(cat *Catalog, catentry *Catalog_entry, starting_set map[string]bool,
+	failed_set map[string]bool) tools.Ret {
+	/* the previous level was started in the background, so wait here until everything this device
+	   starts after shows up as an active device, and if it mounts, until it's mounted, because
+		 that's the whole point of waiting. failed_set is only written between levels so
+		 it's safe to read here. starting_set is the lowercase names of everything we're starting. */
+
+	for _, after := range catentry.Start_after {
+		var afterentry = this.find_catalog_entry(cat, after)
+		if afterentry == nil {
+			continue // get_start_levels already warned about this
+		}
+		if failed_set[strings.ToLower(afterentry.Device_name)] {
+			return tools.Error(this.log, "not starting device: ", catentry.Device_name, " because device: ",
+				afterentry.Device_name, " failed to start")
+		}
+		if starting_set[strings.ToLower(afterentry.Device_name)] == false {
+			/* if it's excluded, broken or not selected it's not our job to start it, but if it's up, wait for it anyway. */
+			var ret, map_of_devices = this.get_active_device_map()
+			if ret != nil {
+				return ret
+			}
+			if _, ok := map_of_devices[strings.ToLower(afterentry.Device_name)]; ok == false {
+				continue
+			}
+		}
+
+		var ret = this.wait_for_device_ready(afterentry)
+		if ret != nil {
+			return tools.Error(this.log, "not starting device: ", catentry.Device_name, " because device: ",
+				afterentry.Device_name, " did not come up")
+		}
+	}
+	return nil
+}
+
+func (this *Lbd_lib) wait_for_device_ready(catentry *Catalog_entry) tools.Ret {
+	var lower_device_name = strings.ToLower(catentry.Device_name)
+	var deadline = time.Now().Add(START_AFTER_TIMEOUT_IN_SECONDS * time.Second)
+	for {
+		var ret, map_of_devices = this.get_active_device_map()
+		if ret != nil {
+			return ret
+		}
+		var _, active = map_of_devices[lower_device_name]
+		if active {
+			if catentry.Mount == false {
+				return nil
+			}
+			var mounted bool
+			ret, mounted = tools.Is_mounted(this.log, catentry.Mountpoint)
+			if ret != nil {
+				return ret
+			}
+			if mounted {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return tools.Error(this.log, "timed out waiting for device: ", catentry.Device_name, " to start")
+		}
+		time.Sleep(START_AFTER_POLL_INTERVAL)
+	}
+}
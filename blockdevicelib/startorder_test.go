@@ -0,0 +1,180 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nixomose/nixomosegotools/tools"
+)
+
+func new_test_lbd_lib(t *testing.T) *Lbd_lib {
+	var ret, lib = New_blockdevicelib("test")
+	if ret != nil {
+		t.Fatal(ret.Get_errmsg())
+	}
+	lib.Set_log(tools.New_Nixomosetools_logger(tools.ERROR))
+	return lib
+}
+
+type test_start_entry struct {
+	name        string
+	priority    int
+	start_after []string
+}
+
+func make_test_catalog(entries []test_start_entry) (*Catalog, map[string]*Catalog_entry) {
+	var cat = New_catalog(tools.New_Nixomosetools_logger(tools.ERROR), "", "")
+	var selected = make(map[string]*Catalog_entry)
+	for _, e := range entries {
+		var catentry = &Catalog_entry{Device_name: e.name, Priority: e.priority, Start_after: e.start_after}
+		cat.catalog_list.Device_list[e.name] = catentry
+		selected[e.name] = catentry
+	}
+	return cat, selected
+}
+
+func level_names(levels [][]*Catalog_entry) [][]string {
+	var names = make([][]string, 0, len(levels))
+	for _, level := range levels {
+		var l = make([]string, 0, len(level))
+		for _, catentry := range level {
+			l = append(l, catentry.Device_name)
+		}
+		names = append(names, l)
+	}
+	return names
+}
+
+func TestGetStartLevels(t *testing.T) {
+	var lib = new_test_lbd_lib(t)
+	var cases = []struct {
+		name    string
+		entries []test_start_entry
+		want    [][]string
+		err     string
+	}{
+		{"no dependencies",
+			[]test_start_entry{{"c", 0, nil}, {"a", 0, nil}, {"b", 0, nil}},
+			[][]string{{"a", "b", "c"}}, ""},
+		{"chain",
+			[]test_start_entry{{"a", 0, []string{"b"}}, {"b", 0, []string{"c"}}, {"c", 0, nil}},
+			[][]string{{"c"}, {"b"}, {"a"}}, ""},
+		{"diamond",
+			[]test_start_entry{{"top", 0, nil}, {"left", 0, []string{"top"}}, {"right", 0, []string{"top"}},
+				{"bottom", 0, []string{"left", "right"}}},
+			[][]string{{"top"}, {"left", "right"}, {"bottom"}}, ""},
+		{"priority then name",
+			[]test_start_entry{{"b", 5, nil}, {"c", 1, nil}, {"a", 5, nil}, {"d", 9, nil}},
+			[][]string{{"c", "a", "b", "d"}}, ""},
+		{"names are case insensitive",
+			[]test_start_entry{{"Data", 0, []string{"ROOT"}}, {"Root", 0, nil}},
+			[][]string{{"Root"}, {"Data"}}, ""},
+		{"missing dependency is ignored",
+			[]test_start_entry{{"a", 0, []string{"ghost"}}, {"b", 0, []string{"a"}}},
+			[][]string{{"a"}, {"b"}}, ""},
+		{"self reference",
+			[]test_start_entry{{"a", 0, []string{"a"}}, {"b", 0, nil}},
+			nil, "depend on each other in a loop: a"},
+		{"cycle",
+			[]test_start_entry{{"a", 0, []string{"c"}}, {"b", 0, []string{"a"}}, {"c", 0, []string{"b"}}, {"d", 0, nil},
+				{"e", 0, []string{"a"}}},
+			nil, "depend on each other in a loop: a b c e"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var cat, entries = make_test_catalog(c.entries)
+			var ret, levels = lib.get_start_levels(cat, entries)
+			if len(c.err) > 0 {
+				expect_error_containing(t, ret, c.err)
+				return
+			}
+			if ret != nil {
+				t.Fatal(ret.Get_errmsg())
+			}
+			if got := level_names(levels); reflect.DeepEqual(got, c.want) == false {
+				t.Fatalf("expected levels %v, got %v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestGetStartLevelsOnlyWaitsForSelected(t *testing.T) {
+	/* b is in the catalog but not being started, so a doesn't wait on it. */
+	var lib = new_test_lbd_lib(t)
+	var cat, entries = make_test_catalog([]test_start_entry{{"a", 0, []string{"b"}}, {"b", 0, nil}, {"c", 0, []string{"a"}}})
+	delete(entries, "b")
+	var ret, levels = lib.get_start_levels(cat, entries)
+	if ret != nil {
+		t.Fatal(ret.Get_errmsg())
+	}
+	var want = [][]string{{"a"}, {"c"}}
+	if got := level_names(levels); reflect.DeepEqual(got, want) == false {
+		t.Fatalf("expected levels %v, got %v", want, got)
+	}
+}
+
+func TestRunParallel(t *testing.T) {
+	var lib = new_test_lbd_lib(t)
+	var level = make([]*Catalog_entry, 0)
+	for lp := 0; lp < 10; lp++ {
+		level = append(level, &Catalog_entry{Device_name: fmt.Sprintf("dev%d", lp)})
+	}
+
+	for _, parallel := range []int{0, 1, 3, 20} {
+		t.Run(fmt.Sprintf("parallel %d", parallel), func(t *testing.T) {
+			var running int32
+			var most int32
+			var started = make([]string, 0)
+			var started_lock sync.Mutex
+			var failed = lib.run_parallel(level, parallel, func(catentry *Catalog_entry) tools.Ret {
+				started_lock.Lock()
+				started = append(started, catentry.Device_name)
+				started_lock.Unlock()
+				var now = atomic.AddInt32(&running, 1)
+				for {
+					var m = atomic.LoadInt32(&most)
+					if now <= m || atomic.CompareAndSwapInt32(&most, m, now) {
+						break
+					}
+				}
+				time.Sleep(5 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				if catentry.Device_name == "dev7" || catentry.Device_name == "dev2" {
+					return tools.Error(lib.log, "failed on purpose")
+				}
+				return nil
+			})
+
+			var limit = int32(parallel)
+			if limit < 1 {
+				limit = 1
+			}
+			if limit > int32(len(level)) {
+				limit = int32(len(level))
+			}
+			if most > limit {
+				t.Fatalf("expected at most %d running at once, got %d", limit, most)
+			}
+			if len(started) != len(level) {
+				t.Fatalf("expected all %d to run, %d did", len(level), len(started))
+			}
+			if limit == 1 {
+				for lp, name := range started {
+					if name != level[lp].Device_name {
+						t.Fatalf("expected them to run in level order, got %v", started)
+					}
+				}
+			}
+			if reflect.DeepEqual(failed, []string{"dev2", "dev7"}) == false {
+				t.Fatalf("expected dev2 and dev7 to fail, got %v", failed)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+// SPDX-License-Identifier: LGPL-2.1
+// Copyright (C) 2021-2022 stu mark
+
+package blockdevicelib
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/nixomose/nixomosegotools/tools"
+	"github.com/nixomose/stree_v/stree_v_lib/stree_v_lib"
+	"github.com/nixomose/zosbd2goclient/zosbd2cmdlib"
+)
+
+/* device-status only knows what the kernel knows, catalog list only knows what's in the toml, and
+   storage-status needs you to know where the backing store is. catalog status puts it all together
+	 so you can see in one place what's defined, what's running, and what's running that nobody
+	 defined (orphaned, usually left over from a catalog delete while it was up). */
+
+const STATE_DEFINED = "defined"   // in the catalog, not running
+const STATE_RUNNING = "running"   // in the catalog and the kernel
+const STATE_ORPHANED = "orphaned" // in the kernel, not in the catalog
+
+const TXT_PROC = "/proc"
+const TXT_PROC_CMDLINE = "cmdline"
+
+type Storage_state struct {
+	Initialized  bool   `json:"initialized"`
+	Dirty        bool   `json:"dirty"`
+	Total_blocks uint32 `json:"total_blocks"`
+	Used_blocks  uint32 `json:"used_blocks"` // the free position, block zero is the header
+	Block_size   uint32 `json:"block_size_in_bytes"`
+	Used_percent uint64 `json:"used_percent"`
+	Mirror       string `json:"mirror,omitempty"` // in sync, out of date or primary out of date
+}
+
+type Device_state struct {
+	Device_name string `json:"device_name"`
+	State       string `json:"state"`
+	Broken      string `json:"broken,omitempty"`
+
+	Handler_pid int `json:"handler_pid,omitempty"`
+
+	Mount      bool   `json:"mount"`
+	Mountpoint string `json:"mountpoint,omitempty"`
+	Mounted    bool   `json:"mounted"`
+
+	Local_storage_file string         `json:"local_storage_file,omitempty"`
+	Storage            *Storage_state `json:"storage,omitempty"`
+	Storage_error      string         `json:"storage_error,omitempty"`
+
+	Kernel *zosbd2cmdlib.Device_status `json:"kernel,omitempty"`
+}
+
+func (this *Lbd_lib) get_storage_state(device *Lbd_device) (tools.Ret, *Storage_state) {
+	/* open the backing store read only and see what the header says. this is safe to do while the
+	   device is running, we never write, but then of course it's going to say it's dirty. */
+	var key_length, value_length, additional_nodes_per_block, key_type, value_type = this.get_init_size_values(device)
+
+	var ret, block_size = stree_v_lib.Calculate_block_size(this.log, key_type, value_type, key_length, value_length, additional_nodes_per_block)
+	if ret != nil {
+		return ret, nil
+	}
+
+	var fstore Lbd_file_store
+	ret, fstore = this.make_backing_store(device, block_size)
+	if ret != nil {
+		return ret, nil
+	}
+
+	var state Storage_state
+	ret = fstore.Open_datastore_readonly()
+	if ret != nil {
+		if ret.Get_errcode() == int(syscall.ENOENT) {
+			return nil, &state // not created yet, so not initialized
+		}
+		return ret, nil
+	}
+	defer fstore.Shutdown()
+
+	ret = fstore.Load_header_and_check_magic(false)
+	if ret != nil {
+		return nil, &state // no magic, not initialized
+	}
+	state.Initialized = true
+
+	ret, state.Dirty = this.get_store_dirty(fstore)
+	if ret != nil {
+		return ret, nil
+	}
+
+	ret, state.Total_blocks = fstore.Get_total_blocks()
+	if ret != nil {
+		return ret, nil
+	}
+	ret, state.Used_blocks = fstore.Get_free_position()
+	if ret != nil {
+		return ret, nil
+	}
+	state.Block_size = block_size
+	if state.Total_blocks > 0 {
+		state.Used_percent = uint64(state.Used_blocks) * 100 / uint64(state.Total_blocks)
+	}
+	if len(device.Mirror_storage_file) > 0 {
+		ret, state.Mirror = this.get_mirror_state(device, block_size)
+		if ret != nil {
+			return ret, nil
+		}
+	}
+	return nil, &state
+}
+
+func (this *Lbd_lib) get_store_dirty(fstore Lbd_file_store) (tools.Ret, bool) {
+	/* the dirty flag isn't available any other way than the store information, so pick it out of there. */
+	var ret, info_json = fstore.Get_store_information()
+	if ret != nil {
+		return ret, false
+	}
+	var info map[string]string
+	var err = json.Unmarshal([]byte(info_json), &info)
+	if err != nil {
+		return tools.Error(this.log, "unable to parse backing store information, err: ", err), false
+	}
+	return nil, strings.ReplaceAll(info["dirty"], ",", "") != "0"
+}
+
+func (this *Lbd_lib) find_handler_pid(device_name string) int {
+	/* the kernel doesn't know who's serving a device, so go look for a process that's us, serving
+	   this device, either as the dragons child or in the foreground. */
+	var executable, err = os.Executable()
+	if err != nil {
+		return 0
+	}
+	var self = filepath.Base(executable)
+
+	entries, err := os.ReadDir(TXT_PROC)
+	if err != nil {
+		return 0
+	}
+	var lower_device_name = strings.ToLower(device_name)
+	for _, entry := range entries {
+		var pid, err = strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		var cmdline []byte
+		cmdline, err = os.ReadFile(filepath.Join(TXT_PROC, entry.Name(), TXT_PROC_CMDLINE))
+		if err != nil || len(cmdline) == 0 {
+			continue
+		}
+		var args = strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+		if filepath.Base(args[0]) != self {
+			continue
+		}
+		var serving = false
+		var this_device = false
+		for lp, arg := range args {
+			switch arg {
+			case "--" + TXT_DRAGONS, "-H", "--" + TXT_FOREGROUND, "-F":
+				serving = true
+			case "--" + TXT_DEVICE_NAME, "-d":
+				if lp+1 < len(args) && strings.ToLower(args[lp+1]) == lower_device_name {
+					this_device = true
+				}
+			default:
+				if strings.ToLower(arg) == "--"+TXT_DEVICE_NAME+"="+lower_device_name {
+					this_device = true
+				}
+			}
+		}
+		if serving && this_device {
+			return pid
+		}
+	}
+	return 0
+}
+
+func (this *Lbd_lib) get_device_state(catentry *Catalog_entry, kernel_status *zosbd2cmdlib.Device_status) *Device_state {
+	var state Device_state
+	if catentry != nil {
+		state.Device_name = catentry.Device_name
+	} else {
+		state.Device_name = kernel_status.Device_name
+	}
+
+	switch {
+	case catentry != nil && kernel_status != nil:
+		state.State = STATE_RUNNING
+	case catentry != nil:
+		state.State = STATE_DEFINED
+	default:
+		state.State = STATE_ORPHANED
+	}
+
+	if kernel_status != nil {
+		var status = *kernel_status
+		state.Kernel = &status
+		state.Handler_pid = this.find_handler_pid(state.Device_name)
+	}
+
+	if catentry == nil {
+		return &state
+	}
+
+	state.Broken = catentry.Broken
+	state.Mount = catentry.Mount
+	state.Mountpoint = catentry.Mountpoint
+	if len(catentry.Mountpoint) > 0 {
+		var ret, mounted = tools.Is_mounted(this.log, catentry.Mountpoint)
+		if ret == nil {
+			state.Mounted = mounted
+		}
+	}
+
+	state.Local_storage_file = catentry.Local_storage_file
+	var device = this.New_block_device_from_catalog_entry(catentry)
+	var ret, storage = this.get_storage_state(device)
+	if ret != nil {
+		state.Storage_error = ret.Get_errmsg()
+	} else {
+		state.Storage = storage
+	}
+	return &state
+}
+
+func (this *Lbd_lib) catalog_status(cat *Catalog, device_name string) tools.Ret {
+	/* show everything we know about one or all devices, defined or running. */
+
+	var ret = this.catalog.Read_catalog(cat)
+	if ret != nil {
+		return ret
+	}
+
+	var map_of_devices map[string]zosbd2cmdlib.Device_status
+	ret, map_of_devices = this.get_active_device_map()
+	if ret != nil {
+		/* no kernel module loaded is still worth reporting on what's defined. */
+		this.log.Error("unable to get active devices, showing catalog only.")
+		map_of_devices = make(map[string]zosbd2cmdlib.Device_status)
+	}
+
+	var states = make([]*Device_state, 0)
+	if len(device_name) > 0 {
+		var catentry = this.find_catalog_entry(cat, device_name)
+		var kernel_status, running = map_of_devices[strings.ToLower(device_name)]
+		if catentry == nil && running == false {
+			return tools.Error(this.log, "device: ", device_name, " not found")
+		}
+		var kernel_status_ptr *zosbd2cmdlib.Device_status = nil
+		if running {
+			kernel_status_ptr = &kernel_status
+		}
+		states = append(states, this.get_device_state(catentry, kernel_status_ptr))
+	} else {
+		var seen = make(map[string]bool)
+		for _, catentry := range cat.catalog_list.Device_list {
+			var lower_device_name = strings.ToLower(catentry.Device_name)
+			seen[lower_device_name] = true
+			var kernel_status_ptr *zosbd2cmdlib.Device_status = nil
+			if kernel_status, running := map_of_devices[lower_device_name]; running {
+				kernel_status_ptr = &kernel_status
+			}
+			states = append(states, this.get_device_state(catentry, kernel_status_ptr))
+		}
+		for lower_device_name, kernel_status := range map_of_devices {
+			if seen[lower_device_name] {
+				continue
+			}
+			var kernel_status_copy = kernel_status
+			states = append(states, this.get_device_state(nil, &kernel_status_copy))
+		}
+		sort.Slice(states, func(i, j int) bool {
+			return strings.ToLower(states[i].Device_name) < strings.ToLower(states[j].Device_name)
+		})
+	}
+
+	var bytesout, err = json.MarshalIndent(states, "", " ")
+	if err != nil {
+		return tools.Error(this.log, "unable to marshal device status into json, err: ", err)
+	}
+	fmt.Println(string(bytesout))
+	return nil
+}
@@ -18,11 +18,11 @@ require (
 	github.com/nixomose/stree_v v0.0.0-20220601010258-cf6c88e1694e
 	github.com/nixomose/zosbd2goclient v0.0.0-20220531234136-1d6059846b15
 	github.com/spf13/cobra v1.4.0
+	github.com/spf13/pflag v1.0.5
 )
 
 require (
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/ncw/directio v1.0.5 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
 	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a // indirect
 )